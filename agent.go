@@ -0,0 +1,50 @@
+package rcom
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Agent authenticates with the keys, and certificates, held by the
+// ssh-agent listening on SSH_AUTH_SOCK in addition to any identity files
+func Agent() ConfigOption {
+	return func(config *Config) error {
+		config.useAgent = true
+		config.agentOptional = false
+		return nil
+	}
+}
+
+// AgentFromEnvironment uses the ssh-agent at SSH_AUTH_SOCK, when it is
+// set, like Agent.  An agent that can not be reached is logged and the
+// identity files are used without it
+func AgentFromEnvironment() ConfigOption {
+	return func(config *Config) error {
+		if os.Getenv("SSH_AUTH_SOCK") != "" {
+			config.useAgent = true
+			config.agentOptional = true
+		}
+		return nil
+	}
+}
+
+// dialAgent connects to the ssh-agent at SSH_AUTH_SOCK
+func (config *Config) dialAgent() error {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return fmt.Errorf("Failed to connect to ssh-agent: SSH_AUTH_SOCK is not set")
+	}
+
+	c, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to ssh-agent: %v", err)
+	}
+
+	Logger.Printf("Using ssh-agent at %s", socket)
+	config.agentConn = c
+	config.agent = agent.NewClient(c)
+	return nil
+}
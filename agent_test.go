@@ -0,0 +1,128 @@
+package rcom
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveAgent serves a keyring holding a new key on a unix socket in
+// dir, the public key of the keyring and the socket are returned
+func serveAgent(t *testing.T, dir string) (ssh.PublicKey, string) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "agent key"}); err != nil {
+		t.Fatalf("Failed to add key to the keyring: %v", err)
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", socket, err)
+	}
+
+	go func() {
+		defer listener.Close()
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("Failed to get the public key: %v", err)
+	}
+	return pub, socket
+}
+
+func TestAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, socket := serveAgent(t, dir)
+	defer setenv("SSH_AUTH_SOCK", &socket)()
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	// only the key held by the agent is accepted, the identity file
+	// of the connection is not
+	server.authorize(key)
+	for _, option := range []ConfigOption{Agent(), AgentFromEnvironment()} {
+		conn := server.connect(t, option, KeepAlive(0))
+		if conn.config.agent == nil {
+			t.Errorf("The agent was not used")
+		}
+		conn.Close()
+
+		if _, err := conn.config.agent.List(); err == nil {
+			t.Errorf("The agent connection is still open after Close")
+		}
+	}
+
+	if conn, err := server.dial(t, KeepAlive(0)); err == nil {
+		conn.Close()
+		t.Errorf("Logged in with the agent key without using the agent")
+	}
+}
+
+func TestAgentStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	stale := filepath.Join(dir, "gone.sock")
+	defer setenv("SSH_AUTH_SOCK", &stale)()
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	// an agent that was asked for must be reachable
+	if conn, err := server.dial(t, Agent(), KeepAlive(0)); err == nil {
+		conn.Close()
+		t.Errorf("Connected although the requested agent is not running")
+	}
+
+	// the agent from the environment is skipped and the identity file
+	// is used
+	conn := server.connect(t, AgentFromEnvironment(), KeepAlive(0))
+	if conn.config.agent != nil {
+		t.Errorf("A stale agent socket was used")
+	}
+	conn.Close()
+}
+
+func TestAgentFromEnvironmentUnset(t *testing.T) {
+	defer setenv("SSH_AUTH_SOCK", nil)()
+	config := &Config{}
+	if err := AgentFromEnvironment()(config); err != nil {
+		t.Fatalf("AgentFromEnvironment failed: %v", err)
+	}
+
+	if config.useAgent {
+		t.Errorf("The agent is used without SSH_AUTH_SOCK")
+	}
+}
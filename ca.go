@@ -0,0 +1,221 @@
+package rcom
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certificateBackdate is how long before the time of signing a
+// certificate becomes valid, to allow for clocks that are behind
+const certificateBackdate = 5 * time.Minute
+
+// certificateExtensions are the permissions of a user certificate, the
+// defaults of ssh-keygen
+var certificateExtensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
+// CertificateOptions describe the user certificate issued by SignUserKey
+type CertificateOptions struct {
+	// KeyID identifies the certificate in the logs of the server
+	KeyID string
+
+	// Principals are the users the certificate can log in as
+	Principals []string
+
+	// Validity is how long the certificate is valid, zero for ever
+	Validity time.Duration
+
+	// ForceCommand is the only command the certificate may run
+	ForceCommand string
+
+	// SourceAddresses are the addresses or CIDR ranges the certificate
+	// may be used from
+	SourceAddresses []string
+}
+
+// LoadPrivateKey reads the OpenSSH or PEM private key in file.  For an
+// encrypted key the passphrase is asked for, with DefaultPassphrase when
+// passphrase is nil
+func LoadPrivateKey(file string, passphrase PassphraseFunc) (PrivateKey, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read private key %s: %v", file, err)
+	}
+
+	if passphrase == nil {
+		passphrase = DefaultPassphrase
+	}
+
+	key, err := ssh.ParseRawPrivateKey(buf)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		var pass []byte
+		pass, err = passphrase(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(buf, pass)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse private key %s: %v", file, err)
+	}
+
+	// ed25519 keys are returned by reference
+	if k, ok := key.(*ed25519.PrivateKey); ok {
+		key = *k
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key %s: %T", file, key)
+	}
+	return privateKey{signer}, nil
+}
+
+// SignUserKey issues a user certificate for pub signed by the CA key
+func SignUserKey(ca PrivateKey, pub *PublicKey, options CertificateOptions) (*PublicKey, error) {
+	if _, ok := pub.PublicKey.(*ssh.Certificate); ok {
+		return nil, fmt.Errorf("Can not sign a certificate, sign the public key it certifies")
+	}
+
+	if len(options.Principals) == 0 {
+		return nil, fmt.Errorf("A certificate needs at least one principal")
+	}
+
+	for _, addr := range options.SourceAddresses {
+		if _, _, err := net.ParseCIDR(addr); err != nil && net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("Invalid source address %q: expected an IP address or CIDR range", addr)
+		}
+	}
+
+	signer, err := ssh.NewSignerFromSigner(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	serial := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, serial); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub.PublicKey,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        ssh.UserCert,
+		KeyId:           options.KeyID,
+		ValidPrincipals: options.Principals,
+		ValidAfter:      uint64(now.Add(-certificateBackdate).Unix()),
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions: ssh.Permissions{
+			CriticalOptions: make(map[string]string),
+			Extensions:      make(map[string]string),
+		},
+	}
+
+	if options.Validity > 0 {
+		cert.ValidBefore = uint64(now.Add(options.Validity).Unix())
+	}
+
+	for name, value := range certificateExtensions {
+		cert.Extensions[name] = value
+	}
+
+	if options.ForceCommand != "" {
+		cert.CriticalOptions["force-command"] = options.ForceCommand
+	}
+
+	if len(options.SourceAddresses) > 0 {
+		cert.CriticalOptions["source-address"] = strings.Join(options.SourceAddresses, ",")
+	}
+
+	// OpenSSH no longer accepts certificates signed with SHA-1 RSA
+	// signatures
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		signer = rsaSHA512Signer{algorithmSigner}
+	}
+
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return nil, fmt.Errorf("Failed to sign certificate: %v", err)
+	}
+	return &PublicKey{cert}, nil
+}
+
+// SignKey signs the public key in keyfile with the CA private key in
+// caKeyfile and writes the certificate to the <key>-cert.pub file that
+// the identity file <key> is used with.  When keyfile is "-" the key is
+// read from stdin and the certificate written to stdout.  The key ID
+// defaults to the principals
+func SignKey(caKeyfile, keyfile string, options CertificateOptions) error {
+	ca, err := LoadPrivateKey(caKeyfile, nil)
+	if err != nil {
+		return err
+	}
+
+	pub, err := readPublicKey(keyfile)
+	if err != nil {
+		return fmt.Errorf("Failed to read public key %s: %v", keyfile, err)
+	}
+
+	if options.KeyID == "" {
+		options.KeyID = strings.Join(options.Principals, ",")
+	}
+
+	cert, err := SignUserKey(ca, pub, options)
+	if err != nil {
+		return err
+	}
+
+	b, _ := cert.MarshalBinary()
+	if keyfile == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+
+	certfile := strings.TrimSuffix(keyfile, ".pub") + "-cert.pub"
+	Logger.Printf("Signed %s key %s as %s for %s, serial %d", pub.Type(), ssh.FingerprintSHA256(pub), options.KeyID, strings.Join(options.Principals, ","), cert.PublicKey.(*ssh.Certificate).Serial)
+	if err := ioutil.WriteFile(certfile, b, 0644); err != nil {
+		return fmt.Errorf("Failed to write certificate %s: %v", certfile, err)
+	}
+	return nil
+}
+
+// rsaSHA512Signer signs with rsa-sha2-512 instead of ssh-rsa
+type rsaSHA512Signer struct {
+	ssh.AlgorithmSigner
+}
+
+func (s rsaSHA512Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, ssh.SigAlgoRSASHA2512)
+}
+
+// AuthorizeCertAuthority adds the CA public key in keyfile to the
+// authorized_keys file as a cert-authority line, so that the user
+// certificates it signs are accepted
+func AuthorizeCertAuthority(keyfile, authorizedKeys string) error {
+	pk, err := readPublicKey(keyfile)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := pk.PublicKey.(*ssh.Certificate); ok {
+		return fmt.Errorf("%s is a certificate, not a CA public key", keyfile)
+	}
+	return appendAuthorizedKey(authorizedKeys, append([]byte("cert-authority "), ssh.MarshalAuthorizedKey(pk)...))
+}
@@ -0,0 +1,229 @@
+package rcom
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSignUserKey(t *testing.T) {
+	user, err := NewPrivateKey(Ed25519Key, 0)
+	if err != nil {
+		t.Fatalf("NewPrivateKey failed: %v", err)
+	}
+
+	pub, err := user.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey failed: %v", err)
+	}
+
+	tests := []struct {
+		keyType string
+		bitsize int
+		sigAlgo string
+	}{
+		{Ed25519Key, 0, ssh.KeyAlgoED25519},
+		{ECDSAKey, 256, ssh.KeyAlgoECDSA256},
+		{RSAKey, 2048, ssh.SigAlgoRSASHA2512},
+	}
+
+	for _, test := range tests {
+		ca, err := NewPrivateKey(test.keyType, test.bitsize)
+		if err != nil {
+			t.Fatalf("NewPrivateKey(%s) failed: %v", test.keyType, err)
+		}
+		caPub, _ := ca.PublicKey()
+
+		options := CertificateOptions{
+			KeyID:           "alice@laptop",
+			Principals:      []string{"alice", "admin"},
+			Validity:        time.Hour,
+			ForceCommand:    "rcom server-dispatch /dev/ttyS0",
+			SourceAddresses: []string{"192.0.2.0/24", "2001:db8::1"},
+		}
+
+		start := time.Now()
+		signed, err := SignUserKey(ca, pub, options)
+		if err != nil {
+			t.Fatalf("%s: SignUserKey failed: %v", test.keyType, err)
+		}
+
+		cert, ok := signed.PublicKey.(*ssh.Certificate)
+		if !ok {
+			t.Fatalf("%s: SignUserKey returned a %s key, want a certificate", test.keyType, signed.Type())
+		}
+
+		if cert.CertType != ssh.UserCert || cert.KeyId != options.KeyID || !bytes.Equal(cert.Key.Marshal(), pub.Marshal()) {
+			t.Errorf("%s: certificate of type %d for %s with ID %q, want a user certificate for the key", test.keyType, cert.CertType, ssh.FingerprintSHA256(cert.Key), cert.KeyId)
+		}
+
+		if strings.Join(cert.ValidPrincipals, ",") != "alice,admin" {
+			t.Errorf("%s: principals %q, want alice and admin", test.keyType, cert.ValidPrincipals)
+		}
+
+		// the certificate is backdated for clocks that are behind
+		after := time.Unix(int64(cert.ValidAfter), 0)
+		before := time.Unix(int64(cert.ValidBefore), 0)
+		if after.After(start.Add(-certificateBackdate)) || after.Before(start.Add(-certificateBackdate-time.Minute)) {
+			t.Errorf("%s: valid after %v, want about %v", test.keyType, after, start.Add(-certificateBackdate))
+		}
+
+		if before.Before(start.Add(time.Hour-time.Second)) || before.After(time.Now().Add(time.Hour)) {
+			t.Errorf("%s: valid before %v, want about %v", test.keyType, before, start.Add(time.Hour))
+		}
+
+		if got := cert.CriticalOptions["force-command"]; got != options.ForceCommand {
+			t.Errorf("%s: force-command %q, want %q", test.keyType, got, options.ForceCommand)
+		}
+
+		if got := cert.CriticalOptions["source-address"]; got != "192.0.2.0/24,2001:db8::1" {
+			t.Errorf("%s: source-address %q, want both addresses", test.keyType, got)
+		}
+
+		if _, ok := cert.Extensions["permit-pty"]; !ok {
+			t.Errorf("%s: extensions %v, want the ssh-keygen defaults", test.keyType, cert.Extensions)
+		}
+
+		if cert.Signature.Format != test.sigAlgo {
+			t.Errorf("%s: signed with %s, want %s", test.keyType, cert.Signature.Format, test.sigAlgo)
+		}
+
+		// the server accepts the certificate for its principals
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				return bytes.Equal(auth.Marshal(), caPub.Marshal())
+			},
+			SupportedCriticalOptions: []string{"force-command", "source-address"},
+		}
+
+		if err := checker.CheckCert("admin", cert); err != nil {
+			t.Errorf("%s: certificate refused: %v", test.keyType, err)
+		}
+
+		if err := checker.CheckCert("root", cert); err == nil {
+			t.Errorf("%s: certificate accepted for another principal", test.keyType)
+		}
+	}
+}
+
+func TestSignUserKeyInvalid(t *testing.T) {
+	ca, err := NewPrivateKey(Ed25519Key, 0)
+	if err != nil {
+		t.Fatalf("NewPrivateKey failed: %v", err)
+	}
+
+	pub, _ := ca.PublicKey()
+	cert, err := SignUserKey(ca, pub, CertificateOptions{Principals: []string{"alice"}})
+	if err != nil {
+		t.Fatalf("SignUserKey failed: %v", err)
+	}
+
+	if c := cert.PublicKey.(*ssh.Certificate); c.ValidBefore != ssh.CertTimeInfinity {
+		t.Errorf("Certificate without a validity expires at %d", c.ValidBefore)
+	}
+
+	tests := []struct {
+		name    string
+		pub     *PublicKey
+		options CertificateOptions
+	}{
+		{"no principals", pub, CertificateOptions{}},
+		{"invalid source address", pub, CertificateOptions{Principals: []string{"alice"}, SourceAddresses: []string{"example.com"}}},
+		{"certificate", cert, CertificateOptions{Principals: []string{"alice"}}},
+	}
+
+	for _, test := range tests {
+		if _, err := SignUserKey(ca, test.pub, test.options); err == nil {
+			t.Errorf("%s: SignUserKey succeeded", test.name)
+		}
+	}
+}
+
+func TestSignKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caKeyfile := filepath.Join(dir, "ca")
+	keyfile := filepath.Join(dir, "id_ed25519")
+	if err := GenerateKey(Ed25519Key, 0, caKeyfile, "ca", nil); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	if err := GenerateKey(Ed25519Key, 0, keyfile, "alice", nil); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	// signing the private or the public key file writes the certificate
+	// the identity file is used with
+	for _, file := range []string{keyfile, keyfile + ".pub"} {
+		os.Remove(keyfile + "-cert.pub")
+		if err := SignKey(caKeyfile, file, CertificateOptions{Principals: []string{"alice", "admin"}}); err != nil {
+			t.Fatalf("SignKey(%s) failed: %v", file, err)
+		}
+
+		config := &Config{}
+		if err := IdentityFile(keyfile)(config); err != nil {
+			t.Fatalf("IdentityFile failed: %v", err)
+		}
+
+		if len(config.certificates) != 1 || config.certificates[0].cert.KeyId != "alice,admin" {
+			t.Errorf("SignKey(%s) wrote %+v, want a certificate with the principals as key ID", file, config.certificates)
+		}
+	}
+}
+
+func TestAuthorizeCertAuthority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caKeyfile := filepath.Join(dir, "ca")
+	if err := GenerateKey(Ed25519Key, 0, caKeyfile, "ca", nil); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	authorizedKeys := filepath.Join(dir, "ssh", "authorized_keys")
+	if err := AuthorizeCertAuthority(caKeyfile, authorizedKeys); err != nil {
+		t.Fatalf("AuthorizeCertAuthority failed: %v", err)
+	}
+
+	buf, err := ioutil.ReadFile(authorizedKeys)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", authorizedKeys, err)
+	}
+
+	key, _, options, rest, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("authorized_keys is %q: %v", buf, err)
+	}
+
+	pub, _ := readPublicKey(caKeyfile)
+	if len(options) != 1 || options[0] != "cert-authority" || !bytes.Equal(key.Marshal(), pub.Marshal()) {
+		t.Errorf("authorized_keys is %q, want a cert-authority line for the CA", buf)
+	}
+
+	// a certificate is not a CA key
+	ca, _ := LoadPrivateKey(caKeyfile, nil)
+	cert, err := SignUserKey(ca, pub, CertificateOptions{Principals: []string{"alice"}})
+	if err != nil {
+		t.Fatalf("SignUserKey failed: %v", err)
+	}
+
+	certfile := filepath.Join(dir, "ca-cert.pub")
+	b, _ := cert.MarshalBinary()
+	ioutil.WriteFile(certfile, b, 0644)
+	if err := AuthorizeCertAuthority(certfile, authorizedKeys); err == nil {
+		t.Errorf("A certificate was authorized as a CA")
+	}
+}
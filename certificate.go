@@ -0,0 +1,117 @@
+package rcom
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certificate is an OpenSSH user certificate and the file it was read
+// from
+type certificate struct {
+	file string
+	cert *ssh.Certificate
+}
+
+// CertificateFile adds the OpenSSH user certificate in file.  It is used
+// with the identity file or ssh-agent key that it certifies.  The
+// certificate of an identity file is also picked up from the
+// <identity>-cert.pub file next to it
+func CertificateFile(file string) ConfigOption {
+	return func(config *Config) error {
+		if file == "" {
+			return nil
+		}
+
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			return fmt.Errorf("No such certificate file: %s", file)
+		} else if err != nil {
+			return err
+		}
+		return config.loadCertificate(file)
+	}
+}
+
+// loadIdentityCertificate loads the certificate of the identity file,
+// if there is one
+func (config *Config) loadIdentityCertificate(identity string) error {
+	file := identity + "-cert.pub"
+	if _, err := os.Stat(file); err != nil {
+		return nil
+	}
+	return config.loadCertificate(file)
+}
+
+// loadCertificate reads the user certificate in file and checks that it
+// is currently valid
+func (config *Config) loadCertificate(file string) error {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read certificate file %s: %v", file, err)
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return fmt.Errorf("Failed to parse certificate %s: %v", file, err)
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("%s is a %s public key, not a certificate", file, key.Type())
+	} else if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("%s is a host certificate, not a user certificate", file)
+	}
+
+	if err := checkCertificate(file, cert, time.Now()); err != nil {
+		return err
+	}
+
+	Logger.Printf("Loaded certificate %s (%s, serial %d)", file, cert.KeyId, cert.Serial)
+	config.certificates = append(config.certificates, certificate{file, cert})
+	return nil
+}
+
+// checkCertificate reports whether the certificate is valid at now
+func checkCertificate(file string, cert *ssh.Certificate, now time.Time) error {
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return fmt.Errorf("Certificate %s is not valid before %s", file, time.Unix(int64(cert.ValidAfter), 0).Format(time.RFC3339))
+	}
+
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return fmt.Errorf("Certificate %s expired at %s", file, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// certSigners returns the signers with the certificates of their keys
+// in front of them.  Certificates that have expired since they were
+// loaded are left out
+func (config *Config) certSigners(signers []ssh.Signer) []ssh.Signer {
+	var certSigners []ssh.Signer
+	for _, c := range config.certificates {
+		if err := checkCertificate(c.file, c.cert, time.Now()); err != nil {
+			Logger.Printf("Skipping certificate: %v", err)
+			continue
+		}
+
+		for _, signer := range signers {
+			if !bytes.Equal(c.cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+				continue
+			}
+
+			certSigner, err := ssh.NewCertSigner(c.cert, signer)
+			if err != nil {
+				Logger.Printf("Skipping certificate %s: %v", c.file, err)
+			} else {
+				certSigners = append(certSigners, certSigner)
+			}
+			break
+		}
+	}
+	return append(certSigners, signers...)
+}
@@ -0,0 +1,184 @@
+package rcom
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestCertificate returns a certificate for key signed by ca, valid
+// from validAfter until validBefore
+func newTestCertificate(t *testing.T, ca ssh.Signer, key ssh.PublicKey, certType uint32, validAfter, validBefore uint64) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        certType,
+		KeyId:           "test",
+		ValidPrincipals: []string{"alice"},
+		ValidAfter:      validAfter,
+		ValidBefore:     validBefore,
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+	return cert
+}
+
+func TestCheckCertificate(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	unix := uint64(now.Unix())
+	tests := []struct {
+		name        string
+		validAfter  uint64
+		validBefore uint64
+		wantErr     string
+	}{
+		{"valid", unix - 60, unix + 60, ""},
+		{"valid for ever", 0, ssh.CertTimeInfinity, ""},
+		{"valid from now", unix, unix + 60, ""},
+		{"not yet valid", unix + 1, unix + 60, "not valid before 2020-09-13T12:26:41Z"},
+		{"expired", unix - 60, unix, "expired at 2020-09-13T12:26:40Z"},
+		{"expired long ago", 0, unix - 3600, "expired"},
+	}
+
+	ca := newTestSigner(t)
+	key := newTestSigner(t).PublicKey()
+	for _, test := range tests {
+		cert := newTestCertificate(t, ca, key, ssh.UserCert, test.validAfter, test.validBefore)
+		err := checkCertificate("id-cert.pub", cert, now.UTC())
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestCertificateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, key := newTestSigner(t), newTestSigner(t)
+	now := uint64(time.Now().Unix())
+	files := map[string][]byte{
+		"valid-cert.pub":   ssh.MarshalAuthorizedKey(newTestCertificate(t, ca, key.PublicKey(), ssh.UserCert, now-60, now+3600)),
+		"expired-cert.pub": ssh.MarshalAuthorizedKey(newTestCertificate(t, ca, key.PublicKey(), ssh.UserCert, now-3600, now-60)),
+		"future-cert.pub":  ssh.MarshalAuthorizedKey(newTestCertificate(t, ca, key.PublicKey(), ssh.UserCert, now+3600, ssh.CertTimeInfinity)),
+		"host-cert.pub":    ssh.MarshalAuthorizedKey(newTestCertificate(t, ca, key.PublicKey(), ssh.HostCert, 0, ssh.CertTimeInfinity)),
+		"key.pub":          ssh.MarshalAuthorizedKey(key.PublicKey()),
+		"garbage-cert.pub": []byte("not a certificate\n"),
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		file    string
+		wantErr string
+	}{
+		{"valid-cert.pub", ""},
+		{"", ""},
+		{"expired-cert.pub", "expired"},
+		{"future-cert.pub", "not valid before"},
+		{"host-cert.pub", "not a user certificate"},
+		{"key.pub", "not a certificate"},
+		{"garbage-cert.pub", "Failed to parse"},
+		{"missing-cert.pub", "No such certificate file"},
+	}
+
+	for _, test := range tests {
+		file := test.file
+		if file != "" {
+			file = filepath.Join(dir, file)
+		}
+
+		config := &Config{}
+		err := CertificateFile(file)(config)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", test.file, err)
+		} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: got error %v, want one containing %q", test.file, err, test.wantErr)
+		}
+
+		if want := test.file != "" && test.wantErr == ""; want != (len(config.certificates) == 1) {
+			t.Errorf("%s: loaded %d certificates", test.file, len(config.certificates))
+		}
+	}
+
+	// an expired certificate fails the connection before dialing, there
+	// is nothing listening on the port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	_, err = Connect("127.0.0.1", Port(port), CertificateFile(filepath.Join(dir, "expired-cert.pub")), KnownHosts(filepath.Join(dir, "known_hosts")))
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Connecting with an expired certificate gave %v, want it to expire before dialing", err)
+	}
+}
+
+func TestIdentityCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyfile := filepath.Join(dir, "id_ed25519")
+	if err := GenerateKey(Ed25519Key, 0, keyfile, "test", nil); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	config := &Config{}
+	if err := IdentityFile(keyfile)(config); err != nil {
+		t.Fatalf("IdentityFile failed: %v", err)
+	}
+
+	if len(config.certificates) != 0 {
+		t.Fatalf("Loaded %d certificates without a -cert.pub file", len(config.certificates))
+	}
+
+	ca, other := newTestSigner(t), newTestSigner(t)
+	key := config.identities[0]
+	cert := newTestCertificate(t, ca, key.PublicKey(), ssh.UserCert, 0, ssh.CertTimeInfinity)
+	if err := ioutil.WriteFile(keyfile+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+
+	config = &Config{}
+	if err := IdentityFile(keyfile)(config); err != nil {
+		t.Fatalf("IdentityFile failed: %v", err)
+	}
+
+	// the certificate is offered in front of the key it certifies, keys
+	// without a certificate are offered on their own
+	signers := config.certSigners(append(config.identities, other))
+	if len(signers) != 3 {
+		t.Fatalf("Got %d signers, want the certificate, its key and the other key", len(signers))
+	}
+
+	if got, ok := signers[0].PublicKey().(*ssh.Certificate); !ok || got.KeyId != cert.KeyId {
+		t.Errorf("First signer is a %s key, want the certificate", signers[0].PublicKey().Type())
+	}
+
+	if _, err := signers[0].Sign(rand.Reader, []byte("data")); err != nil {
+		t.Errorf("Certificate signer failed: %v", err)
+	}
+}
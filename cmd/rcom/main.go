@@ -6,59 +6,285 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/abates/cli"
 	"github.com/abates/rcom"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 const DefaultExec = "rcom"
 
 var (
-	app       *cli.Command
-	clientCmd *cli.Command
-	deployCmd *cli.Command
+	app         *cli.Command
+	clientCmd   *cli.Command
+	breakCmd    *cli.Command
+	serverCmd   *cli.Command
+	deployCmd   *cli.Command
+	keyGenCmd   *cli.Command
+	dispatchCmd *cli.Command
+	caInitCmd   *cli.Command
 
 	currentUser *user.User
 
 	configDir = ""
 	hostname  = ""
 	localDev  = ""
+	remoteDev = ""
+	serial    = ""
 	debug     = false
 
+	serverMux     = false
+	serverPTY     = false
+	serverBreak   = time.Duration(0)
+	breakDuration = 250 * time.Millisecond
+
 	forceLink      = false
 	forceRemote    = false
+	rfc2217Addr    = ""
+	reverse        = stringList{}
+	reconnect      = time.Minute
+	keepAlive      = time.Minute
+	keepAliveMax   = 3
+	keepAliveWait  = 15 * time.Second
+	sshConfig      = ""
+	proxyJump      = ""
+	proxy          = ""
+	useAgent       = os.Getenv("SSH_AUTH_SOCK") != ""
+	bufferLimit    = 64 * 1024
 	username       = ""
 	port           = 22
 	identity       = ""
+	certificate    = ""
 	acceptNew      = false
+	hostKeyCheck   = ""
+	hashKnownHosts = false
+	hostKeys       = stringList{}
+	hostCAs        = stringList{}
 	exec           = DefaultExec
-	bitsize        = 4096
+	bitsize        = 0
+	keyType        = rcom.Ed25519Key
+	keyComment     = ""
 	keyfile        = ""
 	authorizedKeys = ""
+	newPassphrase  = ""
+	caKeyfile      = ""
+	authCA         = false
+	principals     = ""
+	validity       = 8 * time.Hour
+	certKeyID      = ""
+	forceCommand   = ""
+	sourceAddress  = ""
+	keyDevices     = ""
+	keyFrom        = ""
+	keyExpiry      time.Duration
+	policyFile     = ""
+	policyUser     = ""
+	policyKey      = ""
 )
 
+// stringList is a flag that may be given more than once
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
 func setConnectionFlags(fs *flag.FlagSet) {
 	fs.StringVar(&username, "l", currentUser.Username, "login user")
 	fs.IntVar(&port, "p", 22, "port to connect on the remote host")
-	fs.StringVar(&identity, "i", filepath.Join(currentUser.HomeDir, ".ssh", "id_rsa_"+DefaultExec), "specify identity (private key) file")
-	fs.BoolVar(&acceptNew, "a", false, "accept new public keys")
+	fs.StringVar(&identity, "i", defaultIdentity(), "specify identity (private key) file")
+	fs.StringVar(&certificate, "cert", "", "specify user certificate file (default <identity>-cert.pub when it exists)")
+	fs.BoolVar(&acceptNew, "a", false, "accept new host keys, the same as -host-key-checking accept-new")
+	fs.StringVar(&hostKeyCheck, "host-key-checking", "", "handling of unknown host keys: yes, accept-new, ask or no (default yes or StrictHostKeyChecking of ssh_config)")
+	fs.Var(&hostKeys, "hostkey", "only accept the remote host key with this SHA256:... fingerprint instead of using known_hosts (may be repeated)")
+	fs.Var(&hostCAs, "host-ca", "trust the host certificates signed by the CA public key in this file (may be repeated)")
+	fs.BoolVar(&hashKnownHosts, "hash-known-hosts", false, "hash the hostnames added to known_hosts")
+	fs.BoolVar(&useAgent, "agent", useAgent, "authenticate with the keys of the ssh-agent at SSH_AUTH_SOCK")
 	fs.StringVar(&exec, "e", exec, "executable path/name on remote system")
+	fs.StringVar(&sshConfig, "F", "", "ssh_config file to resolve the remote host with, \"none\" to ignore ssh_config (default ~/.ssh/config and /etc/ssh/ssh_config)")
+	fs.StringVar(&proxyJump, "J", "", "connect through jump hosts given as [user@]host[:port][,...], \"none\" to ignore ProxyJump in ssh_config")
+	fs.StringVar(&proxy, "proxy", "", "connect through a proxy given as socks5://, socks5h:// or http://[user:password@]host:port, \"none\" to ignore ALL_PROXY")
+	fs.DurationVar(&keepAlive, "keepalive", keepAlive, "interval between keep-alive requests, 0 disables them")
+	fs.IntVar(&keepAliveMax, "keepalive-max", keepAliveMax, "unanswered keep-alives in a row before the remote host is considered dead")
+	fs.DurationVar(&keepAliveWait, "keepalive-timeout", keepAliveWait, "how long to wait for each keep-alive reply")
+}
+
+// connectionOptions returns the options for the connection flags of a
+// command.  Unless ssh_config is ignored, the login, port and identity
+// flags only override it when they are given on the command line
+func connectionOptions(fs *flag.FlagSet) []rcom.ConfigOption {
+	options := []rcom.ConfigOption{rcom.KeepAlive(keepAlive), rcom.KeepAliveCountMax(keepAliveMax), rcom.KeepAliveTimeout(keepAliveWait)}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if sshConfig == "none" {
+		given["l"], given["p"] = true, true
+		if _, err := os.Stat(identity); err == nil {
+			given["i"] = true
+		}
+	} else if sshConfig == "" {
+		options = append(options, rcom.SSHConfig())
+	} else {
+		options = append(options, rcom.SSHConfig(sshConfig))
+	}
+
+	if given["l"] {
+		options = append(options, rcom.Login(username))
+	}
+
+	if given["p"] {
+		options = append(options, rcom.Port(port))
+	}
+
+	if given["i"] {
+		options = append(options, rcom.IdentityFile(identity))
+	}
+
+	if certificate != "" {
+		options = append(options, rcom.CertificateFile(certificate))
+	}
+
+	if proxyJump != "" {
+		options = append(options, rcom.ProxyJump(proxyJump))
+	}
+
+	if acceptNew {
+		options = append(options, rcom.Accept(true))
+	} else if hostKeyCheck != "" {
+		options = append(options, rcom.StrictHostKeyChecking(hostKeyCheck))
+	}
+
+	if len(hostKeys) > 0 {
+		options = append(options, rcom.HostKeyFingerprint(hostKeys...))
+	}
+
+	for _, file := range hostCAs {
+		options = append(options, rcom.HostCA(file))
+	}
+
+	if hashKnownHosts {
+		options = append(options, rcom.HashKnownHosts(hashKnownHosts))
+	}
+
+	// the agent is used by default when SSH_AUTH_SOCK is set, a stale
+	// socket then does not prevent logging in with the identity files
+	if given["agent"] && useAgent {
+		options = append(options, rcom.Agent())
+	} else if useAgent {
+		options = append(options, rcom.AgentFromEnvironment())
+	}
+
+	if proxy == "" {
+		options = append(options, rcom.ProxyFromEnvironment())
+	} else {
+		options = append(options, rcom.Proxy(proxy))
+	}
+	return options
 }
 
 func setKeyFlags(fs *flag.FlagSet) {
-	fs.IntVar(&bitsize, "b", 4096, "bitsize")
-	fs.StringVar(&keyfile, "f", filepath.Join(currentUser.HomeDir, ".ssh", "id_rsa_"+DefaultExec), "key file")
+	fs.StringVar(&keyType, "t", keyType, "type of key to generate: ed25519, ecdsa or rsa")
+	fs.IntVar(&bitsize, "b", 0, "bitsize (default 4096 for rsa and 256 for ecdsa)")
+	fs.StringVar(&keyComment, "C", "", "comment of the generated key (default user@host)")
+	fs.StringVar(&keyfile, "f", "", "key file (default ~/.ssh/id_<type>_"+DefaultExec+")")
+}
+
+// keyFlags fills in the defaults of the key file and comment that depend
+// on the other flags
+func keyFlags() {
+	if keyfile == "" {
+		keyfile = filepath.Join(currentUser.HomeDir, ".ssh", "id_"+keyType+"_"+DefaultExec)
+	}
+
+	if keyComment == "" {
+		host, _ := os.Hostname()
+		keyComment = currentUser.Username + "@" + host
+	}
+}
+
+// defaultIdentity is the key file of rcom, ~/.ssh/id_ed25519_rcom, or
+// the ~/.ssh/id_rsa_rcom of older versions when only that one exists
+func defaultIdentity() string {
+	identity := filepath.Join(currentUser.HomeDir, ".ssh", "id_"+rcom.Ed25519Key+"_"+DefaultExec)
+	if _, err := os.Stat(identity); os.IsNotExist(err) {
+		legacy := filepath.Join(currentUser.HomeDir, ".ssh", "id_"+rcom.RSAKey+"_"+DefaultExec)
+		if _, err := os.Stat(legacy); err == nil {
+			return legacy
+		}
+	}
+	return identity
+}
+
+// defaultCAKeyfile is the CA private key of rcom key ca init and rcom key
+// sign
+func defaultCAKeyfile() string {
+	return filepath.Join(currentUser.HomeDir, ".ssh", "ca_"+DefaultExec)
 }
 
 func setDeployFlags(fs *flag.FlagSet) {
 	setConnectionFlags(fs)
 	setKeyFlags(fs)
+	setRestrictionFlags(fs)
+}
+
+// setPolicyFlags sets the flags of the access policy, which the forced
+// command of authorized_keys gives to pin the identity of a login
+func setPolicyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&policyFile, "policy", "", "access policy file (default "+rcom.DefaultPolicyFile+" when it exists)")
+	fs.StringVar(&policyUser, "user", "", "user that the access policy applies to (default the current user)")
+	fs.StringVar(&policyKey, "key", "", "key fingerprint that the access policy applies to, the key rules only apply when it is given")
+}
+
+func setRestrictionFlags(fs *flag.FlagSet) {
+	fs.StringVar(&keyFrom, "from", "", "comma separated address patterns the restricted key may be used from")
+	fs.DurationVar(&keyExpiry, "expiry", 0, "how long the restricted key is accepted, 0 for ever")
+}
+
+// keyRestriction returns the restriction of an authorized key to the
+// comma separated devices, or nil when no devices are given
+func keyRestriction(devices string) (*rcom.KeyRestriction, error) {
+	restriction := &rcom.KeyRestriction{}
+	for _, device := range strings.Split(devices, ",") {
+		if device = strings.TrimSpace(device); device != "" {
+			restriction.Devices = append(restriction.Devices, device)
+		}
+	}
+
+	for _, from := range strings.Split(keyFrom, ",") {
+		if from = strings.TrimSpace(from); from != "" {
+			restriction.From = append(restriction.From, from)
+		}
+	}
+
+	if keyExpiry > 0 {
+		restriction.Expiry = time.Now().Add(keyExpiry)
+	}
+
+	if len(restriction.Devices) == 0 {
+		if len(restriction.From) > 0 || keyExpiry > 0 {
+			return nil, fmt.Errorf("-from and -expiry only apply to a key restricted to devices")
+		}
+		return nil, nil
+	}
+
+	if executable, err := os.Executable(); err == nil {
+		restriction.Exec = executable
+	}
+	return restriction, nil
 }
 
 func init() {
@@ -83,40 +309,93 @@ func init() {
 	app.Flags.BoolVar(&debug, "debug", false, "turn on debug logging")
 
 	clientCmd = app.SubCommand("client",
-		cli.UsageOption("[options] <remote host> <ldev:rdev> [<ldev:rdev> ...]"),
+		cli.UsageOption("[options] <remote host> [<ldev:rdev[:settings]> ...]"),
 		cli.DescOption("Start client mode"),
 		cli.CallbackOption(clientCb),
 	)
 	setConnectionFlags(&clientCmd.Flags)
 	clientCmd.Flags.BoolVar(&forceLink, "f", false, "Force link. Remove link if it exists.")
 	clientCmd.Flags.BoolVar(&forceRemote, "fr", false, "Force remote link. Remove remote link if it exists.")
-	clientCmd.Arguments.String(&hostname, "remote hostname")
-
-	serverCmd := app.SubCommand("server",
-		cli.UsageOption("<local device>"),
+	clientCmd.Flags.StringVar(&rfc2217Addr, "rfc2217", "", "serve each mapping with RFC 2217 starting at [host:]port, leave ldev empty to skip the pty")
+	clientCmd.Flags.DurationVar(&reconnect, "reconnect", reconnect, "longest delay between attempts to reconnect a lost connection, 0 exits instead")
+	clientCmd.Flags.IntVar(&bufferLimit, "buffer", bufferLimit, "bytes of output to buffer for each device while reconnecting")
+	clientCmd.Flags.Var(&reverse, "R", "share the local device ldev as a pty called rdev on the remote host (ldev:rdev[:settings], may be repeated)")
+	clientCmd.Arguments.String(&hostname, "remote hostname or rfc2217://, telnet:// or tcp:// terminal server")
+
+	serverCmd = app.SubCommand("server",
+		cli.UsageOption("[options] <local device> | -mux <local device[:settings]> [<local device[:settings]> ...]"),
 		cli.DescOption("Start server mode"),
 		cli.CallbackOption(serverCb),
 	)
 	serverCmd.Flags.BoolVar(&forceLink, "f", false, "Force link. Remove link if it exists.")
+	serverCmd.Flags.StringVar(&serial, "s", "", "serial settings for the device (ex: 115200,8N1)")
+	serverCmd.Flags.BoolVar(&serverPTY, "pty", false, "create a pty for a device that is opened on the client")
+	serverCmd.Flags.BoolVar(&serverMux, "mux", false, "serve every device over one multiplexed stream")
+	serverCmd.Flags.DurationVar(&serverBreak, "break", 0, "send a BREAK of the given duration to the device and exit")
+	setPolicyFlags(&serverCmd.Flags)
 	serverCmd.Arguments.String(&localDev, "device path")
 
+	breakCmd = app.SubCommand("break",
+		cli.UsageOption("[options] <remote host> <rdev>"),
+		cli.DescOption("Send a BREAK to a remote device"),
+		cli.CallbackOption(breakCb),
+	)
+	setConnectionFlags(&breakCmd.Flags)
+	breakCmd.Flags.DurationVar(&breakDuration, "d", breakDuration, "duration of the BREAK")
+	breakCmd.Arguments.String(&hostname, "remote hostname")
+	breakCmd.Arguments.String(&remoteDev, "remote device")
+
 	key := app.SubCommand("key",
 		cli.UsageOption("<command> [options]"),
 		cli.DescOption("Perform ssh public key operations"),
 	)
 
-	gen := key.SubCommand("gen", cli.DescOption("Generate a local SSH public/private key pair"), cli.CallbackOption(genCmd))
-	setKeyFlags(&gen.Flags)
+	keyGenCmd = key.SubCommand("gen", cli.DescOption("Generate a local SSH public/private key pair"), cli.CallbackOption(genCmd))
+	setKeyFlags(&keyGenCmd.Flags)
+	keyGenCmd.Flags.StringVar(&newPassphrase, "N", "", "passphrase to encrypt the private key with, visible to other users in ps (default RCOM_PASSPHRASE or prompted for on a terminal)")
 	auth := key.SubCommand("auth", cli.DescOption("Add a public key to the authorized_keys file"), cli.CallbackOption(authCmd))
 	setKeyFlags(&auth.Flags)
+	auth.Flags.StringVar(&keyDevices, "devices", "", "comma separated devices or patterns that the key may only serve, instead of having full access")
+	setRestrictionFlags(&auth.Flags)
+	auth.Flags.BoolVar(&authCA, "ca", false, "add the key as a cert-authority that user certificates are accepted from (default key ~/.ssh/ca_"+DefaultExec+".pub)")
+
+	ca := key.SubCommand("ca",
+		cli.UsageOption("<command> [options]"),
+		cli.DescOption("Manage the SSH certificate authority"),
+	)
+
+	caInitCmd = ca.SubCommand("init", cli.DescOption("Generate the private key of a new certificate authority, encrypted with the passphrase prompted for or in RCOM_PASSPHRASE"), cli.CallbackOption(caInitCb))
+	setKeyFlags(&caInitCmd.Flags)
+	caInitCmd.Flags.Lookup("f").Usage = "CA key file (default ~/.ssh/ca_" + DefaultExec + ")"
+
+	sign := key.SubCommand("sign",
+		cli.UsageOption("[options] <public key file>"),
+		cli.DescOption("Sign a user public key with the certificate authority"),
+		cli.CallbackOption(signCb),
+	)
+	sign.Flags.StringVar(&caKeyfile, "ca", "", "CA private key file (default ~/.ssh/ca_"+DefaultExec+")")
+	sign.Flags.StringVar(&principals, "principals", "", "comma separated users that the certificate can log in as")
+	sign.Flags.DurationVar(&validity, "validity", validity, "how long the certificate is valid, 0 for ever")
+	sign.Flags.StringVar(&certKeyID, "I", "", "key identity logged by the server (default the principals)")
+	sign.Flags.StringVar(&forceCommand, "force-command", "", "the only command that the certificate may run")
+	sign.Flags.StringVar(&sourceAddress, "source-address", "", "comma separated addresses or CIDR ranges that the certificate may be used from")
+	sign.Arguments.String(&keyfile, "public key file, - to read stdin and write the certificate to stdout")
 
 	deployCmd = key.SubCommand("deploy",
-		cli.UsageOption("[options] <remote host> <rdev> [<rdev> ...]"),
-		cli.DescOption("Deploy a public key to a remote host"),
+		cli.UsageOption("[options] <remote host> [<rdev> ...]"),
+		cli.DescOption("Deploy a public key to a remote host, restricted to serving the rdevs when any are given"),
 		cli.CallbackOption(deployCb),
 	)
 	setDeployFlags(&deployCmd.Flags)
 	deployCmd.Arguments.String(&hostname, "remote hostname")
+
+	dispatchCmd = app.SubCommand(rcom.DispatchCommand,
+		cli.UsageOption("<device> [<device> ...]"),
+		cli.DescOption("Run the rcom server command in SSH_ORIGINAL_COMMAND if it only serves the given devices or patterns, the forced command of restricted keys"),
+		cli.CallbackOption(dispatchCb),
+	)
+	setPolicyFlags(&dispatchCmd.Flags)
+	dispatchCmd.Arguments.String(&localDev, "allowed device or pattern")
 }
 
 func main() {
@@ -129,9 +408,49 @@ func main() {
 	os.Exit(0)
 }
 
+// mapping is a ldev:rdev[:settings] argument of the client command
+type mapping struct {
+	name           string
+	localDev       string
+	remoteDev      string
+	settings       string
+	serialSettings *rcom.Settings
+}
+
+// serverExec returns the command that starts the rcom server on the
+// remote host
+func serverExec() string {
+	exec := exec
+	if debug {
+		exec = fmt.Sprintf("%s -debug", exec)
+	}
+
+	exec = fmt.Sprintf("%s server", exec)
+	if forceRemote {
+		exec = fmt.Sprintf("%s -f", exec)
+	}
+	return exec
+}
+
+// connectionEvents reports the loss and recovery of the connection
+func connectionEvents(event rcom.Event) {
+	if event.Type == rcom.DisconnectEvent || event.Type == rcom.ReconnectEvent {
+		fmt.Fprintln(os.Stderr, event)
+	}
+}
+
 func clientCb(string) error {
 	rcom.Logger.Printf("Connecting to %s", hostname)
-	client, err := rcom.Connect(hostname, rcom.Login(username), rcom.Port(port), rcom.IdentityFile(identity), rcom.Accept(acceptNew))
+	terminal := rcom.IsTerminalURL(hostname)
+	var client *rcom.Connection
+	var err error
+	if terminal {
+		client, err = rcom.ConnectTerminal(hostname)
+	} else {
+		options := append(connectionOptions(&clientCmd.Flags), rcom.Reconnect(reconnect), rcom.BufferLimit(bufferLimit), rcom.Notify(connectionEvents))
+		client, err = rcom.Connect(hostname, options...)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -145,54 +464,342 @@ func clientCb(string) error {
 		os.Exit(0)
 	}()
 
+	rfc2217Host, rfc2217Port := "localhost", 0
+	if rfc2217Addr != "" {
+		portStr := rfc2217Addr
+		if strings.Contains(rfc2217Addr, ":") {
+			rfc2217Host, portStr, err = net.SplitHostPort(rfc2217Addr)
+			if err != nil {
+				return err
+			}
+		}
+
+		rfc2217Port, err = strconv.Atoi(portStr)
+		if err != nil {
+			return fmt.Errorf("Invalid RFC 2217 port %q", portStr)
+		}
+	}
+
+	var mappings []mapping
 	for _, device := range clientCmd.Arguments.Args() {
-		localDev, remoteDev := device, device
+		m := mapping{localDev: device, remoteDev: device}
 		if strings.Contains(device, ":") {
-			s := strings.Split(device, ":")
-			localDev, remoteDev = s[0], s[1]
+			s := strings.SplitN(device, ":", 3)
+			m.localDev, m.remoteDev = s[0], s[1]
+			if len(s) > 2 {
+				m.settings = s[2]
+			}
 		}
 
-		if strings.HasSuffix(exec, DefaultExec) {
-			if debug {
-				exec = fmt.Sprintf("%s -debug", exec)
+		if m.settings != "" {
+			if m.serialSettings, err = rcom.ParseSettings(m.settings); err != nil {
+				return err
+			}
+		}
+
+		m.name = m.localDev
+		if m.localDev == "" {
+			if rfc2217Addr == "" {
+				return fmt.Errorf("No local device given for %s", m.remoteDev)
 			}
+			m.name = m.remoteDev
+		}
+		mappings = append(mappings, m)
+	}
+
+	if len(mappings) == 0 && len(reverse) == 0 {
+		return fmt.Errorf("No devices given")
+	}
+
+	if len(mappings) > 0 && !terminal && strings.HasSuffix(exec, DefaultExec) {
+		// every device is served by a single multiplexed server
+		exec := serverExec() + " -mux"
+		var names []string
+		for _, m := range mappings {
+			device := m.remoteDev
+			if m.settings != "" {
+				device = fmt.Sprintf("%s:%s", device, m.settings)
+			}
+			exec = fmt.Sprintf("%s %q", exec, device)
+			names = append(names, m.name)
+		}
 
-			exec = fmt.Sprintf("%s server", exec)
-			if forceRemote {
-				exec = fmt.Sprintf("%s -f", exec)
+		err = client.AttachMux(exec, names...)
+		for _, m := range mappings {
+			if err == nil && m.localDev != "" {
+				err = client.AddPTY(m.name, m.localDev, forceLink)
 			}
-			exec = fmt.Sprintf("%s %s", exec, remoteDev)
 		}
-		err = client.AttachPTY(localDev, exec, forceLink)
+	} else {
+		for _, m := range mappings {
+			exec := exec
+			if terminal {
+				exec = m.remoteDev
+			}
+
+			if m.localDev == "" {
+				err = client.Attach(m.name, exec)
+			} else {
+				err = client.AttachPTY(m.localDev, exec, forceLink)
+			}
+
+			if err == nil && terminal && m.serialSettings != nil {
+				err = client.SetSettings(m.name, m.serialSettings)
+			}
+
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	for _, device := range reverse {
 		if err != nil {
 			break
 		}
+
+		s := strings.SplitN(device, ":", 3)
+		if len(s) < 2 || s[0] == "" || s[1] == "" {
+			err = fmt.Errorf("Invalid reverse mapping %q: expected ldev:rdev[:settings]", device)
+			break
+		}
+
+		if terminal {
+			err = fmt.Errorf("Devices can not be shared with a terminal server")
+			break
+		}
+
+		var settings *rcom.Settings
+		if len(s) > 2 {
+			if settings, err = rcom.ParseSettings(s[2]); err != nil {
+				break
+			}
+		}
+
+		exec := exec
+		if strings.HasSuffix(exec, DefaultExec) {
+			exec = fmt.Sprintf("%s -pty %q", serverExec(), s[1])
+		}
+		err = client.AttachDevice(s[0], exec, settings)
+	}
+
+	for i, m := range mappings {
+		if err == nil && rfc2217Addr != "" {
+			addr := net.JoinHostPort(rfc2217Host, strconv.Itoa(rfc2217Port+i))
+			err = client.ServeRFC2217(m.name, addr)
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "%s available at rfc2217://%s\n", m.remoteDev, addr)
+			}
+		}
 	}
 
 	if err == nil {
 		client.Wait()
+		err = client.Err()
 		client.Close()
 	}
 	return err
 }
 
+// serverOptions returns the access policy of the server, from the policy
+// file when one is given and otherwise from the default policy file if
+// it exists
+func serverOptions() ([]rcom.ServerOption, error) {
+	var policy *rcom.Policy
+	var err error
+	if policyFile == "" {
+		policy, err = rcom.LoadDefaultPolicy()
+	} else {
+		policy, err = rcom.LoadPolicy(policyFile)
+	}
+
+	if err != nil || policy == nil {
+		return nil, err
+	}
+
+	name, key := rcom.PolicyIdentity(policyUser, policyKey)
+	return []rcom.ServerOption{rcom.AccessPolicy(policy, name, key)}, nil
+}
+
 func serverCb(string) error {
-	return rcom.Server(localDev, forceLink)
+	options, err := serverOptions()
+	if err != nil {
+		return err
+	}
+
+	if serverBreak > 0 {
+		return rcom.SendBreak(localDev, serverBreak, options...)
+	}
+
+	var settings *rcom.Settings
+	if serial != "" {
+		settings, err = rcom.ParseSettings(serial)
+		if err != nil {
+			return err
+		}
+	}
+
+	if serverPTY {
+		return rcom.PTYServer(localDev, forceLink, options...)
+	}
+
+	if serverMux {
+		return rcom.MuxServer(append([]string{localDev}, serverCmd.Arguments.Args()...), forceLink, settings, options...)
+	}
+	return rcom.Server(localDev, forceLink, settings, options...)
+}
+
+func breakCb(string) error {
+	options := connectionOptions(&breakCmd.Flags)
+	conn, err := rcom.Connect(hostname, options...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if strings.HasSuffix(exec, DefaultExec) {
+		if debug {
+			exec = fmt.Sprintf("%s -debug", exec)
+		}
+		exec = fmt.Sprintf("%s server -break %v %q", exec, breakDuration, remoteDev)
+	}
+	return conn.Run(exec, nil, os.Stdout, os.Stderr)
 }
 
 func genCmd(string) error {
-	return rcom.GenerateKey(bitsize, keyfile)
+	keyFlags()
+	passphrase, err := keyPassphrase(&keyGenCmd.Flags)
+	if err != nil {
+		return err
+	}
+	return rcom.GenerateKey(keyType, bitsize, keyfile, keyComment, passphrase)
+}
+
+// keyPassphrase returns the passphrase for a new key, the -N flag when
+// the command has one, RCOM_PASSPHRASE or, when neither is given, the
+// passphrase entered twice on the terminal
+func keyPassphrase(fs *flag.FlagSet) ([]byte, error) {
+	given := false
+	fs.Visit(func(f *flag.Flag) { given = given || f.Name == "N" })
+	if given {
+		return []byte(newPassphrase), nil
+	}
+
+	if passphrase, found := os.LookupEnv("RCOM_PASSPHRASE"); found {
+		return []byte(passphrase), nil
+	}
+
+	var passphrase []byte
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		var err error
+		passphrase, err = rcom.ReadPassphrase("Enter passphrase (empty for no passphrase): ")
+		if err != nil {
+			return nil, err
+		}
+
+		again, err := rcom.ReadPassphrase("Enter same passphrase again: ")
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(passphrase, again) {
+			return nil, fmt.Errorf("Passphrases do not match")
+		}
+	}
+	return passphrase, nil
 }
 
 func authCmd(string) error {
-	return rcom.AuthorizeKey(keyfile, authorizedKeys)
+	if authCA {
+		if keyfile == "" {
+			keyfile = defaultCAKeyfile() + ".pub"
+		}
+		return rcom.AuthorizeCertAuthority(keyfile, authorizedKeys)
+	}
+
+	keyFlags()
+	restriction, err := keyRestriction(keyDevices)
+	if err != nil {
+		return err
+	}
+	return rcom.AuthorizeKey(keyfile, authorizedKeys, restriction)
+}
+
+func dispatchCb(string) error {
+	options, err := serverOptions()
+	if err != nil {
+		return err
+	}
+
+	devices := append([]string{localDev}, dispatchCmd.Arguments.Args()...)
+	return rcom.Dispatch(os.Getenv("SSH_ORIGINAL_COMMAND"), devices, options...)
+}
+
+func caInitCb(string) error {
+	if keyfile == "" {
+		keyfile = defaultCAKeyfile()
+	}
+	keyFlags()
+
+	if _, err := os.Stat(keyfile); err == nil {
+		return fmt.Errorf("CA key %s already exists", keyfile)
+	}
+
+	// the CA key is not left unencrypted by accident, and its passphrase
+	// is not taken from the command line where ps and the history show it
+	if _, found := os.LookupEnv("RCOM_PASSPHRASE"); !found && !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("No passphrase for CA key %s: set RCOM_PASSPHRASE, empty for none, when there is no terminal", keyfile)
+	}
+
+	passphrase, err := keyPassphrase(&caInitCmd.Flags)
+	if err != nil {
+		return err
+	}
+	return rcom.GenerateKey(keyType, bitsize, keyfile, keyComment, passphrase)
+}
+
+func signCb(string) error {
+	if caKeyfile == "" {
+		caKeyfile = defaultCAKeyfile()
+	}
+
+	options := rcom.CertificateOptions{
+		KeyID:        certKeyID,
+		Validity:     validity,
+		ForceCommand: forceCommand,
+	}
+
+	for _, principal := range strings.Split(principals, ",") {
+		if principal = strings.TrimSpace(principal); principal != "" {
+			options.Principals = append(options.Principals, principal)
+		}
+	}
+
+	for _, addr := range strings.Split(sourceAddress, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			options.SourceAddresses = append(options.SourceAddresses, addr)
+		}
+	}
+
+	if len(options.Principals) == 0 {
+		return fmt.Errorf("No principals given: use -principals to name the users the certificate can log in as")
+	}
+	return rcom.SignKey(caKeyfile, keyfile, options)
 }
 
 func deployCb(string) error {
+	// deploy the existing key of rcom unless another one is asked for
+	given := make(map[string]bool)
+	deployCmd.Flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if !given["f"] && !given["t"] {
+		keyfile = defaultIdentity()
+	}
+	keyFlags()
+
 	// create key if it doesn't already exist
 	_, err := os.Stat(keyfile)
 	if os.IsNotExist(err) {
-		err = rcom.GenerateKey(bitsize, keyfile)
+		err = rcom.GenerateKey(keyType, bitsize, keyfile, keyComment, nil)
 	}
 
 	if err != nil {
@@ -212,10 +819,26 @@ func deployCb(string) error {
 	}
 	publicKey = append(publicKey, []byte("\n")...)
 
+	devices := strings.Join(deployCmd.Arguments.Args(), ",")
+	if _, err := keyRestriction(devices); err != nil {
+		return err
+	}
+
 	if strings.HasSuffix(exec, DefaultExec) {
 		exec = fmt.Sprintf("%s key auth -f -", exec)
+		if devices != "" {
+			exec = fmt.Sprintf("%s -devices %q", exec, devices)
+			if keyFrom != "" {
+				exec = fmt.Sprintf("%s -from %q", exec, keyFrom)
+			}
+
+			if keyExpiry > 0 {
+				exec = fmt.Sprintf("%s -expiry %v", exec, keyExpiry)
+			}
+		}
 	}
-	conn, err := rcom.Connect(hostname, rcom.PasswordAuth(), rcom.Login(username), rcom.Port(port), rcom.Accept(acceptNew))
+	options := append(connectionOptions(&deployCmd.Flags), rcom.PasswordAuth())
+	conn, err := rcom.Connect(hostname, options...)
 	if err != nil {
 		return err
 	}
@@ -1,38 +1,60 @@
 package rcom
 
 import (
-	"bufio"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
-	kh "golang.org/x/crypto/ssh/knownhosts"
 )
 
 type Connection struct {
 	*ssh.Client
-	config   *Config
-	sessions []*ssh.Session
-	wg       sync.WaitGroup
+	addr      string
+	jumps     []jumpHost
+	config    *Config
+	links     []*link
+	listeners []net.Listener
+	wg        sync.WaitGroup
+
+	// dialMu serializes reconnection attempts
+	dialMu sync.Mutex
+
+	mu        sync.Mutex
+	sessions  []*ssh.Session
+	closed    bool
+	done      chan struct{}
+	err       error
+	connected bool
+
+	// terminal is the terminal server given to ConnectTerminal and
+	// terminals are the links to its ports
+	terminal  *url.URL
+	terminals []*link
 }
 
-/*
+// Run executes the command on the remote host and waits for it to
+// complete
 func (conn *Connection) Run(exec string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
-	session, err := conn.Start(exec, stdin, stdout, stderr)
-	if err == nil {
-		err = session.Wait()
+	session, err := conn.NewSession()
+	if err != nil {
+		Logger.Printf("Failed to create ssh session: %v", err)
+		return err
 	}
-	return err
-}*/
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	return session.Run(exec)
+}
 
 type logWriter struct {
 	io.Writer
@@ -78,165 +100,469 @@ func (conn *Connection) Start(exec string, stdin io.Reader, stdout io.Writer, st
 	return session, err
 }
 
-func (conn *Connection) AttachPTY(localDev string, exec string, force bool) error {
-	Logger.Printf("Attaching to local port %s", localDev)
-	p, err := newPort(localDev, force)
+// Attach executes the server command on the remote host and connects
+// its device to a link called name.  Local endpoints, such as a pty or
+// an RFC 2217 listener, are then added to the link with AttachPTY and
+// ServeRFC2217.  On a terminal server connection exec is the TCP port
+// of the device, the port of the terminal server URL is used when it is
+// not a number
+func (conn *Connection) Attach(name string, exec string) error {
+	if _, err := conn.link(name); err == nil {
+		return fmt.Errorf("%s is already attached", name)
+	}
+
+	if conn.terminal != nil {
+		return conn.attachTerminal(name, exec)
+	}
+
+	return conn.attach(&attachment{exec: exec, links: []*link{conn.newLink(name)}})
+}
+
+// AttachMux executes a server command that serves several devices on
+// the remote host and connects them to links called names.  The frames
+// of every device are carried over the one session, the stream id of a
+// device is its index in names
+func (conn *Connection) AttachMux(exec string, names ...string) error {
+	if conn.terminal != nil {
+		return fmt.Errorf("Devices on a terminal server can not be multiplexed")
+	}
+
+	if len(names) > 65536 {
+		return fmt.Errorf("Too many devices to multiplex: %d", len(names))
+	}
+
+	a := &attachment{exec: exec, mux: true}
+	for i, name := range names {
+		if _, err := conn.link(name); err == nil {
+			return fmt.Errorf("%s is already attached", name)
+		}
+
+		for _, other := range names[0:i] {
+			if name == other {
+				return fmt.Errorf("%s is given more than once", name)
+			}
+		}
+		a.links = append(a.links, conn.newLink(name))
+	}
+	return conn.attach(a)
+}
+
+// attachment is a server session on the remote host and the links of
+// the devices it serves
+type attachment struct {
+	exec  string
+	links []*link
+	mux   bool
+}
+
+// connect connects the links to the stdin of a new session and returns
+// the function that reads frames from its stdout
+func (a *attachment) connect(stdin io.Writer, stdout io.Reader) (func() error, error) {
+	if !a.mux {
+		l := a.links[0]
+		if err := l.connect(frameStream{stdin}); err != nil {
+			return nil, err
+		}
+		return func() error { return l.copyIn(stdout) }, nil
+	}
+
+	m := newMux(stdin)
+	var streams []*muxStream
+	for i, l := range a.links {
+		s, err := m.open(uint16(i), l)
+		if err != nil {
+			m.close(err)
+			return nil, err
+		}
+		streams = append(streams, s)
+	}
+
+	// flushing the frames buffered while disconnected waits for the
+	// credit returned by the peer, so the reader must already run
+	done := make(chan error, 1)
+	go func() { done <- m.run(stdout) }()
+	for i, s := range streams {
+		if err := a.links[i].connect(s); err != nil {
+			m.close(err)
+			return nil, err
+		}
+	}
+	return func() error { return <-done }, nil
+}
+
+func (conn *Connection) newLink(name string) *link {
+	l := newLink(name, nil, conn.config.notify)
+	l.persistent = conn.config.reconnect > 0
+	l.bufferLimit = conn.config.bufferLimit
+	return l
+}
+
+func (conn *Connection) attach(a *attachment) error {
+	s, err := conn.start(a)
 	if err != nil {
-		Logger.Printf("Failed to attach to port %s: %v", localDev, err)
-		p.ClosePTY()
 		return err
 	}
 
+	conn.links = append(conn.links, a.links...)
+	conn.wg.Add(1)
+	go conn.supervise(a, s)
+	return nil
+}
+
+// serverSession is a server command executed for an attachment
+type serverSession struct {
+	*ssh.Session
+	stdin  io.Closer
+	stdout io.Reader
+
+	// copyIn reads the frames of the session until it ends
+	copyIn func() error
+
+	// received counts the bytes read from stdout
+	received int64
+}
+
+func (s *serverSession) Read(p []byte) (int, error) {
+	n, err := s.stdout.Read(p)
+	s.received += int64(n)
+	return n, err
+}
+
+// start executes the server command of the attachment and connects its
+// links to the new session
+func (conn *Connection) start(a *attachment) (*serverSession, error) {
+	session, stdin, stdout, err := conn.startServer(a.exec)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &serverSession{Session: session, stdin: stdin, stdout: stdout}
+	s.copyIn, err = a.connect(stdin, s)
+	if err != nil {
+		session.Close()
+		conn.removeSession(session)
+		return nil, err
+	}
+	return s, nil
+}
+
+// startServer executes the server command in a new session and returns
+// the stdin and stdout of the session
+func (conn *Connection) startServer(exec string) (*ssh.Session, io.WriteCloser, io.Reader, error) {
+	session, err := conn.client().NewSession()
+	if err != nil {
+		Logger.Printf("Failed to create ssh session: %v", err)
+		return nil, nil, nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	session.Stderr = os.Stderr
+
 	Logger.Printf("Executing %q on remote host", exec)
-	session, err := conn.Start(exec, p, p, os.Stderr)
-	if err == nil {
-		conn.sessions = append(conn.sessions, session)
-	} else {
-		p.ClosePTY()
+	err = session.Start(exec)
+	if err != nil {
+		Logger.Printf("Failed to start remote command: %q: %v", exec, err)
+		return nil, nil, nil, err
 	}
 
-	return err
+	conn.mu.Lock()
+	conn.sessions = append(conn.sessions, session)
+	conn.mu.Unlock()
+	return session, stdin, stdout, nil
 }
 
-func (conn *Connection) Wait() {
-	conn.wg.Wait()
+func (conn *Connection) removeSession(session *ssh.Session) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for i, s := range conn.sessions {
+		if s == session {
+			conn.sessions = append(conn.sessions[0:i], conn.sessions[i+1:]...)
+			break
+		}
+	}
 }
 
-func (conn *Connection) Close() error {
-	for _, session := range conn.sessions {
-		session.Signal(ssh.SIGINT)
-		if p, ok := session.Stdin.(*port); ok {
+// AttachPTY creates a pty linked to localDev and attaches it to the
+// device served by exec on the remote host
+func (conn *Connection) AttachPTY(localDev string, exec string, force bool) error {
+	Logger.Printf("Attaching to local port %s", localDev)
+	p, err := newPort(localDev, force, nil)
+	if err != nil {
+		Logger.Printf("Failed to attach to port %s: %v", localDev, err)
+		if p != nil {
 			p.ClosePTY()
 		}
-		session.Close()
+		return err
 	}
-	conn.sessions = nil
+
+	err = conn.Attach(localDev, exec)
+	if err != nil {
+		p.ClosePTY()
+		return err
+	}
+
+	l, _ := conn.link(localDev)
+	conn.addPort(l, p)
 	return nil
 }
 
-func (conn *Connection) hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
-	fields := strings.Split(hostname, ":")
-	if fields[1] == "22" {
-		hostname = fields[0]
-	} else {
-		hostname = fmt.Sprintf("[%s]:%s", fields[0], fields[1])
+// AttachDevice opens the serial device localDev and attaches it to the
+// remote host, where exec serves it with a pty.  This is the reverse of
+// AttachPTY
+func (conn *Connection) AttachDevice(localDev string, exec string, settings *Settings) error {
+	if _, err := os.Stat(localDev); err != nil {
+		return err
 	}
 
-	remoteAddr := remote.String()
-	fields = strings.Split(remoteAddr, ":")
-	if fields[1] == "22" {
-		remoteAddr = fields[0]
-	} else {
-		remoteAddr = fmt.Sprintf("[%s]:%s", fields[0], fields[1])
+	Logger.Printf("Attaching to local device %s", localDev)
+	p, err := newPort(localDev, false, settings)
+	if err != nil {
+		Logger.Printf("Failed to open device %s: %v", localDev, err)
+		if p != nil {
+			p.ClosePTY()
+		}
+		return err
 	}
 
-	if _, err := os.Stat(conn.config.knownHosts); err != nil {
-		if os.IsNotExist(err) {
-			if conn.config.acceptNew {
-				if err := os.MkdirAll(filepath.Dir(conn.config.knownHosts), 0700); err != nil {
-					return err
-				}
+	err = conn.Attach(localDev, exec)
+	if err != nil {
+		p.ClosePTY()
+		return err
+	}
 
-				line := kh.Line([]string{hostname}, key)
-				return ioutil.WriteFile(conn.config.knownHosts, append([]byte(line), []byte("\n")...), 0600)
-			} else {
-				return fmt.Errorf("Could not verify %s: known_hosts file not found", hostname)
-			}
-		} else {
-			return err
-		}
+	l, _ := conn.link(localDev)
+	conn.addPort(l, p)
+	return nil
+}
+
+// AddPTY creates a pty linked to localDev and connects it to the device
+// already attached as name, such as a device attached with AttachMux
+func (conn *Connection) AddPTY(name string, localDev string, force bool) error {
+	l, err := conn.link(name)
+	if err != nil {
+		return err
 	}
 
-	file, err := os.Open(filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"))
+	Logger.Printf("Attaching to local port %s", localDev)
+	p, err := newPort(localDev, force, nil)
 	if err != nil {
+		Logger.Printf("Failed to attach to port %s: %v", localDev, err)
+		if p != nil {
+			p.ClosePTY()
+		}
 		return err
 	}
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		_, hosts, pk, _, _, err := ssh.ParseKnownHosts(scanner.Bytes())
+	conn.addPort(l, p)
+	return nil
+}
+
+func (conn *Connection) addPort(l *link, p *port) {
+	go func() {
+		err := l.add(p)
 		if err != nil {
-			return err
-		}
-		for _, host := range hosts {
-			if host == hostname || host == remoteAddr {
-				err = ssh.FixedHostKey(pk)(hostname, remote, key)
-				return err
-			}
+			Logger.Printf("%s: %v", l.name, err)
 		}
+	}()
+}
+
+// ServeRFC2217 listens for RFC 2217 (Telnet COM Port Control) clients
+// on addr and connects them to the device attached as name
+func (conn *Connection) ServeRFC2217(name string, addr string) error {
+	l, err := conn.link(name)
+	if err != nil {
+		return err
 	}
 
-	if conn.config.acceptNew {
-		line := kh.Line([]string{hostname}, key)
-		f, err := os.OpenFile(conn.config.knownHosts, os.O_APPEND|os.O_WRONLY, 0600)
-		if err == nil {
-			_, err = f.WriteString(line + "\n")
-		}
-		f.Close()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
 		return err
 	}
-	return fmt.Errorf("Hostkey verification failed, no entry in known_hosts")
+
+	Logger.Printf("%s: serving RFC 2217 on %v", name, listener.Addr())
+	conn.listeners = append(conn.listeners, listener)
+	go serveRFC2217(listener, l)
+	return nil
+}
+
+func (conn *Connection) link(localDev string) (*link, error) {
+	for _, l := range conn.links {
+		if l.name == localDev {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not attached", localDev)
+}
+
+// SetSettings changes the line settings of the remote device attached
+// to localDev
+func (conn *Connection) SetSettings(localDev string, settings *Settings) error {
+	l, err := conn.link(localDev)
+	if err == nil {
+		l.sendSettings(settings)
+	}
+	return err
+}
+
+// SetModemLines changes the output lines (DTR and RTS) given in mask on
+// the remote device attached to localDev
+func (conn *Connection) SetModemLines(localDev string, lines, mask ModemLines) error {
+	l, err := conn.link(localDev)
+	if err == nil {
+		err = l.SetModemLines(lines, mask)
+	}
+	return err
+}
+
+// ModemLines returns the last known state of the modem lines of the
+// remote device attached to localDev
+func (conn *Connection) ModemLines(localDev string) (ModemLines, error) {
+	l, err := conn.link(localDev)
+	if err != nil {
+		return 0, err
+	}
+	return l.ModemLines(), nil
+}
+
+// SendBreak asserts a BREAK for the given duration on the remote device
+// attached to localDev
+func (conn *Connection) SendBreak(localDev string, duration time.Duration) error {
+	l, err := conn.link(localDev)
+	if err == nil {
+		err = l.SendBreak(duration)
+	}
+	return err
+}
+
+func (conn *Connection) Wait() {
+	conn.wg.Wait()
+}
+
+func (conn *Connection) Close() error {
+	conn.mu.Lock()
+	if !conn.closed {
+		conn.closed = true
+		close(conn.done)
+	}
+	sessions := conn.sessions
+	conn.sessions = nil
+	conn.mu.Unlock()
+
+	for _, session := range sessions {
+		session.Signal(ssh.SIGINT)
+		session.Close()
+	}
+
+	for _, listener := range conn.listeners {
+		listener.Close()
+	}
+
+	for _, l := range conn.links {
+		l.Close()
+	}
+
+	for _, l := range conn.terminals {
+		l.Close()
+	}
+	conn.links = nil
+	conn.terminals = nil
+	conn.listeners = nil
+
+	// the jump host connections are closed along with the client
+	if client := conn.client(); client != nil {
+		client.Close()
+	}
+
+	if conn.config.agentConn != nil {
+		conn.config.agentConn.Close()
+	}
+	return nil
 }
 
 func Connect(hostname string, options ...ConfigOption) (*Connection, error) {
 	config := &Config{
-		port:      22,
-		keepAlive: time.Second * 60,
+		keepAlive:         time.Second * 60,
+		keepAliveCountMax: 3,
+		keepAliveTimeout:  time.Second * 15,
+		updateHostKeys:    true,
 		clientConfig: ssh.ClientConfig{
 			Timeout: time.Second * 5,
 		},
 	}
 
 	for _, option := range options {
-		option(config)
+		if err := option(config); err != nil {
+			return nil, err
+		}
 	}
 
-	if config.identityAuth == nil || config.clientConfig.User == "" || config.knownHosts == "" {
-		u, err := user.Current()
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	// identity files given as options replace those of ssh_config, the
+	// default identity file is otherwise always tried after them
+	explicitIdentity := len(config.identities) > 0
+
+	if config.sshConfig {
+		hostname, err = config.applySSHConfig(hostname, u.HomeDir)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		if config.identityAuth == nil {
-			err := DefaultIdentityFile(u.HomeDir)(config)
-			if err != nil {
-				return nil, err
-			}
-		}
+	if config.port == 0 {
+		config.port = 22
+	}
 
-		if config.identityAuth != nil {
-			config.clientConfig.Auth = append(config.clientConfig.Auth, config.identityAuth)
+	if config.useAgent {
+		if err := config.dialAgent(); err != nil && !config.agentOptional {
+			return nil, err
+		} else if err != nil {
+			Logger.Printf("%v, using the identity files only", err)
 		}
+	}
 
-		if config.passwordAuth != nil {
-			config.clientConfig.Auth = append(config.clientConfig.Auth, config.passwordAuth)
+	if !explicitIdentity {
+		err := DefaultIdentityFile(u.HomeDir)(config)
+		if err != nil && len(config.identities) == 0 && config.agent == nil {
+			return nil, err
 		}
+	}
+	config.clientConfig.Auth = config.authMethods()
 
-		if config.clientConfig.User == "" {
-			config.clientConfig.User = u.Username
-		}
+	if config.clientConfig.User == "" {
+		config.clientConfig.User = u.Username
+	}
 
-		if config.knownHosts == "" {
-			config.knownHosts = filepath.Join(u.HomeDir, ".ssh", "known_hosts")
-		}
+	if config.knownHosts == nil {
+		config.knownHosts = []string{filepath.Join(u.HomeDir, ".ssh", "known_hosts")}
 	}
 
-	conn := &Connection{config: config}
+	conn := newConnection(config)
+	conn.addr = fmt.Sprintf("%s:%d", hostname, config.port)
 	config.clientConfig.HostKeyCallback = conn.hostKeyCallback
+	if len(config.hostKeyFingerprints) > 0 {
+		config.clientConfig.HostKeyCallback = config.pinnedHostKey
+	}
 
-	var err error
-	conn.Client, err = ssh.Dial("tcp", fmt.Sprintf("%s:%d", hostname, config.port), &config.clientConfig)
+	conn.jumps, err = conn.jumpHosts(u.HomeDir)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.Client, err = conn.dial()
+	conn.connected = err == nil
 	if err == nil && config.keepAlive > 0 {
-		go func() {
-			for {
-				<-time.After(config.keepAlive)
-				println("Sending keep alive")
-				_, _, err := conn.Client.SendRequest("rcom keep alive", true, nil)
-				if err != nil {
-					conn.Close()
-					return
-				}
-			}
-		}()
+		go conn.keepAlive()
 	}
 	return conn, err
 }
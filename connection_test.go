@@ -0,0 +1,225 @@
+package rcom
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an ssh server on the loopback interface that accepts
+// any public key, or only the authorized key once one is set.
+// Keep-alive requests are answered until silence is called
+type testServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+
+	mu         sync.Mutex
+	silent     bool
+	authorized ssh.PublicKey
+	conns      []*ssh.ServerConn
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create host key signer: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	s := &testServer{listener: listener, hostKey: hostKey}
+	go s.serve()
+	return s
+}
+
+func (s *testServer) serve() {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.authorized != nil && !bytes.Equal(key.Marshal(), s.authorized.Marshal()) {
+				return nil, fmt.Errorf("unauthorized key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(s.hostKey)
+
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			conn, chans, reqs, err := ssh.NewServerConn(c, config)
+			if err != nil {
+				c.Close()
+				return
+			}
+
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+
+			go func() {
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+
+			for req := range reqs {
+				if req.WantReply && !s.isSilent() {
+					req.Reply(req.Type == keepAliveRequest, nil)
+				}
+			}
+		}()
+	}
+}
+
+func (s *testServer) isSilent() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.silent
+}
+
+// silence stops answering requests, as a dead peer would
+func (s *testServer) silence() {
+	s.mu.Lock()
+	s.silent = true
+	s.mu.Unlock()
+}
+
+func (s *testServer) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// authorize only accepts key from now on
+func (s *testServer) authorize(key ssh.PublicKey) {
+	s.mu.Lock()
+	s.authorized = key
+	s.mu.Unlock()
+}
+
+func (s *testServer) connect(t *testing.T, options ...ConfigOption) *Connection {
+	t.Helper()
+	conn, err := s.dial(t, options...)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	return conn
+}
+
+// dial connects to the server with a new identity and the host key
+// pinned by its fingerprint
+func (s *testServer) dial(t *testing.T, options ...ConfigOption) (*Connection, error) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyfile := filepath.Join(dir, "id_ed25519")
+	if err := GenerateKey(Ed25519Key, 0, keyfile, "test", nil); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	port := s.listener.Addr().(*net.TCPAddr).Port
+	options = append([]ConfigOption{
+		Port(port),
+		IdentityFile(keyfile),
+		HostKeyFingerprint(ssh.FingerprintSHA256(s.hostKey.PublicKey())),
+		KnownHosts(filepath.Join(dir, "known_hosts")),
+	}, options...)
+
+	return Connect("127.0.0.1", options...)
+}
+
+func TestConnectionDeadPeer(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	var mu sync.Mutex
+	var events []Event
+	conn := server.connect(t,
+		KeepAlive(20*time.Millisecond),
+		KeepAliveTimeout(20*time.Millisecond),
+		KeepAliveCountMax(3),
+		Notify(func(event Event) {
+			mu.Lock()
+			events = append(events, event)
+			mu.Unlock()
+		}),
+	)
+	defer conn.Close()
+
+	// answered keep-alives keep the connection open
+	time.Sleep(200 * time.Millisecond)
+	if conn.isClosed() {
+		t.Fatalf("Connection was closed while the peer answered keep-alives: %v", conn.Err())
+	}
+
+	server.silence()
+	start := time.Now()
+	select {
+	case <-conn.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Connection was not closed after the peer stopped answering")
+	}
+
+	// three keep-alives must go unanswered, each after an interval
+	if elapsed := time.Since(start); elapsed < 3*20*time.Millisecond {
+		t.Errorf("Connection was closed after %v, before 3 keep-alives went unanswered", elapsed)
+	}
+
+	if conn.Err() != ErrDeadPeer {
+		t.Errorf("Err() = %v, want %v", conn.Err(), ErrDeadPeer)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0].Type != DisconnectEvent {
+		t.Errorf("Events = %v, want a single disconnect", events)
+	}
+}
+
+func TestConnectionCloseClient(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	conn := server.connect(t, KeepAlive(0))
+	conn.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- conn.Client.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The ssh client was not closed by Close")
+	}
+}
@@ -0,0 +1,282 @@
+package rcom
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DispatchCommand is the rcom command that authorized_keys entries with a
+// KeyRestriction are forced to run
+const DispatchCommand = "server-dispatch"
+
+// KeyRestriction limits an authorized key to serving devices with rcom
+type KeyRestriction struct {
+	// Exec is the rcom executable on the host, rcom when empty
+	Exec string
+
+	// Devices are the device paths, or glob patterns, the key may serve
+	Devices []string
+
+	// From are the address patterns the key may be used from
+	From []string
+
+	// Expiry is when the key stops being accepted, never when zero
+	Expiry time.Time
+}
+
+// options returns the authorized_keys options of the restriction for
+// the key with the fingerprint, which the access policy of the
+// dispatcher applies to
+func (r *KeyRestriction) options(fingerprint string) (string, error) {
+	if len(r.Devices) == 0 {
+		return "", fmt.Errorf("A restricted key needs at least one device")
+	}
+
+	exec := r.Exec
+	if exec == "" {
+		exec = "rcom"
+	}
+
+	command := []string{shellQuote(exec), DispatchCommand, "-key", shellQuote(fingerprint)}
+	for _, device := range r.Devices {
+		if !filepath.IsAbs(device) {
+			return "", fmt.Errorf("Invalid device %q: expected an absolute path", device)
+		}
+		command = append(command, shellQuote(device))
+	}
+
+	options := []string{"restrict", "command=" + optionQuote(strings.Join(command, " "))}
+	if len(r.From) > 0 {
+		for _, from := range r.From {
+			if from == "" || strings.IndexFunc(from, func(r rune) bool { return unicode.IsSpace(r) || r == '"' || r == ',' }) >= 0 {
+				return "", fmt.Errorf("Invalid from pattern %q", from)
+			}
+		}
+		options = append(options, "from="+optionQuote(strings.Join(r.From, ",")))
+	}
+
+	if !r.Expiry.IsZero() {
+		// sshd reads the expiry time in its local time zone
+		options = append(options, "expiry-time="+optionQuote(r.Expiry.Local().Format("200601021504")))
+	}
+	return strings.Join(options, ","), nil
+}
+
+// shellQuote quotes s for the shell that sshd runs the command with
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("/._-+:@%=", r)))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// optionQuote quotes an authorized_keys option value, sshd only
+// unescapes double quotes
+func optionQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// serverCommand is an rcom server command line sent by a client
+type serverCommand struct {
+	debug    bool
+	pty      bool
+	mux      bool
+	brk      time.Duration
+	settings string
+	devices  []string
+}
+
+// parseServerCommand parses the command line of the rcom server that a
+// client asked to run.  Only the server commands that rcom clients send
+// are accepted, without -f since it removes whatever the device path
+// names
+func parseServerCommand(command string) (*serverCommand, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Interactive sessions are not allowed, only rcom server commands")
+	}
+
+	sc := &serverCommand{}
+	global := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	global.SetOutput(ioutil.Discard)
+	global.BoolVar(&sc.debug, "debug", false, "")
+	if err := global.Parse(args[1:]); err != nil || global.Arg(0) != "server" {
+		return nil, fmt.Errorf("Command not allowed: only rcom server commands may be run with this key")
+	}
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	force := fs.Bool("f", false, "")
+	fs.StringVar(&sc.settings, "s", "", "")
+	fs.BoolVar(&sc.pty, "pty", false, "")
+	fs.BoolVar(&sc.mux, "mux", false, "")
+	fs.DurationVar(&sc.brk, "break", 0, "")
+	if err := fs.Parse(global.Args()[1:]); err != nil {
+		return nil, fmt.Errorf("Command not allowed: %v", err)
+	} else if *force {
+		return nil, fmt.Errorf("Command not allowed: -f can not be used with a restricted key")
+	}
+
+	sc.devices = fs.Args()
+	if len(sc.devices) == 0 {
+		return nil, fmt.Errorf("Command not allowed: no device given")
+	} else if len(sc.devices) > 1 && !sc.mux {
+		return nil, fmt.Errorf("Command not allowed: unexpected arguments %q", sc.devices[1:])
+	}
+	return sc, nil
+}
+
+// paths returns the device paths of the command, without the settings of
+// multiplexed devices
+func (sc *serverCommand) paths() []string {
+	var paths []string
+	for _, device := range sc.devices {
+		if sc.mux {
+			device = strings.SplitN(device, ":", 2)[0]
+		}
+		paths = append(paths, device)
+	}
+	return paths
+}
+
+// run serves the devices of the command
+func (sc *serverCommand) run(options ...ServerOption) error {
+	if sc.debug {
+		Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	if sc.brk > 0 {
+		return SendBreak(sc.devices[0], sc.brk, options...)
+	}
+
+	var settings *Settings
+	if sc.settings != "" {
+		var err error
+		settings, err = ParseSettings(sc.settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	if sc.pty {
+		return PTYServer(sc.devices[0], false, options...)
+	}
+
+	if sc.mux {
+		return MuxServer(sc.devices, false, settings, options...)
+	}
+	return Server(sc.devices[0], false, settings, options...)
+}
+
+// matchDevice reports whether device is one of the patterns.  Devices
+// that are not clean absolute paths never match
+func matchDevice(patterns []string, device string) bool {
+	if !filepath.IsAbs(device) || filepath.Clean(device) != device {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, device); matched || pattern == device {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatch runs the rcom server command that a client sent, normally
+// taken from SSH_ORIGINAL_COMMAND, when it only serves the devices that
+// match the patterns and the access policy of the options.  It is the
+// forced command of restricted keys
+func Dispatch(command string, devices []string, options ...ServerOption) error {
+	sc, err := parseServerCommand(command)
+	if err != nil {
+		return err
+	}
+
+	for _, device := range sc.paths() {
+		if !matchDevice(devices, device) {
+			return fmt.Errorf("Access to %s is not allowed with this key", device)
+		}
+	}
+
+	Logger.Printf("Dispatching %q", command)
+	return sc.run(options...)
+}
+
+// splitCommand splits a command line into its arguments like the shell
+// does for the quoting used by rcom clients: single quotes, and double
+// quotes with backslash escapes as written by %q.  Anything the shell
+// would expand or treat as another command, such as newlines, is refused
+func splitCommand(command string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated quote in command %q", command)
+			}
+			arg.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inArg = true
+		case c == '"':
+			end := i + 1
+			for ; end < len(command) && command[end] != '"'; end++ {
+				if command[end] == '$' || command[end] == '`' {
+					return nil, fmt.Errorf("Command not allowed: unexpected %q", command[end])
+				} else if command[end] == '\\' {
+					end++
+				}
+			}
+
+			if end >= len(command) {
+				return nil, fmt.Errorf("Unterminated quote in command %q", command)
+			}
+
+			s, err := strconv.Unquote(command[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid quoting in command %q", command)
+			}
+			arg.WriteString(s)
+			i = end
+			inArg = true
+		case c == '\\' && i+1 < len(command):
+			i++
+			arg.WriteByte(command[i])
+			inArg = true
+		case strings.IndexByte("|&;<>()$`*?[#~{}\n\r", c) >= 0:
+			return nil, fmt.Errorf("Command not allowed: unexpected %q", c)
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
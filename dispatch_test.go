@@ -0,0 +1,252 @@
+package rcom
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"rcom server /dev/ttyS0", []string{"rcom", "server", "/dev/ttyS0"}},
+		{"rcom\tserver  /dev/ttyS0 ", []string{"rcom", "server", "/dev/ttyS0"}},
+		{`rcom server "/dev/tty S0"`, []string{"rcom", "server", "/dev/tty S0"}},
+		{`rcom server "/dev/tty\"S0\\"`, []string{"rcom", "server", `/dev/tty"S0\`}},
+		{`rcom server '/dev/$(tty);S0'`, []string{"rcom", "server", "/dev/$(tty);S0"}},
+		{`rcom server /dev/tty\ S0`, []string{"rcom", "server", "/dev/tty S0"}},
+		{`rcom server /dev/'tty'"S0"`, []string{"rcom", "server", "/dev/ttyS0"}},
+		{`rcom server ''`, []string{"rcom", "server", ""}},
+	}
+
+	for _, test := range tests {
+		got, err := splitCommand(test.command)
+		if err != nil {
+			t.Errorf("splitCommand(%q): %v", test.command, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitCommand(%q) = %q, want %q", test.command, got, test.want)
+		}
+	}
+}
+
+func TestSplitCommandInvalid(t *testing.T) {
+	tests := []string{
+		"rcom server /dev/ttyS0; rm -rf /",
+		"rcom server /dev/ttyS0 | nc host 1234",
+		"rcom server /dev/ttyS0 && reboot",
+		"rcom server /dev/$(whoami)",
+		"rcom server /dev/${TTY}",
+		"rcom server /dev/`whoami`",
+		`rcom server "/dev/$(whoami)"`,
+		"rcom server \"/dev/`whoami`\"",
+		"rcom server /dev/ttyS0\nreboot",
+		"rcom server /dev/ttyS0\r\nreboot",
+		"rcom server /dev/ttyS0 > /etc/passwd",
+		"rcom server /dev/ttyS0 < /etc/shadow",
+		"rcom server /dev/ttyS0 &",
+		"rcom server /dev/ttyS*",
+		"rcom server /dev/ttyS?",
+		"rcom server /dev/ttyS[01]",
+		"rcom server ~/ttyS0",
+		"rcom server /dev/ttyS{0,1}",
+		"rcom server /dev/ttyS0 # comment",
+		"rcom server '/dev/ttyS0",
+		`rcom server "/dev/ttyS0`,
+		`rcom server "/dev/ttyS0\"`,
+		`rcom server "/dev/\qttyS0"`,
+	}
+
+	for _, command := range tests {
+		if args, err := splitCommand(command); err == nil {
+			t.Errorf("splitCommand(%q) = %q, expected an error", command, args)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []string{
+		"/dev/ttyS0",
+		"/dev/tty S0",
+		"/dev/tty'S0",
+		"/dev/$(whoami)",
+		"/dev/`whoami`;reboot",
+		"SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s",
+		"",
+	}
+
+	for _, s := range tests {
+		args, err := splitCommand(shellQuote(s))
+		if err != nil {
+			t.Errorf("shellQuote(%q) = %s: %v", s, shellQuote(s), err)
+		} else if len(args) != 1 || args[0] != s {
+			t.Errorf("shellQuote(%q) = %s, split into %q", s, shellQuote(s), args)
+		}
+	}
+}
+
+func TestParseServerCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    serverCommand
+		paths   []string
+	}{
+		{"rcom server /dev/ttyS0", serverCommand{devices: []string{"/dev/ttyS0"}}, []string{"/dev/ttyS0"}},
+		{`/usr/bin/rcom -debug server -s 9600,8,N,1 "/dev/ttyS0"`, serverCommand{debug: true, settings: "9600,8,N,1", devices: []string{"/dev/ttyS0"}}, []string{"/dev/ttyS0"}},
+		{`rcom server -pty "/tmp/rp"`, serverCommand{pty: true, devices: []string{"/tmp/rp"}}, []string{"/tmp/rp"}},
+		{`rcom server -break 250ms "/dev/ttyS0"`, serverCommand{brk: 250 * time.Millisecond, devices: []string{"/dev/ttyS0"}}, []string{"/dev/ttyS0"}},
+		{`rcom server -mux "/dev/ttyS0" "/dev/ttyUSB0:115200,8,N,1"`, serverCommand{mux: true, devices: []string{"/dev/ttyS0", "/dev/ttyUSB0:115200,8,N,1"}}, []string{"/dev/ttyS0", "/dev/ttyUSB0"}},
+		{`rcom server "/dev/ttyUSB0:115200"`, serverCommand{devices: []string{"/dev/ttyUSB0:115200"}}, []string{"/dev/ttyUSB0:115200"}},
+	}
+
+	for _, test := range tests {
+		sc, err := parseServerCommand(test.command)
+		if err != nil {
+			t.Errorf("parseServerCommand(%q): %v", test.command, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(*sc, test.want) {
+			t.Errorf("parseServerCommand(%q) = %+v, want %+v", test.command, *sc, test.want)
+		}
+
+		if paths := sc.paths(); !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("parseServerCommand(%q) paths %q, want %q", test.command, paths, test.paths)
+		}
+	}
+}
+
+func TestParseServerCommandInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"rcom",
+		"sh -c reboot",
+		"rcom client host /dev/ttyS0",
+		"rcom key auth -f -",
+		"rcom -unknown server /dev/ttyS0",
+		"rcom server",
+		"rcom server -unknown /dev/ttyS0",
+		"rcom server -break forever /dev/ttyS0",
+		"rcom server -f /dev/ttyS0",
+		"rcom server -f -pty /tmp/rp",
+		"rcom server -mux -f=true /dev/ttyS0",
+		"rcom server /dev/ttyS0 /dev/ttyS1",
+		"rcom server /dev/ttyS0; sh",
+	}
+
+	for _, command := range tests {
+		if sc, err := parseServerCommand(command); err == nil {
+			t.Errorf("parseServerCommand(%q) = %+v, expected an error", command, *sc)
+		}
+	}
+}
+
+func TestMatchDevice(t *testing.T) {
+	patterns := []string{"/dev/ttyUSB*", "/dev/ttyS0", "/dev/serial/by-id/*"}
+	tests := []struct {
+		device string
+		want   bool
+	}{
+		{"/dev/ttyS0", true},
+		{"/dev/ttyS1", false},
+		{"/dev/ttyUSB0", true},
+		{"/dev/ttyUSB12", true},
+		{"/dev/serial/by-id/usb-FTDI", true},
+		{"/dev/serial/by-id/a/b", false},
+		{"/dev/ttyUSB0/../ttyS1", false},
+		{"/dev/../etc/shadow", false},
+		{"/dev/ttyUSB../../etc/passwd", false},
+		{"/dev//ttyS0", false},
+		{"/dev/./ttyS0", false},
+		{"/dev/ttyS0/", false},
+		{"dev/ttyS0", false},
+		{"ttyUSB0", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := matchDevice(patterns, test.device); got != test.want {
+			t.Errorf("matchDevice(%q) = %v, want %v", test.device, got, test.want)
+		}
+	}
+
+	if matchDevice([]string{"/dev/ttyS["}, "/dev/ttyS[") != true {
+		t.Errorf("Expected an invalid pattern to match the same path")
+	}
+
+	if matchDevice(nil, "/dev/ttyS0") {
+		t.Errorf("Expected no patterns to match nothing")
+	}
+}
+
+func TestDispatchDenied(t *testing.T) {
+	devices := []string{"/dev/ttyUSB*"}
+	tests := []struct {
+		command string
+		err     string
+	}{
+		{"", "Interactive sessions are not allowed"},
+		{" \t", "Interactive sessions are not allowed"},
+		{"\n", "Command not allowed"},
+		{"rcom server /dev/ttyS0", "Access to /dev/ttyS0 is not allowed"},
+		{`rcom server "/dev/ttyUSB0/../ttyS0"`, "Access to /dev/ttyUSB0/../ttyS0 is not allowed"},
+		{`rcom server -mux "/dev/ttyUSB0" "/dev/ttyS0:9600"`, "Access to /dev/ttyS0 is not allowed"},
+		{`rcom server -break 1s "/dev/ttyS0"`, "Access to /dev/ttyS0 is not allowed"},
+		{`rcom server -f "/dev/ttyUSB0"`, "-f can not be used with a restricted key"},
+		{"rcom server /dev/ttyUSB0; reboot", "Command not allowed"},
+	}
+
+	for _, test := range tests {
+		err := Dispatch(test.command, devices)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Dispatch(%q) = %v, want %q", test.command, err, test.err)
+		}
+	}
+}
+
+func TestDispatchMissingCommand(t *testing.T) {
+	command, found := os.LookupEnv("SSH_ORIGINAL_COMMAND")
+	os.Unsetenv("SSH_ORIGINAL_COMMAND")
+	defer func() {
+		if found {
+			os.Setenv("SSH_ORIGINAL_COMMAND", command)
+		}
+	}()
+
+	err := Dispatch(os.Getenv("SSH_ORIGINAL_COMMAND"), []string{"/dev/ttyS0"})
+	if err == nil || !strings.Contains(err.Error(), "Interactive sessions are not allowed") {
+		t.Errorf("Dispatch without SSH_ORIGINAL_COMMAND = %v, expected interactive sessions to be refused", err)
+	}
+}
+
+func TestKeyRestrictionOptions(t *testing.T) {
+	r := &KeyRestriction{Devices: []string{"/dev/ttyUSB*", "/dev/tty S0"}, From: []string{"10.0.0.0/8", "*.example.com"}}
+	got, err := r.options("SHA256:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `restrict,command="rcom server-dispatch -key SHA256:abc '/dev/ttyUSB*' '/dev/tty S0'",from="10.0.0.0/8,*.example.com"`
+	if got != want {
+		t.Errorf("Got options %s, want %s", got, want)
+	}
+
+	invalid := []*KeyRestriction{
+		{},
+		{Devices: []string{"ttyS0"}},
+		{Devices: []string{"/dev/ttyS0"}, From: []string{"10.0.0.1,"}},
+		{Devices: []string{"/dev/ttyS0"}, From: []string{`"`}},
+		{Devices: []string{"/dev/ttyS0"}, From: []string{""}},
+	}
+
+	for _, r := range invalid {
+		if options, err := r.options("SHA256:abc"); err == nil {
+			t.Errorf("Restriction %+v gave options %s, expected an error", *r, options)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package rcom
+
+import "fmt"
+
+type EventType int
+
+const (
+	// ModemEvent is reported when the input lines of the remote
+	// device change state
+	ModemEvent EventType = iota
+
+	// BreakEvent is reported when the remote device receives a BREAK
+	BreakEvent
+
+	// DisconnectEvent is reported when the remote host stops answering
+	// keep-alives or the connection to it is lost.  Device is the address
+	// of the remote host
+	DisconnectEvent
+
+	// ReconnectEvent is reported when the connection to the remote host
+	// has been re-established
+	ReconnectEvent
+)
+
+func (et EventType) String() string {
+	switch et {
+	case ModemEvent:
+		return "modem"
+	case BreakEvent:
+		return "break"
+	case DisconnectEvent:
+		return "disconnect"
+	case ReconnectEvent:
+		return "reconnect"
+	}
+	return fmt.Sprintf("event(%d)", int(et))
+}
+
+// Event describes a change on the remote end of an attached device or
+// of the connection to the remote host
+type Event struct {
+	Device string
+	Type   EventType
+	Lines  ModemLines
+}
+
+func (ev Event) String() string {
+	switch ev.Type {
+	case ModemEvent:
+		return fmt.Sprintf("%s: %v lines %v", ev.Device, ev.Type, ev.Lines)
+	}
+	return fmt.Sprintf("%s: %v", ev.Device, ev.Type)
+}
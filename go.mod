@@ -6,5 +6,5 @@ require (
 	github.com/abates/cli v0.0.0-20200214140913-c0d2d0647475
 	github.com/creack/pty v1.1.9
 	golang.org/x/crypto v0.0.0-20200214034016-1d94cc7ab1c6
-	golang.org/x/sys v0.0.0-20200212091648-12a6c2dcc1e4 // indirect
+	golang.org/x/sys v0.0.0-20200212091648-12a6c2dcc1e4
 )
@@ -0,0 +1,246 @@
+package rcom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH host key rotation requests, see PROTOCOL in the OpenSSH source
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// hostKeysFilter passes the global requests of the remote host on to the
+// client, except for hostkeys-00@openssh.com which is used to update
+// known_hosts.  hostKey is the key the host authenticated with
+func (config *Config) hostKeysFilter(client ssh.Conn, hostname string, hostKey ssh.PublicKey, in <-chan *ssh.Request) <-chan *ssh.Request {
+	out := make(chan *ssh.Request)
+	go func() {
+		defer close(out)
+		for req := range in {
+			if req.Type != hostKeysRequest {
+				out <- req
+				continue
+			}
+
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+
+			go func(payload []byte) {
+				if err := config.updateKnownHosts(client, hostname, hostKey, payload); err != nil {
+					Logger.Printf("Not updating the host keys of %s: %v", hostname, err)
+				}
+			}(req.Payload)
+		}
+	}()
+	return out
+}
+
+// updateKnownHosts adds the announced host keys that are not known yet to
+// the first user known_hosts file, once the host has proven that it holds
+// their private keys, and removes the keys of the host that are no longer
+// announced.  Like OpenSSH, only lines for this host alone are removed
+func (config *Config) updateKnownHosts(client ssh.Conn, hostname string, hostKey ssh.PublicKey, payload []byte) error {
+	if _, ok := hostKey.(*ssh.Certificate); ok {
+		return fmt.Errorf("The host authenticated with a certificate")
+	}
+
+	if len(config.knownHosts) == 0 {
+		return fmt.Errorf("No known_hosts file to write to")
+	}
+
+	blobs, err := parseStrings(payload)
+	if err != nil {
+		return fmt.Errorf("Invalid %s request: %v", hostKeysRequest, err)
+	}
+
+	var keys []ssh.PublicKey
+	announced := make(map[string]bool)
+	for _, blob := range blobs {
+		key, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			Logger.Printf("Skipping host key announced by %s: %v", hostname, err)
+			continue
+		}
+
+		if _, ok := key.(*ssh.Certificate); ok || announced[string(blob)] {
+			continue
+		}
+		announced[string(blob)] = true
+		keys = append(keys, key)
+	}
+
+	if !announced[string(hostKey.Marshal())] {
+		return fmt.Errorf("The announced keys do not include the %s key the host authenticated with", hostKey.Type())
+	}
+
+	db, err := config.knownHostsDB()
+	if err != nil {
+		return err
+	}
+
+	file := config.knownHosts[0]
+	var deprecated []knownHostsLine
+	found := false
+	for _, line := range db.hostKeys(hostname) {
+		if line.file != file {
+			continue
+		}
+
+		found = true
+		if len(line.hosts) == 1 && !announced[string(line.key.Marshal())] {
+			deprecated = append(deprecated, line)
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("%s is not in %s", hostname, file)
+	}
+
+	var learned []ssh.PublicKey
+	for _, key := range keys {
+		if db.revoked[string(key.Marshal())] {
+			Logger.Printf("Skipping revoked %s key %s announced by %s", key.Type(), ssh.FingerprintSHA256(key), hostname)
+		} else if !db.hasKey(hostname, key) {
+			learned = append(learned, key)
+		}
+	}
+
+	if len(learned) == 0 && len(deprecated) == 0 {
+		return nil
+	}
+
+	if len(learned) > 0 {
+		if err := proveHostKeys(client, learned); err != nil {
+			return err
+		}
+	}
+	return config.rewriteKnownHosts(file, hostname, learned, deprecated)
+}
+
+// proveHostKeys asks the host to sign the session ID with each of the
+// keys and verifies the signatures
+func proveHostKeys(client ssh.Conn, keys []ssh.PublicKey) error {
+	var payload []byte
+	for _, key := range keys {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{key.Marshal()})...)
+	}
+
+	ok, reply, err := client.SendRequest(hostKeysProveRequest, true, payload)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("The host refused to prove its keys")
+	}
+
+	sigs, err := parseStrings(reply)
+	if err != nil {
+		return fmt.Errorf("Invalid %s reply: %v", hostKeysProveRequest, err)
+	} else if len(sigs) != len(keys) {
+		return fmt.Errorf("Expected %d signatures but got %d", len(keys), len(sigs))
+	}
+
+	for i, key := range keys {
+		sig := new(ssh.Signature)
+		if err := ssh.Unmarshal(sigs[i], sig); err != nil {
+			return fmt.Errorf("Invalid signature for the %s key: %v", key.Type(), err)
+		}
+
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{hostKeysProveRequest, client.SessionID(), key.Marshal()})
+
+		if err := key.Verify(data, sig); err != nil {
+			return fmt.Errorf("The host failed to prove its %s key %s: %v", key.Type(), ssh.FingerprintSHA256(key), err)
+		}
+	}
+	return nil
+}
+
+// rewriteKnownHosts replaces file with a copy that leaves out the
+// deprecated lines and adds the learned keys of hostname
+func (config *Config) rewriteKnownHosts(file, hostname string, learned []ssh.PublicKey, deprecated []knownHostsLine) error {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	remove := make(map[int]bool)
+	for _, line := range deprecated {
+		Logger.Printf("Removing %s key %s of %s from %s:%d", line.key.Type(), ssh.FingerprintSHA256(line.key), hostname, file, line.line)
+		remove[line.line] = true
+	}
+
+	var out bytes.Buffer
+	lines := strings.SplitAfter(string(buf), "\n")
+	for i, line := range lines {
+		if line == "" || remove[i+1] {
+			continue
+		}
+
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteByte('\n')
+		}
+	}
+
+	for _, key := range learned {
+		Logger.Printf("Adding %s key %s of %s to %s", key.Type(), ssh.FingerprintSHA256(key), hostname, file)
+		out.WriteString(config.knownHostsEntry(hostname, key) + "\n")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	_, err = tmp.Write(out.Bytes())
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %v", file, err)
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// parseStrings splits buf into the SSH strings it consists of
+func parseStrings(buf []byte) ([][]byte, error) {
+	var strs [][]byte
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, fmt.Errorf("Short string length")
+		}
+
+		length := binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+		if uint32(len(buf)) < length {
+			return nil, fmt.Errorf("String length %d exceeds the %d remaining bytes", length, len(buf))
+		}
+		strs = append(strs, buf[:length])
+		buf = buf[length:]
+	}
+	return strs, nil
+}
@@ -0,0 +1,214 @@
+package rcom
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	kh "golang.org/x/crypto/ssh/knownhosts"
+)
+
+// proverConn is the client side of a connection to a host that holds
+// the private keys of signers and proves them on request
+type proverConn struct {
+	ssh.Conn
+	signers []ssh.Signer
+}
+
+func (c *proverConn) SessionID() []byte { return []byte("session") }
+
+func (c *proverConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	if name != hostKeysProveRequest {
+		return false, nil, nil
+	}
+
+	blobs, err := parseStrings(payload)
+	if err != nil {
+		return false, nil, err
+	}
+
+	var reply []byte
+	for _, blob := range blobs {
+		key, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			return false, nil, err
+		}
+
+		// keys the host does not hold are signed with another key
+		signer := c.signers[0]
+		for _, s := range c.signers {
+			if string(s.PublicKey().Marshal()) == string(blob) {
+				signer = s
+			}
+		}
+
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{hostKeysProveRequest, c.SessionID(), key.Marshal()})
+		sig, err := signer.Sign(rand.Reader, data)
+		if err != nil {
+			return false, nil, err
+		}
+		reply = append(reply, ssh.Marshal(struct{ Sig []byte }{ssh.Marshal(sig)})...)
+	}
+	return true, reply, nil
+}
+
+// hostKeysPayload returns a hostkeys-00 request announcing keys
+func hostKeysPayload(keys ...ssh.PublicKey) []byte {
+	var payload []byte
+	for _, key := range keys {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{key.Marshal()})...)
+	}
+	return payload
+}
+
+func TestUpdateKnownHosts(t *testing.T) {
+	current, retired, shared, added := newTestSigner(t), newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	line := func(host string, key ssh.Signer) string {
+		return kh.Line(strings.Split(host, ","), key.PublicKey()) + "\n"
+	}
+	content := "# keep this comment\n" +
+		line("router", current) +
+		line("switch", retired) +
+		line("router", retired) +
+		line("router,router.example.com", shared) +
+		"\n" +
+		"# and this one\n"
+
+	tests := []struct {
+		name      string
+		signers   []ssh.Signer
+		announced []ssh.PublicKey
+		want      string
+		wantErr   bool
+	}{{
+		name:      "proven key added and deprecated key removed",
+		signers:   []ssh.Signer{current, added},
+		announced: []ssh.PublicKey{current.PublicKey(), added.PublicKey()},
+		want: "# keep this comment\n" +
+			line("router", current) +
+			line("switch", retired) +
+			line("router,router.example.com", shared) +
+			"\n" +
+			"# and this one\n" +
+			line("router", added),
+	}, {
+		name:      "unproven key",
+		signers:   []ssh.Signer{current},
+		announced: []ssh.PublicKey{current.PublicKey(), retired.PublicKey(), added.PublicKey()},
+		want:      content,
+		wantErr:   true,
+	}, {
+		name:      "authenticated key not announced",
+		signers:   []ssh.Signer{added},
+		announced: []ssh.PublicKey{added.PublicKey()},
+		want:      content,
+		wantErr:   true,
+	}, {
+		name:      "nothing changed",
+		signers:   []ssh.Signer{current},
+		announced: []ssh.PublicKey{current.PublicKey(), retired.PublicKey(), shared.PublicKey()},
+		want:      content,
+	}}
+
+	for _, test := range tests {
+		dir := writeKnownHosts(t, map[string]string{"known_hosts": content})
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "known_hosts")
+		if err := os.Chmod(file, 0640); err != nil {
+			t.Fatalf("Failed to change the mode of %s: %v", file, err)
+		}
+
+		config := &Config{knownHosts: []string{file}, globalKnownHosts: []string{}}
+		client := &proverConn{signers: test.signers}
+		err := config.updateKnownHosts(client, "router:22", current.PublicKey(), hostKeysPayload(test.announced...))
+		if test.wantErr && err == nil {
+			t.Errorf("%s: known_hosts was updated", test.name)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("%s: updateKnownHosts failed: %v", test.name, err)
+		}
+
+		buf, _ := ioutil.ReadFile(file)
+		if string(buf) != test.want {
+			t.Errorf("%s: known_hosts is\n%s\nwant\n%s", test.name, buf, test.want)
+		}
+
+		// the file is replaced by renaming a copy that keeps its mode
+		if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0640 {
+			t.Errorf("%s: the mode of known_hosts changed: %v %v", test.name, info.Mode(), err)
+		}
+
+		if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+			t.Errorf("%s: %d files left in the known_hosts directory", test.name, len(files))
+		}
+	}
+}
+
+func TestUpdateKnownHostsCertificate(t *testing.T) {
+	key := newTestSigner(t)
+	cert := &ssh.Certificate{Key: key.PublicKey(), CertType: ssh.HostCert}
+	config := &Config{knownHosts: []string{"known_hosts"}}
+	if err := config.updateKnownHosts(&proverConn{}, "router:22", cert, hostKeysPayload(key.PublicKey())); err == nil {
+		t.Errorf("Host keys were updated for a host that authenticated with a certificate")
+	}
+}
+
+func TestHostKeysFilter(t *testing.T) {
+	current, added := newTestSigner(t), newTestSigner(t)
+	dir := writeKnownHosts(t, map[string]string{"known_hosts": kh.Line([]string{"router"}, current.PublicKey()) + "\n"})
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "known_hosts")
+
+	config := &Config{knownHosts: []string{file}, globalKnownHosts: []string{}}
+	in := make(chan *ssh.Request, 2)
+	out := config.hostKeysFilter(&proverConn{signers: []ssh.Signer{current, added}}, "router:22", current.PublicKey(), in)
+
+	in <- &ssh.Request{Type: hostKeysRequest, Payload: hostKeysPayload(current.PublicKey(), added.PublicKey())}
+	in <- &ssh.Request{Type: keepAliveRequest}
+	close(in)
+
+	// other requests are passed on, the host keys request is not
+	var passed []string
+	for req := range out {
+		passed = append(passed, req.Type)
+	}
+
+	if len(passed) != 1 || passed[0] != keepAliveRequest {
+		t.Errorf("Passed on %q, want only %s", passed, keepAliveRequest)
+	}
+
+	want := kh.Line([]string{"router"}, current.PublicKey()) + "\n" + kh.Line([]string{"router"}, added.PublicKey()) + "\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		buf, _ := ioutil.ReadFile(file)
+		if string(buf) == want {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("known_hosts is %q, want %q", buf, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseStrings(t *testing.T) {
+	strs, err := parseStrings(ssh.Marshal(struct{ A, B []byte }{[]byte("one"), []byte("")}))
+	if err != nil || len(strs) != 2 || string(strs[0]) != "one" || len(strs[1]) != 0 {
+		t.Errorf("parseStrings = %q, %v, want one and an empty string", strs, err)
+	}
+
+	for _, invalid := range [][]byte{{0, 0, 0}, {0, 0, 0, 4, 'a'}} {
+		if _, err := parseStrings(invalid); err == nil {
+			t.Errorf("parseStrings(%v) succeeded", invalid)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package rcom
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpHost is an intermediate host that the connection is tunneled
+// through with a direct-tcpip channel
+type jumpHost struct {
+	addr         string
+	clientConfig ssh.ClientConfig
+}
+
+// parseJumpHost splits a [user@]host[:port] jump host specification
+func parseJumpHost(spec string) (username, host string, port int, err error) {
+	host = spec
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		username, host = host[0:i], host[i+1:]
+	}
+
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host = h
+		port, err = strconv.Atoi(p)
+		if err != nil || port < 1 || 65535 < port {
+			return "", "", 0, fmt.Errorf("Invalid port in jump host %q", spec)
+		}
+	}
+
+	if host == "" {
+		return "", "", 0, fmt.Errorf("Invalid jump host %q", spec)
+	}
+	return username, host, port, nil
+}
+
+// jumpHosts resolves the jump hosts of the connection.  Each jump host
+// is looked up in ssh_config on its own and is authenticated with its
+// own identity files, followed by the auth methods of the connection
+func (conn *Connection) jumpHosts(homedir string) ([]jumpHost, error) {
+	config := conn.config
+	if config.proxyJump == "" || strings.EqualFold(config.proxyJump, "none") {
+		return nil, nil
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	var hops []jumpHost
+	for _, spec := range strings.Split(config.proxyJump, ",") {
+		username, host, port, err := parseJumpHost(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, err
+		}
+
+		var signers []ssh.Signer
+		hop := jumpHost{clientConfig: ssh.ClientConfig{
+			User:            username,
+			HostKeyCallback: conn.hostKeyCallback,
+			Timeout:         config.clientConfig.Timeout,
+		}}
+
+		if config.sshConfig {
+			h, err := config.lookupSSHConfig(host, username, homedir)
+			if err != nil {
+				return nil, err
+			}
+
+			if hop.clientConfig.User == "" {
+				hop.clientConfig.User = h.get("User")
+			}
+
+			if port == 0 && h.get("Port") != "" {
+				port, err = strconv.Atoi(h.get("Port"))
+				if err != nil {
+					return nil, fmt.Errorf("Invalid port %q for %s in ssh_config", h.get("Port"), host)
+				}
+			}
+
+			signers = config.loadIdentities(h.identityFiles(hop.clientConfig.User))
+			host = h.hostname()
+		}
+
+		if hop.clientConfig.User == "" {
+			hop.clientConfig.User = u.Username
+		}
+
+		if port == 0 {
+			port = 22
+		}
+
+		hop.clientConfig.Auth = config.authMethods(signers...)
+		hop.addr = net.JoinHostPort(host, strconv.Itoa(port))
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// dial connects to the remote host, through the jump hosts if there are
+// any.  The jump host connections are closed along with the returned
+// client
+func (conn *Connection) dial() (*ssh.Client, error) {
+	var clients []*ssh.Client
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+
+	hops := append(append([]jumpHost{}, conn.jumps...), jumpHost{addr: conn.addr, clientConfig: conn.config.clientConfig})
+	for i, hop := range hops {
+		var c net.Conn
+		var err error
+		if len(clients) == 0 {
+			Logger.Printf("Connecting to %s", hop.addr)
+			c, err = conn.config.dialTCP(hop.addr)
+		} else {
+			Logger.Printf("Connecting to %s through %s", hop.addr, clients[len(clients)-1].RemoteAddr())
+			c, err = clients[len(clients)-1].Dial("tcp", hop.addr)
+		}
+
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("Failed to connect to %s: %v", hop.addr, err)
+		}
+
+		var hostKey ssh.PublicKey
+		clientConfig := hop.clientConfig
+		last := i == len(hops)-1
+		if !last || len(conn.config.hostKeyFingerprints) == 0 {
+			clientConfig.HostKeyAlgorithms = conn.config.knownHostKeyAlgorithms(hop.addr, c.RemoteAddr())
+			clientConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				hostKey = key
+				return hop.clientConfig.HostKeyCallback(hostname, remote, key)
+			}
+		}
+
+		clientConn, chans, reqs, err := ssh.NewClientConn(c, hop.addr, &clientConfig)
+		if err != nil {
+			c.Close()
+			closeAll()
+			return nil, fmt.Errorf("Failed to connect to %s: %v", hop.addr, err)
+		}
+
+		if last && hostKey != nil && conn.config.updateHostKeys {
+			reqs = conn.config.hostKeysFilter(clientConn, hop.addr, hostKey, reqs)
+		}
+		clients = append(clients, ssh.NewClient(clientConn, chans, reqs))
+	}
+
+	client := clients[len(clients)-1]
+	go func() {
+		client.Wait()
+		closeAll()
+	}()
+	return client, nil
+}
@@ -2,13 +2,21 @@ package rcom
 
 import (
 	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"os"
 	"path/filepath"
 	"strings"
@@ -16,47 +24,188 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-type PrivateKey struct {
-	*rsa.PrivateKey
+// openssh-key-v1 private key format, see PROTOCOL.key in OpenSSH.  The
+// rounds and salt size are the defaults of ssh-keygen
+const (
+	openSSHMagic     = "openssh-key-v1\x00"
+	openSSHRounds    = 16
+	openSSHSaltSize  = 16
+	openSSHBlockSize = 8
+)
+
+// Key types that can be generated
+const (
+	RSAKey     = "rsa"
+	ECDSAKey   = "ecdsa"
+	Ed25519Key = "ed25519"
+)
+
+// PrivateKey is a generated private key
+type PrivateKey interface {
+	crypto.Signer
+
+	// PublicKey returns the ssh public key of the private key
+	PublicKey() (*PublicKey, error)
+
+	// MarshalOpenSSH encodes the key in the OpenSSH format, encrypted
+	// with the passphrase unless it is empty
+	MarshalOpenSSH(comment string, passphrase []byte) ([]byte, error)
+}
+
+// privateKey is a PrivateKey for the RSA, ECDSA and Ed25519 keys of the
+// crypto packages
+type privateKey struct {
+	crypto.Signer
+}
+
+// NewPrivateKey generates a key of the given type.  The size is the
+// number of bits of RSA keys, 2048 and up, or the curve size of ECDSA
+// keys, 256, 384 or 521.  Zero selects the default size for the type and
+// the size of Ed25519 keys is fixed
+func NewPrivateKey(keyType string, bitsize int) (PrivateKey, error) {
+	switch keyType {
+	case RSAKey:
+		if bitsize == 0 {
+			bitsize = 4096
+		} else if bitsize < 2048 {
+			return nil, fmt.Errorf("Invalid RSA key size %d: must be at least 2048", bitsize)
+		}
+
+		key, err := rsa.GenerateKey(rand.Reader, bitsize)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		return privateKey{key}, nil
+	case ECDSAKey:
+		var curve elliptic.Curve
+		switch bitsize {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Invalid ECDSA key size %d: must be 256, 384 or 521", bitsize)
+		}
+
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return privateKey{key}, nil
+	case Ed25519Key:
+		if bitsize != 0 && bitsize != 256 {
+			return nil, fmt.Errorf("Invalid Ed25519 key size %d: Ed25519 keys are 256 bits", bitsize)
+		}
+
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return privateKey{key}, nil
+	}
+	return nil, fmt.Errorf("Unknown key type %q: use %s, %s or %s", keyType, Ed25519Key, ECDSAKey, RSAKey)
 }
 
-func NewPrivateKey(bitsize int) (*PrivateKey, error) {
-	// Private Key generation
-	privateKey, err := rsa.GenerateKey(rand.Reader, bitsize)
+func (pk privateKey) PublicKey() (*PublicKey, error) {
+	publicKey, err := ssh.NewPublicKey(pk.Public())
 	if err != nil {
 		return nil, err
 	}
+	return &PublicKey{publicKey}, nil
+}
+
+func (pk privateKey) MarshalOpenSSH(comment string, passphrase []byte) ([]byte, error) {
+	return marshalOpenSSH(pk.Signer, comment, passphrase)
+}
 
-	// Validate Private Key
-	err = privateKey.Validate()
+func marshalOpenSSH(key crypto.Signer, comment string, passphrase []byte) ([]byte, error) {
+	pub, err := ssh.NewPublicKey(key.Public())
 	if err != nil {
 		return nil, err
 	}
 
-	return &PrivateKey{privateKey}, nil
-}
+	var fields []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return nil, fmt.Errorf("RSA keys with %d primes are not supported", len(k.Primes))
+		}
+		k.Precompute()
+		fields = ssh.Marshal(struct {
+			N, E, D, Iqmp, P, Q *big.Int
+		}{k.N, big.NewInt(int64(k.E)), k.D, k.Precomputed.Qinv, k.Primes[0], k.Primes[1]})
+	case *ecdsa.PrivateKey:
+		curve := strings.TrimPrefix(pub.Type(), "ecdsa-sha2-")
+		fields = ssh.Marshal(struct {
+			Curve string
+			Pub   []byte
+			D     *big.Int
+		}{curve, elliptic.Marshal(k.Curve, k.X, k.Y), k.D})
+	case ed25519.PrivateKey:
+		fields = ssh.Marshal(struct {
+			Pub, Priv []byte
+		}{k.Public().(ed25519.PublicKey), k})
+	default:
+		return nil, fmt.Errorf("Unsupported key type %T", key)
+	}
 
-func (pk *PrivateKey) MarshalPEM() ([]byte, error) {
-	// Get ASN.1 DER format
-	privDER := x509.MarshalPKCS1PrivateKey(pk.PrivateKey)
+	check := make([]byte, 4)
+	if _, err := rand.Read(check); err != nil {
+		return nil, err
+	}
+	checkint := binary.BigEndian.Uint32(check)
 
-	// pem.Block
-	privBlock := &pem.Block{
-		Type:    "RSA PRIVATE KEY",
-		Headers: nil,
-		Bytes:   privDER,
+	block := ssh.Marshal(struct {
+		Check1, Check2 uint32
+		Keytype        string
+		Fields         []byte `ssh:"rest"`
+	}{checkint, checkint, pub.Type(), fields})
+	block = append(block, ssh.Marshal(struct{ Comment string }{comment})...)
+
+	cipherName, kdfName, kdfOpts, blockSize := "none", "none", "", openSSHBlockSize
+	var salt []byte
+	if len(passphrase) > 0 {
+		cipherName, kdfName, blockSize = "aes256-ctr", "bcrypt", aes.BlockSize
+		salt = make([]byte, openSSHSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		kdfOpts = string(ssh.Marshal(struct {
+			Salt   string
+			Rounds uint32
+		}{string(salt), openSSHRounds}))
 	}
 
-	// Private key in PEM format
-	return pem.EncodeToMemory(privBlock), nil
-}
+	for i := 1; len(block)%blockSize != 0; i++ {
+		block = append(block, byte(i))
+	}
 
-func (pk *PrivateKey) PublicKey() (*PublicKey, error) {
-	publicKey, err := ssh.NewPublicKey(&pk.PrivateKey.PublicKey)
-	if err != nil {
-		return nil, err
+	if len(passphrase) > 0 {
+		k, err := bcryptPBKDF(passphrase, salt, openSSHRounds, 32+aes.BlockSize)
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := aes.NewCipher(k[:32])
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCTR(c, k[32:]).XORKeyStream(block, block)
 	}
-	return &PublicKey{publicKey}, nil
+
+	buf := append([]byte(openSSHMagic), ssh.Marshal(struct {
+		CipherName, KdfName, KdfOpts string
+		NumKeys                      uint32
+		PubKey, PrivKeyBlock         []byte
+	}{cipherName, kdfName, kdfOpts, 1, pub.Marshal(), block})...)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: buf}), nil
 }
 
 type PublicKey struct {
@@ -91,9 +240,13 @@ func (pk *PublicKey) MarshalBinary() ([]byte, error) {
 	return ssh.MarshalAuthorizedKey(pk.PublicKey), nil
 }
 
-func GenerateKey(bitsize int, keyfile string) error {
-	Logger.Printf("Generating new private key...")
-	privateKey, err := NewPrivateKey(bitsize)
+// GenerateKey writes a new key pair of the given type and size, see
+// NewPrivateKey, to keyfile and keyfile.pub.  The private key is written
+// in the OpenSSH format and is encrypted with the passphrase unless it is
+// empty
+func GenerateKey(keyType string, bitsize int, keyfile string, comment string, passphrase []byte) error {
+	Logger.Printf("Generating new %s private key...", keyType)
+	privateKey, err := NewPrivateKey(keyType, bitsize)
 	if err != nil {
 		Logger.Printf("failed: %v\n", err)
 		return err
@@ -114,13 +267,21 @@ func GenerateKey(bitsize int, keyfile string) error {
 		return err
 	}
 
-	b, _ := privateKey.MarshalPEM()
+	b, err := privateKey.MarshalOpenSSH(comment, passphrase)
+	if err != nil {
+		return err
+	}
+
 	err = ioutil.WriteFile(keyfile, b, 0600)
 	if err != nil {
 		return fmt.Errorf("Failed to write private key %s: %v", keyfile, err)
 	}
 
 	b, _ = publicKey.MarshalBinary()
+	if comment != "" {
+		b = append(bytes.TrimRight(b, "\n"), []byte(" "+comment+"\n")...)
+	}
+
 	err = ioutil.WriteFile(keyfile+".pub", b, 0600)
 	if err != nil {
 		return fmt.Errorf("Failed to write public key %s.pub: %v", keyfile, err)
@@ -128,21 +289,44 @@ func GenerateKey(bitsize int, keyfile string) error {
 	return nil
 }
 
-func AuthorizeKey(keyfile, authorizedKeys string) (err error) {
-	var pk PublicKey
-	// read the key
+// AuthorizeKey adds the public key in keyfile to the authorized_keys
+// file.  With a restriction the key can only run the rcom dispatcher for
+// the devices of the restriction, otherwise it has full access
+func AuthorizeKey(keyfile, authorizedKeys string, restriction *KeyRestriction) error {
+	pk, err := readPublicKey(keyfile)
+	if err != nil {
+		return err
+	}
+
+	line := []byte{}
+	if restriction != nil {
+		options, err := restriction.options(ssh.FingerprintSHA256(pk))
+		if err != nil {
+			return err
+		}
+		line = append([]byte(options), ' ')
+	}
+	return appendAuthorizedKey(authorizedKeys, append(line, ssh.MarshalAuthorizedKey(pk)...))
+}
+
+// readPublicKey reads the public key in keyfile, or keyfile.pub when
+// keyfile is a private key, or from stdin when keyfile is "-"
+func readPublicKey(keyfile string) (pk *PublicKey, err error) {
+	pk = &PublicKey{}
 	if keyfile == "-" {
 		// read from stdin
 		err = pk.Decode(os.Stdin)
 	} else {
 		var f *os.File
 		if f, err = os.Open(keyfile); err == nil {
+			defer f.Close()
 			err = pk.Decode(f)
 
 			if err != nil && !strings.HasSuffix(keyfile, ".pub") {
 				if _, err = os.Stat(keyfile + ".pub"); err == nil {
 					f, err = os.Open(keyfile + ".pub")
 					if err == nil {
+						defer f.Close()
 						err = pk.Decode(f)
 					}
 				} else {
@@ -151,19 +335,22 @@ func AuthorizeKey(keyfile, authorizedKeys string) (err error) {
 			}
 		}
 	}
+	return pk, err
+}
 
-	if err == nil {
-		var f *os.File
-		if err = os.MkdirAll(filepath.Dir(authorizedKeys), 0700); err == nil {
-			f, err = os.OpenFile(authorizedKeys, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-			if err == nil {
-				defer f.Close()
-				// TODO add forced command here
-				_, err = f.Write(ssh.MarshalAuthorizedKey(pk))
-			}
-		} else {
-			Logger.Printf("Failed to create %s: %v", filepath.Dir(authorizedKeys), err)
-		}
+// appendAuthorizedKey appends the line to the authorized_keys file
+func appendAuthorizedKey(authorizedKeys string, line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(authorizedKeys), 0700); err != nil {
+		Logger.Printf("Failed to create %s: %v", filepath.Dir(authorizedKeys), err)
+		return err
 	}
+
+	f, err := os.OpenFile(authorizedKeys, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(line)
 	return err
 }
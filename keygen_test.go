@@ -0,0 +1,164 @@
+package rcom
+
+import (
+	"bytes"
+	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMarshalOpenSSH(t *testing.T) {
+	tests := []struct {
+		keyType string
+		bitsize int
+	}{
+		{Ed25519Key, 0},
+		{ECDSAKey, 256},
+		{ECDSAKey, 384},
+		{ECDSAKey, 521},
+		{RSAKey, 2048},
+	}
+
+	for _, test := range tests {
+		key, err := NewPrivateKey(test.keyType, test.bitsize)
+		if err != nil {
+			t.Fatalf("NewPrivateKey(%s, %d): %v", test.keyType, test.bitsize, err)
+		}
+		signer := key.(privateKey).Signer
+		want, err := ssh.NewPublicKey(signer.Public())
+		if err != nil {
+			t.Fatalf("%s: %v", test.keyType, err)
+		}
+
+		for _, passphrase := range []string{"", "correct horse"} {
+			buf, err := marshalOpenSSH(signer, "user@host", []byte(passphrase))
+			if err != nil {
+				t.Errorf("%s %d passphrase %q: marshal failed: %v", test.keyType, test.bitsize, passphrase, err)
+				continue
+			}
+
+			var parsed interface{}
+			if passphrase == "" {
+				parsed, err = ssh.ParseRawPrivateKey(buf)
+			} else {
+				if _, err := ssh.ParseRawPrivateKey(buf); err == nil {
+					t.Errorf("%s %d: encrypted key parsed without a passphrase", test.keyType, test.bitsize)
+				} else if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+					t.Errorf("%s %d: expected a PassphraseMissingError without a passphrase, got %v", test.keyType, test.bitsize, err)
+				}
+
+				if _, err := ssh.ParseRawPrivateKeyWithPassphrase(buf, []byte("wrong")); err == nil {
+					t.Errorf("%s %d: encrypted key parsed with the wrong passphrase", test.keyType, test.bitsize)
+				}
+				parsed, err = ssh.ParseRawPrivateKeyWithPassphrase(buf, []byte(passphrase))
+			}
+
+			if err != nil {
+				t.Errorf("%s %d passphrase %q: parse failed: %v", test.keyType, test.bitsize, passphrase, err)
+				continue
+			}
+
+			got, err := ssh.NewPublicKey(parsed.(crypto.Signer).Public())
+			if err != nil {
+				t.Errorf("%s %d passphrase %q: %v", test.keyType, test.bitsize, passphrase, err)
+			} else if !bytes.Equal(got.Marshal(), want.Marshal()) {
+				t.Errorf("%s %d passphrase %q: parsed key %s, want %s", test.keyType, test.bitsize, passphrase, ssh.FingerprintSHA256(got), ssh.FingerprintSHA256(want))
+			}
+		}
+	}
+}
+
+func TestMarshalOpenSSHSigns(t *testing.T) {
+	key, err := NewPrivateKey(Ed25519Key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := key.MarshalOpenSSH("", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(buf, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("rcom")
+	sig, err := signer.Sign(nil, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := publicKey.Verify(data, sig); err != nil {
+		t.Errorf("Signature of the parsed key does not verify with the generated key: %v", err)
+	}
+}
+
+func TestNewPrivateKeyInvalid(t *testing.T) {
+	tests := []struct {
+		keyType string
+		bitsize int
+	}{
+		{RSAKey, 1024},
+		{ECDSAKey, 128},
+		{Ed25519Key, 512},
+		{"dsa", 0},
+	}
+
+	for _, test := range tests {
+		if _, err := NewPrivateKey(test.keyType, test.bitsize); err == nil {
+			t.Errorf("NewPrivateKey(%q, %d) expected an error", test.keyType, test.bitsize)
+		}
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyfile := filepath.Join(dir, "ssh", "id_ed25519_rcom")
+	if err := GenerateKey(Ed25519Key, 0, keyfile, "user@host", nil); err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	buf, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", keyfile, err)
+	}
+
+	buf, err = ioutil.ReadFile(keyfile + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, comment, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		t.Fatalf("Failed to parse %s.pub: %v", keyfile, err)
+	}
+
+	if !bytes.Equal(publicKey.Marshal(), signer.PublicKey().Marshal()) {
+		t.Errorf("%s.pub does not match the private key", keyfile)
+	}
+
+	if comment != "user@host" {
+		t.Errorf("Got comment %q, want %q", comment, "user@host")
+	}
+}
@@ -0,0 +1,595 @@
+package rcom
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	kh "golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// HostKeyChecking modes, as the StrictHostKeyChecking option of ssh.  A
+// key that does not match the known key of a host is refused in every
+// mode, unlike ssh the no mode does not connect to such hosts
+const (
+	// HostKeyCheckingYes refuses hosts that are not in known_hosts
+	HostKeyCheckingYes = "yes"
+
+	// HostKeyCheckingAcceptNew adds the keys of unknown hosts to
+	// known_hosts
+	HostKeyCheckingAcceptNew = "accept-new"
+
+	// HostKeyCheckingAsk shows the fingerprint of an unknown host key on
+	// the terminal and only adds it when the user confirms it
+	HostKeyCheckingAsk = "ask"
+
+	// HostKeyCheckingNo adds the keys of unknown hosts to known_hosts
+	HostKeyCheckingNo = "no"
+)
+
+// parseHostKeyChecking parses a StrictHostKeyChecking mode, including the
+// aliases that ssh_config allows
+func parseHostKeyChecking(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case HostKeyCheckingYes, "true":
+		return HostKeyCheckingYes, nil
+	case HostKeyCheckingAcceptNew:
+		return HostKeyCheckingAcceptNew, nil
+	case HostKeyCheckingAsk:
+		return HostKeyCheckingAsk, nil
+	case HostKeyCheckingNo, "off", "false":
+		return HostKeyCheckingNo, nil
+	}
+	return "", fmt.Errorf("Unknown host key checking mode %q: use yes, accept-new, ask or no", mode)
+}
+
+// defaultGlobalKnownHosts are the system wide known_hosts files of ssh
+var defaultGlobalKnownHosts = []string{"/etc/ssh/ssh_known_hosts", "/etc/ssh/ssh_known_hosts2"}
+
+// knownHostsFiles returns the known_hosts files to check, the user files
+// followed by the global files
+func (config *Config) knownHostsFiles() []string {
+	global := config.globalKnownHosts
+	if global == nil {
+		global = defaultGlobalKnownHosts
+	}
+	return append(append([]string{}, config.knownHosts...), global...)
+}
+
+// hostKeyAlgorithms are the host key algorithms of the ssh package, in
+// its order of preference
+var hostKeyAlgorithms = []string{
+	ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.KeyAlgoED25519,
+}
+
+// knownHostsDB holds the parsed known_hosts files
+type knownHostsDB struct {
+	callback ssh.HostKeyCallback
+
+	// names maps the copies of files with lines that could not be
+	// parsed back to the original file
+	names map[string]string
+
+	// authorities are the @cert-authority lines and the HostCA keys
+	authorities []knownHostsLine
+
+	// keys are the host key lines, without markers, revoked holds the
+	// @revoked keys
+	keys    []knownHostsLine
+	revoked map[string]bool
+}
+
+// knownHostsLine is a host key line of a known_hosts file
+type knownHostsLine struct {
+	file  string
+	line  int
+	hosts []string
+	key   ssh.PublicKey
+}
+
+// knownHostsDB loads the known_hosts files that exist.  Lines that can not
+// be parsed are skipped, rather than failing every host
+func (config *Config) knownHostsDB() (*knownHostsDB, error) {
+	var files []string
+	db := &knownHostsDB{names: make(map[string]string), revoked: make(map[string]bool)}
+	db.authorities = append(db.authorities, config.hostCAs...)
+	for _, file := range config.knownHostsFiles() {
+		buf, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %v", file, err)
+		}
+
+		clean, ok := db.scan(file, buf)
+		if ok {
+			files = append(files, file)
+			db.names[file] = file
+			continue
+		}
+
+		tmp, err := ioutil.TempFile("", "known_hosts")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+
+		_, err = tmp.Write(clean)
+		tmp.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, tmp.Name())
+		db.names[tmp.Name()] = file
+	}
+
+	var err error
+	db.callback, err = kh.New(files...)
+	if err != nil {
+		for tmp, file := range db.names {
+			err = fmt.Errorf("%s", strings.Replace(err.Error(), tmp, file, -1))
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+// scan collects the key, @cert-authority and @revoked lines of a
+// known_hosts file and blanks the lines that can not be parsed, keeping
+// the line numbers of the others.  It reports whether every line could be parsed
+func (db *knownHostsDB) scan(file string, buf []byte) ([]byte, bool) {
+	ok := true
+	var clean bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Bytes()
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts(line)
+
+		// a line without a key, such as a lone word, is skipped by
+		// ParseKnownHosts but refused by the knownhosts package
+		if trimmed := bytes.TrimSpace(line); err == io.EOF && len(trimmed) > 0 && trimmed[0] != '#' {
+			err = fmt.Errorf("missing key")
+		}
+
+		if err != nil && err != io.EOF {
+			Logger.Printf("Skipping %s line %d: %v", file, lineno, err)
+			line, ok = nil, false
+		} else if err == nil && marker == "cert-authority" {
+			db.authorities = append(db.authorities, knownHostsLine{file, lineno, hosts, key})
+		} else if err == nil && marker == "revoked" {
+			db.revoked[string(key.Marshal())] = true
+		} else if err == nil && marker == "" {
+			db.keys = append(db.keys, knownHostsLine{file, lineno, hosts, key})
+		}
+		clean.Write(line)
+		clean.WriteByte('\n')
+	}
+	return clean.Bytes(), ok && scanner.Err() == nil
+}
+
+// hasAuthority reports whether there is a certificate authority for the
+// host.  As with the keys, only the hostname is checked
+func (db *knownHostsDB) hasAuthority(hostname string) bool {
+	return db.isAuthority(hostname, nil)
+}
+
+// isAuthority reports whether key is a certificate authority for the
+// host, or whether there is any when key is nil
+func (db *knownHostsDB) isAuthority(hostname string, key ssh.PublicKey) bool {
+	name := kh.Normalize(hostname)
+	for _, line := range db.authorities {
+		if key != nil && !bytes.Equal(line.key.Marshal(), key.Marshal()) {
+			continue
+		}
+
+		if matchKnownHosts(line.hosts, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHostCertificate verifies the certificate of a host signed by one
+// of its authorities.  Like OpenSSH, the certificate must name the host
+// as a principal
+func (db *knownHostsDB) checkHostCertificate(hostname string, cert *ssh.Certificate) error {
+	name := hostname
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		name = host
+	}
+
+	if cert.CertType != ssh.HostCert {
+		return fmt.Errorf("Host key verification failed: %s presented a user certificate as host key", hostname)
+	}
+
+	for _, key := range []ssh.PublicKey{cert.Key, cert.SignatureKey} {
+		if db.revoked[string(key.Marshal())] {
+			return fmt.Errorf("Host key verification failed: the %s key %s of the certificate of %s is revoked", key.Type(), ssh.FingerprintSHA256(key), hostname)
+		}
+	}
+
+	if err := checkCertificate("of "+hostname, cert, time.Now()); err != nil {
+		return fmt.Errorf("Host key verification failed: %v", err)
+	}
+
+	if len(cert.ValidPrincipals) == 0 {
+		return fmt.Errorf("Host key verification failed: the certificate of %s (%s, serial %d) has no principals", hostname, cert.KeyId, cert.Serial)
+	}
+
+	found := false
+	for _, principal := range cert.ValidPrincipals {
+		found = found || principal == name
+	}
+
+	if !found {
+		return fmt.Errorf("Host key verification failed: the certificate of %s (%s, serial %d) is only valid for %q", hostname, cert.KeyId, cert.Serial, cert.ValidPrincipals)
+	}
+
+	checker := &ssh.CertChecker{}
+	if err := checker.CheckCert(name, cert); err != nil {
+		return fmt.Errorf("Host key verification failed: invalid certificate for %s: %v", hostname, err)
+	}
+	return nil
+}
+
+// hostKeys returns the key lines for the host
+func (db *knownHostsDB) hostKeys(hostname string) (lines []knownHostsLine) {
+	name := kh.Normalize(hostname)
+	for _, line := range db.keys {
+		if matchKnownHosts(line.hosts, name) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// hasKey reports whether key is one of the keys of the host.  The
+// knownhosts package only compares the first key of each type, which
+// refuses a host once a rotated key of the same type has been added
+func (db *knownHostsDB) hasKey(hostname string, key ssh.PublicKey) bool {
+	for _, line := range db.hostKeys(hostname) {
+		if bytes.Equal(line.key.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchKnownHosts reports whether the normalized name matches the hosts
+// of a known_hosts line, which are patterns or hashed names
+func matchKnownHosts(hosts []string, name string) bool {
+	var patterns []string
+	for _, host := range hosts {
+		if strings.HasPrefix(host, "|1|") {
+			if matchHashedHost(host, name) {
+				return true
+			}
+			continue
+		}
+		patterns = append(patterns, host)
+	}
+	return matchPatternList(patterns, name)
+}
+
+// matchHashedHost reports whether hashed, |1|salt|hash as written by
+// HashHostname, is the hash of name
+func matchHashedHost(hashed, name string) bool {
+	fields := strings.Split(hashed, "|")
+	if len(fields) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// knownHostKeyAlgorithms returns the host key algorithms to negotiate
+// with the host.  The server picks the first of these that it has, so
+// the types of the known keys of the host come first and certificates
+// are only negotiated when there is an authority for the host.  Without
+// this a host would be refused for offering a key of another type than
+// the one in known_hosts
+func (config *Config) knownHostKeyAlgorithms(hostname string, remote net.Addr) []string {
+	db, err := config.knownHostsDB()
+	if err != nil {
+		return nil
+	}
+
+	ca := db.hasAuthority(hostname)
+	known := make(map[string]bool)
+	for _, line := range db.hostKeys(hostname) {
+		known[line.key.Type()] = true
+	}
+	var certs, first, rest []string
+	for _, algo := range hostKeyAlgorithms {
+		switch {
+		case strings.Contains(algo, "-cert-"):
+			if ca {
+				certs = append(certs, algo)
+			}
+		case known[algo]:
+			first = append(first, algo)
+		default:
+			rest = append(rest, algo)
+		}
+	}
+	return append(append(certs, first...), rest...)
+}
+
+// hostKeyCallback verifies the host key against the known_hosts files.
+// Host certificates are verified when their authority is trusted for the
+// host, otherwise the certified key is checked.  Unknown hosts are
+// handled according to the host key checking mode, a host key that does
+// not match is always refused
+func (conn *Connection) hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	db, err := conn.config.knownHostsDB()
+	if err != nil {
+		return err
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if db.isAuthority(hostname, cert.SignatureKey) {
+			return db.checkHostCertificate(hostname, cert)
+		}
+
+		Logger.Printf("No trusted authority for the certificate of %s, checking its %s key instead", hostname, cert.Key.Type())
+		key = cert.Key
+	}
+
+	names := db.names
+	err = db.callback(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	switch e := err.(type) {
+	case *kh.RevokedError:
+		return fmt.Errorf("Host key verification failed: the %s key of %s is revoked at %s:%d", key.Type(), hostname, names[e.Revoked.Filename], e.Revoked.Line)
+	case *kh.KeyError:
+		if db.hasKey(hostname, key) {
+			return nil
+		}
+
+		if len(e.Want) > 0 {
+			var known []string
+			for _, want := range e.Want {
+				known = append(known, fmt.Sprintf("%s:%d (%s %s)", names[want.Filename], want.Line, want.Key.Type(), ssh.FingerprintSHA256(want.Key)))
+			}
+			return fmt.Errorf("Host key verification failed: the %s key of %s has changed to %s, known keys are at %s", key.Type(), hostname, ssh.FingerprintSHA256(key), strings.Join(known, ", "))
+		}
+
+		return conn.config.unknownHost(hostname, remote, key)
+	}
+	return err
+}
+
+// pinnedHostKey only accepts the keys with the fingerprints given to
+// HostKeyFingerprint.  For a host certificate the certified key may be
+// pinned as well
+func (config *Config) pinnedHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	keys := []ssh.PublicKey{key}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		keys = append(keys, cert.Key)
+	}
+
+	for _, k := range keys {
+		fingerprint := ssh.FingerprintSHA256(k)
+		for _, pinned := range config.hostKeyFingerprints {
+			if fingerprint == pinned {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Host key verification failed: the %s key of %s has fingerprint %s, which is not pinned", key.Type(), hostname, ssh.FingerprintSHA256(key))
+}
+
+// unknownHost handles a host that is not in known_hosts according to the
+// host key checking mode
+func (config *Config) unknownHost(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	switch config.hostKeyChecking {
+	case HostKeyCheckingAcceptNew, HostKeyCheckingNo:
+		return config.addKnownHost(hostname, key)
+	case HostKeyCheckingAsk:
+		if err := askHostKey(hostname, remote, key); err != nil {
+			return err
+		}
+		return config.addKnownHost(hostname, key)
+	}
+	return fmt.Errorf("Host key verification failed: %s is not in %s", hostname, strings.Join(config.knownHostsFiles(), ", "))
+}
+
+// askHostKey shows the fingerprint and randomart of the key on the
+// terminal and asks the user to confirm it
+func askHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("Host key verification failed: %s is not known and there is no terminal to confirm its key", hostname)
+	}
+	return confirmHostKey(os.Stdin, os.Stdout, hostname, remote, key)
+}
+
+// confirmHostKey shows the key on w and reads the answer of the user
+// from r
+func confirmHostKey(r io.Reader, w io.Writer, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	name, _ := keyAlgorithm(key)
+	fingerprint := ssh.FingerprintSHA256(key)
+	fmt.Fprintf(w, "The authenticity of host '%s (%s)' can't be established.\n", hostname, remote)
+	fmt.Fprintf(w, "%s key fingerprint is %s.\n%s", name, fingerprint, randomArt(key))
+
+	reader := bufio.NewReader(r)
+	for {
+		fmt.Fprintf(w, "Are you sure you want to continue connecting (yes/no/[fingerprint])? ")
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("Host key verification failed: %v", err)
+		}
+
+		switch answer = strings.TrimSpace(answer); {
+		case strings.EqualFold(answer, "yes"), answer == fingerprint:
+			return nil
+		case strings.EqualFold(answer, "no"):
+			return fmt.Errorf("Host key verification failed: the key of %s was not accepted", hostname)
+		case strings.HasPrefix(answer, "SHA256:"):
+			return fmt.Errorf("Host key verification failed: the key of %s does not match fingerprint %s", hostname, answer)
+		}
+	}
+}
+
+// keyAlgorithm returns the name and size of the key as shown by ssh
+func keyAlgorithm(key ssh.PublicKey) (string, int) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+
+	if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+		switch k := cryptoKey.CryptoPublicKey().(type) {
+		case *rsa.PublicKey:
+			return "RSA", k.N.BitLen()
+		case *ecdsa.PublicKey:
+			return "ECDSA", k.Curve.Params().BitSize
+		case *dsa.PublicKey:
+			return "DSA", k.P.BitLen()
+		case ed25519.PublicKey:
+			return "ED25519", 256
+		}
+	}
+	return strings.ToUpper(key.Type()), 0
+}
+
+// randomart dimensions and symbols, as in ssh-keygen
+const (
+	randomArtWidth   = 17
+	randomArtHeight  = 9
+	randomArtSymbols = " .o+=*BOX@%&#/^SE"
+)
+
+// randomArt draws the SHA256 fingerprint of the key as the random art
+// of ssh, the path of a bishop that moves diagonally for every two bits
+func randomArt(key ssh.PublicKey) string {
+	var field [randomArtWidth][randomArtHeight]int
+	end := len(randomArtSymbols) - 1
+	x, y := randomArtWidth/2, randomArtHeight/2
+
+	digest := sha256.Sum256(key.Marshal())
+	for _, input := range digest {
+		for b := 0; b < 4; b++ {
+			if input&1 != 0 && x < randomArtWidth-1 {
+				x++
+			} else if input&1 == 0 && x > 0 {
+				x--
+			}
+
+			if input&2 != 0 && y < randomArtHeight-1 {
+				y++
+			} else if input&2 == 0 && y > 0 {
+				y--
+			}
+
+			if field[x][y] < end-2 {
+				field[x][y]++
+			}
+			input >>= 2
+		}
+	}
+	field[randomArtWidth/2][randomArtHeight/2] = end - 1
+	field[x][y] = end
+
+	name, bits := keyAlgorithm(key)
+	title := fmt.Sprintf("[%s %d]", name, bits)
+	if len(title) > randomArtWidth {
+		title = fmt.Sprintf("[%s]", name)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(randomArtBorder(title))
+	for y := 0; y < randomArtHeight; y++ {
+		sb.WriteByte('|')
+		for x := 0; x < randomArtWidth; x++ {
+			sb.WriteByte(randomArtSymbols[field[x][y]])
+		}
+		sb.WriteString("|\n")
+	}
+	sb.WriteString(randomArtBorder("[SHA256]"))
+	return sb.String()
+}
+
+func randomArtBorder(title string) string {
+	left := (randomArtWidth - len(title)) / 2
+	right := randomArtWidth - len(title) - left
+	return "+" + strings.Repeat("-", left) + title + strings.Repeat("-", right) + "+\n"
+}
+
+// addKnownHost appends the key of hostname to the first user known_hosts
+// file
+func (config *Config) addKnownHost(hostname string, key ssh.PublicKey) error {
+	if len(config.knownHosts) == 0 {
+		return fmt.Errorf("Can not add %s: no known_hosts file to write to", hostname)
+	}
+
+	file := config.knownHosts[0]
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line := config.knownHostsEntry(hostname, key) + "\n"
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if r, err := os.Open(file); err == nil {
+			if _, err := r.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+				line = "\n" + line
+			}
+			r.Close()
+		}
+	}
+
+	Logger.Printf("Adding %s key of %s to %s", key.Type(), hostname, file)
+	_, err = f.WriteString(line)
+	return err
+}
+
+// knownHostsEntry returns the known_hosts line for the key of hostname,
+// with the hostname hashed when HashKnownHosts is set
+func (config *Config) knownHostsEntry(hostname string, key ssh.PublicKey) string {
+	host := kh.Normalize(hostname)
+	if config.hashKnownHosts {
+		host = kh.HashHostname(host)
+	}
+	return kh.Line([]string{host}, key)
+}
@@ -0,0 +1,460 @@
+package rcom
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	kh "golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	return signer
+}
+
+// writeKnownHosts writes the known_hosts files, given by name, to a new
+// temporary directory and returns it
+func writeKnownHosts(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+// knownHostsConnection returns a connection that checks host keys
+// against the known_hosts files in dir, without the global files
+func knownHostsConnection(dir string, files ...string) *Connection {
+	config := &Config{globalKnownHosts: []string{}}
+	for _, file := range files {
+		config.knownHosts = append(config.knownHosts, filepath.Join(dir, file))
+	}
+	return newConnection(config)
+}
+
+func TestKnownHosts(t *testing.T) {
+	router, rotated, other, revoked := newTestSigner(t).PublicKey(), newTestSigner(t).PublicKey(), newTestSigner(t).PublicKey(), newTestSigner(t).PublicKey()
+	line := func(hosts string, key ssh.PublicKey) string {
+		return kh.Line(strings.Split(hosts, ","), key) + "\n"
+	}
+
+	dir := writeKnownHosts(t, map[string]string{
+		"first": "# comment\n" +
+			line("switch", other) +
+			line("router", router) +
+			line("router", rotated),
+		"second": line("[console]:2222", router) +
+			line(kh.HashHostname("hashed"), router) +
+			"@revoked * " + string(ssh.MarshalAuthorizedKey(revoked)) +
+			line("revoked", revoked),
+		"broken": "not a known_hosts line\n" +
+			"garbage\n" +
+			"\n" +
+			line("broken", other),
+	})
+	defer os.RemoveAll(dir)
+	conn := knownHostsConnection(dir, "first", "second", "broken")
+
+	tests := []struct {
+		name    string
+		host    string
+		key     ssh.PublicKey
+		wantErr string
+	}{
+		{"first key of a host", "router:22", router, ""},
+		{"rotated key of the same type", "router:22", rotated, ""},
+		{"host in the second file", "console:2222", router, ""},
+		{"hashed host", "hashed:22", router, ""},
+		{"host after an unparsable line", "broken:22", other, ""},
+		{"changed key", "router:22", other, "known keys are at " + filepath.Join(dir, "first") + ":3 (ssh-ed25519"},
+		{"changed key of a host in the second file", "console:2222", other, filepath.Join(dir, "second") + ":1 ("},
+		{"changed key after an unparsable line", "broken:22", router, filepath.Join(dir, "broken") + ":4 ("},
+		{"wrong port", "console:22", router, "is not in"},
+		{"revoked key", "revoked:22", revoked, "is revoked at " + filepath.Join(dir, "second") + ":3"},
+		{"unknown host", "unknown:22", router, "unknown:22 is not in"},
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	for _, test := range tests {
+		err := conn.hostKeyCallback(test.host, remote, test.key)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.wantErr)
+		}
+
+		if err != nil && strings.Contains(err.Error(), os.TempDir()+string(filepath.Separator)+"known_hosts") {
+			t.Errorf("%s: error names the copy of a file: %v", test.name, err)
+		}
+	}
+}
+
+func TestKnownHostsScan(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+	valid := kh.Line([]string{"router"}, key)
+	authority := "@cert-authority *.example.com " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	content := strings.Join([]string{
+		"# comment",
+		"garbage",
+		valid,
+		authority,
+		"router ssh-ed25519 AAAAnotbase64",
+		valid,
+	}, "\n") + "\n"
+
+	db := &knownHostsDB{revoked: make(map[string]bool)}
+	clean, ok := db.scan("known_hosts", []byte(content))
+	if ok {
+		t.Errorf("scan reported every line as parsed")
+	}
+
+	// the unparsable lines are blanked so that the others keep their
+	// line numbers
+	want := []string{"# comment", "", valid, authority, "", valid, ""}
+	if got := strings.Split(string(clean), "\n"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("scan returned %q, want %q", got, want)
+	}
+
+	if len(db.keys) != 2 || db.keys[0].line != 3 || db.keys[1].line != 6 {
+		t.Errorf("scan found keys %+v, want lines 3 and 6", db.keys)
+	}
+
+	if len(db.authorities) != 1 || db.authorities[0].line != 4 || !db.hasAuthority("device.example.com:22") || db.hasAuthority("router:22") {
+		t.Errorf("scan found authorities %+v, want line 4 for *.example.com", db.authorities)
+	}
+
+	if _, ok := db.scan("known_hosts", []byte(valid+"\n")); !ok {
+		t.Errorf("scan reported a valid file as unparsable")
+	}
+}
+
+func TestUnknownHost(t *testing.T) {
+	known, changed, unknown := newTestSigner(t).PublicKey(), newTestSigner(t).PublicKey(), newTestSigner(t).PublicKey()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	for _, mode := range []string{HostKeyCheckingYes, HostKeyCheckingAcceptNew, HostKeyCheckingAsk, HostKeyCheckingNo} {
+		// ask would prompt on the terminal the tests run on
+		if mode == HostKeyCheckingAsk && terminal.IsTerminal(int(os.Stdin.Fd())) {
+			continue
+		}
+
+		dir := writeKnownHosts(t, map[string]string{"known_hosts": kh.Line([]string{"router"}, known) + "\n"})
+		defer os.RemoveAll(dir)
+		conn := knownHostsConnection(dir, "known_hosts")
+		conn.config.hostKeyChecking = mode
+
+		// a changed key is refused in every mode
+		if err := conn.hostKeyCallback("router:22", remote, changed); err == nil || !strings.Contains(err.Error(), "has changed") {
+			t.Errorf("%s: changed key gave %v, want it refused", mode, err)
+		}
+
+		// without a terminal to ask on, only accept-new and no add the
+		// unknown host
+		err := conn.hostKeyCallback("switch:22", remote, unknown)
+		added := mode == HostKeyCheckingAcceptNew || mode == HostKeyCheckingNo
+		if added && err != nil {
+			t.Errorf("%s: unknown host refused: %v", mode, err)
+		} else if !added && err == nil {
+			t.Errorf("%s: unknown host accepted", mode)
+		}
+
+		buf, _ := ioutil.ReadFile(filepath.Join(dir, "known_hosts"))
+		want := kh.Line([]string{"router"}, known) + "\n"
+		if added {
+			want += kh.Line([]string{"switch"}, unknown) + "\n"
+		}
+
+		if string(buf) != want {
+			t.Errorf("%s: known_hosts is %q, want %q", mode, buf, want)
+		}
+
+		// the added key is known from now on, the changed key still is not
+		if added {
+			if err := conn.hostKeyCallback("switch:22", remote, unknown); err != nil {
+				t.Errorf("%s: added key refused: %v", mode, err)
+			}
+
+			if err := conn.hostKeyCallback("switch:22", remote, changed); err == nil {
+				t.Errorf("%s: key of an added host changed without error", mode)
+			}
+		}
+	}
+}
+
+func TestConfirmHostKey(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+	fingerprint := ssh.FingerprintSHA256(key)
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	tests := []struct {
+		answers string
+		wantErr bool
+	}{
+		{"yes\n", false},
+		{"YES\n", false},
+		{fingerprint + "\n", false},
+		{"no\n", true},
+		{"SHA256:other\n", true},
+		{"maybe\n\nyes\n", false},
+		{"maybe\n", true},
+	}
+
+	for _, test := range tests {
+		var out strings.Builder
+		err := confirmHostKey(strings.NewReader(test.answers), &out, "router:22", remote, key)
+		if test.wantErr && err == nil {
+			t.Errorf("answers %q accepted the key", test.answers)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("answers %q refused the key: %v", test.answers, err)
+		}
+
+		if !strings.Contains(out.String(), "ED25519 key fingerprint is "+fingerprint) {
+			t.Errorf("The fingerprint was not shown: %q", out.String())
+		}
+	}
+}
+
+func TestAddKnownHost(t *testing.T) {
+	dir := writeKnownHosts(t, map[string]string{"known_hosts": "# no newline"})
+	defer os.RemoveAll(dir)
+
+	key := newTestSigner(t).PublicKey()
+	file := filepath.Join(dir, "known_hosts")
+	created := filepath.Join(dir, "new", "known_hosts")
+	tests := []struct {
+		file   string
+		hash   bool
+		host   string
+		prefix string
+	}{
+		{file, false, "router:22", "# no newline\nrouter "},
+		{file, true, "hashed:22", "|1|"},
+		{file, false, "console:2222", "[console]:2222 "},
+		{created, true, "[2001:db8::1]:22", "|1|"},
+	}
+
+	for _, test := range tests {
+		config := &Config{knownHosts: []string{test.file}, globalKnownHosts: []string{}, hashKnownHosts: test.hash}
+		before, _ := ioutil.ReadFile(test.file)
+		if err := config.addKnownHost(test.host, key); err != nil {
+			t.Fatalf("addKnownHost(%s) failed: %v", test.host, err)
+		}
+
+		buf, err := ioutil.ReadFile(test.file)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", test.file, err)
+		}
+
+		added := strings.TrimPrefix(string(buf), strings.TrimSuffix(string(before), "# no newline"))
+		if !strings.HasPrefix(added, test.prefix) || !strings.HasSuffix(added, "\n") {
+			t.Errorf("addKnownHost(%s) added %q, want a line starting with %q", test.host, added, test.prefix)
+		}
+
+		host, _, _ := net.SplitHostPort(test.host)
+		if test.hash && strings.Contains(added, host) {
+			t.Errorf("addKnownHost(%s) did not hash the host: %q", test.host, added)
+		}
+
+		// hashed entries are found again by the host key check
+		conn := newConnection(config)
+		if err := conn.hostKeyCallback(test.host, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}, key); err != nil {
+			t.Errorf("Added key of %s refused: %v", test.host, err)
+		}
+	}
+
+	if info, err := os.Stat(created); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("%s was not created with mode 0600: %v", created, err)
+	}
+
+	if err := (&Config{}).addKnownHost("router:22", key); err == nil {
+		t.Errorf("addKnownHost succeeded without a known_hosts file")
+	}
+}
+
+func TestHostKeyFingerprint(t *testing.T) {
+	key, other := newTestSigner(t).PublicKey(), newTestSigner(t).PublicKey()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	config := &Config{}
+	fingerprint := ssh.FingerprintSHA256(key)
+	if err := HostKeyFingerprint(fingerprint + "=")(config); err != nil {
+		t.Fatalf("HostKeyFingerprint(%s) failed: %v", fingerprint, err)
+	}
+
+	if err := config.pinnedHostKey("router:22", remote, key); err != nil {
+		t.Errorf("Pinned key refused: %v", err)
+	}
+
+	if err := config.pinnedHostKey("router:22", remote, other); err == nil || !strings.Contains(err.Error(), "not pinned") {
+		t.Errorf("Other key gave %v, want it refused", err)
+	}
+
+	for _, invalid := range []string{"", "MD5:" + fingerprint[7:], "SHA256:short", strings.TrimPrefix(fingerprint, "SHA256:")} {
+		if err := HostKeyFingerprint(invalid)(&Config{}); err == nil {
+			t.Errorf("HostKeyFingerprint(%q) was accepted", invalid)
+		}
+	}
+}
+
+func TestHostKeyFingerprintSkipsKnownHosts(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	// known_hosts has another key for the server, which would be
+	// refused as changed if it were checked
+	changed := kh.Line([]string{"127.0.0.1"}, newTestSigner(t).PublicKey()) + "\n"
+	dir := writeKnownHosts(t, map[string]string{"known_hosts": changed})
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "known_hosts")
+
+	conn, err := server.dial(t, KeepAlive(0), KnownHosts(file), GlobalKnownHosts(), StrictHostKeyChecking(HostKeyCheckingAcceptNew))
+	if err != nil {
+		t.Fatalf("Connecting with the pinned key failed: %v", err)
+	}
+	conn.Close()
+
+	if buf, _ := ioutil.ReadFile(file); string(buf) != changed {
+		t.Errorf("known_hosts was changed to %q", buf)
+	}
+
+	// another pinned key is refused even though known_hosts is not
+	// checked and unknown hosts would be accepted
+	unpin := func(config *Config) error {
+		config.hostKeyFingerprints = nil
+		return nil
+	}
+	pinned := HostKeyFingerprint(ssh.FingerprintSHA256(newTestSigner(t).PublicKey()))
+	_, err = server.dial(t, KeepAlive(0), KnownHosts(file), GlobalKnownHosts(), StrictHostKeyChecking(HostKeyCheckingAcceptNew), unpin, pinned)
+	if err == nil || !strings.Contains(err.Error(), "not pinned") {
+		t.Errorf("Connecting with another pinned key gave %v, want it refused", err)
+	}
+
+	if buf, _ := ioutil.ReadFile(file); string(buf) != changed {
+		t.Errorf("known_hosts was changed to %q by a refused key", buf)
+	}
+}
+
+func TestHostCertificate(t *testing.T) {
+	ca, otherCA, hostKey := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	authority := func(pattern string, key ssh.Signer) string {
+		return "@cert-authority " + pattern + " " + string(ssh.MarshalAuthorizedKey(key.PublicKey()))
+	}
+
+	dir := writeKnownHosts(t, map[string]string{
+		"known_hosts": authority("*.example.com", ca) +
+			authority("*.revoked.example.com", otherCA) +
+			"@revoked * " + string(ssh.MarshalAuthorizedKey(otherCA.PublicKey())),
+	})
+	defer os.RemoveAll(dir)
+	conn := knownHostsConnection(dir, "known_hosts")
+
+	now := uint64(time.Now().Unix())
+	sign := func(signer ssh.Signer, certType uint32, principals []string, validAfter, validBefore uint64) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             hostKey.PublicKey(),
+			CertType:        certType,
+			KeyId:           "router",
+			ValidPrincipals: principals,
+			ValidAfter:      validAfter,
+			ValidBefore:     validBefore,
+		}
+
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatalf("Failed to sign certificate: %v", err)
+		}
+		return cert
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		cert    *ssh.Certificate
+		wantErr string
+	}{
+		{"valid", "router.example.com:22", sign(ca, ssh.HostCert, []string{"router.example.com"}, now-60, now+3600), ""},
+		{"valid for ever", "router.example.com:22", sign(ca, ssh.HostCert, []string{"switch.example.com", "router.example.com"}, 0, ssh.CertTimeInfinity), ""},
+		{"other principal", "router.example.com:22", sign(ca, ssh.HostCert, []string{"switch.example.com"}, 0, ssh.CertTimeInfinity), "is only valid for"},
+		{"no principals", "router.example.com:22", sign(ca, ssh.HostCert, nil, 0, ssh.CertTimeInfinity), "has no principals"},
+		{"expired", "router.example.com:22", sign(ca, ssh.HostCert, []string{"router.example.com"}, now-3600, now-60), "expired"},
+		{"not yet valid", "router.example.com:22", sign(ca, ssh.HostCert, []string{"router.example.com"}, now+3600, ssh.CertTimeInfinity), "not valid before"},
+		{"user certificate", "router.example.com:22", sign(ca, ssh.UserCert, []string{"router.example.com"}, 0, ssh.CertTimeInfinity), "user certificate"},
+		{"revoked CA", "router.revoked.example.com:22", sign(otherCA, ssh.HostCert, []string{"router.revoked.example.com"}, 0, ssh.CertTimeInfinity), "is revoked"},
+		{"CA of other hosts", "router.example.org:22", sign(ca, ssh.HostCert, []string{"router.example.org"}, 0, ssh.CertTimeInfinity), "router.example.org:22 is not in"},
+		{"CA not trusted for the host", "router.example.com:22", sign(otherCA, ssh.HostCert, []string{"router.example.com"}, 0, ssh.CertTimeInfinity), "has changed"},
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	for _, test := range tests {
+		err := conn.hostKeyCallback(test.host, remote, test.cert)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.wantErr)
+		}
+	}
+
+	// a certificate whose authority is not trusted falls back to the
+	// certified key
+	known := writeKnownHosts(t, map[string]string{"known_hosts": kh.Line([]string{"router.example.org"}, hostKey.PublicKey()) + "\n"})
+	defer os.RemoveAll(known)
+	cert := sign(ca, ssh.HostCert, []string{"router.example.org"}, 0, ssh.CertTimeInfinity)
+	if err := knownHostsConnection(known, "known_hosts").hostKeyCallback("router.example.org:22", remote, cert); err != nil {
+		t.Errorf("Known key of an untrusted certificate refused: %v", err)
+	}
+}
+
+func TestHostCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestSigner(t)
+	file := filepath.Join(dir, "ca.pub")
+	ioutil.WriteFile(file, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0644)
+
+	config := &Config{globalKnownHosts: []string{}}
+	if err := HostCA(file, "*.example.com")(config); err != nil {
+		t.Fatalf("HostCA failed: %v", err)
+	}
+
+	db, err := config.knownHostsDB()
+	if err != nil {
+		t.Fatalf("knownHostsDB failed: %v", err)
+	}
+
+	if !db.isAuthority("router.example.com:22", ca.PublicKey()) || db.isAuthority("router.example.org:22", ca.PublicKey()) {
+		t.Errorf("HostCA is not trusted for exactly *.example.com")
+	}
+
+	if err := HostCA(filepath.Join(dir, "missing.pub"))(config); err == nil {
+		t.Errorf("HostCA accepted a missing file")
+	}
+}
@@ -0,0 +1,425 @@
+package rcom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxBreak is the longest BREAK that fits in a break frame
+const maxBreak = 65535 * time.Millisecond
+
+// endpoint is a local end of a link, such as a pty, a serial device or
+// an RFC 2217 client connection
+type endpoint interface {
+	io.ReadWriteCloser
+
+	// SetSettings applies line settings received from the peer
+	SetSettings(*Settings) error
+
+	// SetModemLines applies the state of the lines in mask received from
+	// the peer.  Endpoints drive the output lines they are able to and
+	// report the input lines to their users
+	SetModemLines(lines, mask ModemLines) error
+
+	// SendBreak asserts a BREAK for the given duration.  A zero duration
+	// reports a BREAK that was received by the peer
+	SendBreak(duration time.Duration) error
+
+	// watch starts reporting line events of the endpoint
+	watch(events lineEvents)
+}
+
+// frameWriter sends the frames of a link to its peer
+type frameWriter interface {
+	writeFrame(ft frameType, payload []byte) error
+}
+
+// frameStream writes frames directly to a byte stream such as the
+// stdin of an ssh session
+type frameStream struct {
+	io.Writer
+}
+
+func (fs frameStream) writeFrame(ft frameType, payload []byte) error {
+	return writeFrame(fs.Writer, ft, payload)
+}
+
+// lineEvents receives the line events of an endpoint
+type lineEvents interface {
+	sendSettings(*Settings)
+	sendModemLines(lines, mask ModemLines)
+	sendBreak(duration time.Duration) error
+}
+
+// link connects the local endpoints of a device to its peer on the
+// other end of the ssh session.  Data and line events from the
+// endpoints are framed and written to the peer, frames received from
+// the peer are applied to every endpoint
+type link struct {
+	name   string
+	notify func(Event)
+
+	wmu sync.Mutex
+	w   frameWriter
+
+	// persistent links survive the loss of their peer.  Frames sent
+	// while the peer is disconnected are held in pending, up to
+	// bufferLimit bytes, until the link is connected again
+	persistent  bool
+	bufferLimit int
+	pending     []bufferedFrame
+	pendingSize int
+
+	mu        sync.Mutex
+	endpoints []endpoint
+
+	// lines is the last known state of the modem lines on the peer
+	lines ModemLines
+
+	// settings are the last known line settings of the peer device
+	settings Settings
+
+	// readOnly links refuse the data, settings, modem lines and breaks
+	// sent by the peer.  The first refusal of each kind of frame is
+	// reported to refusals, which the server sets to its stderr so
+	// the client sees it
+	readOnly bool
+	refusals io.Writer
+	refused  map[frameType]bool
+}
+
+type bufferedFrame struct {
+	ft      frameType
+	payload []byte
+}
+
+func newLink(name string, w frameWriter, notify func(Event)) *link {
+	return &link{name: name, w: w, notify: notify}
+}
+
+// connect sends the buffered frames to the new peer and then makes it
+// the destination of the link
+func (l *link) connect(w frameWriter) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	for len(l.pending) > 0 {
+		f := l.pending[0]
+		if err := w.writeFrame(f.ft, f.payload); err != nil {
+			return err
+		}
+		l.pending = l.pending[1:]
+		l.pendingSize -= len(f.payload)
+	}
+
+	Logger.Printf("%s: connected", l.name)
+	l.w = w
+	return nil
+}
+
+// disconnect starts buffering the frames sent by the endpoints and
+// reports DCD as dropped until the link is connected again
+func (l *link) disconnect() {
+	l.wmu.Lock()
+	l.w = nil
+	l.wmu.Unlock()
+
+	Logger.Printf("%s: disconnected", l.name)
+	l.setModemLines(0, LineDCD)
+}
+
+// buffer holds a frame until the link is connected, frames that do not
+// fit within the buffer limit are dropped
+func (l *link) buffer(ft frameType, payload []byte) {
+	if l.pendingSize+len(payload) > l.bufferLimit {
+		Logger.Printf("%s: buffer full, dropping %d byte %v frame", l.name, len(payload), ft)
+		return
+	}
+
+	l.pending = append(l.pending, bufferedFrame{ft, append([]byte{}, payload...)})
+	l.pendingSize += len(payload)
+}
+
+// add attaches the endpoint to the link and copies its data to the peer
+// until the endpoint fails.  The endpoint is removed when add returns
+func (l *link) add(e endpoint) error {
+	l.mu.Lock()
+	l.endpoints = append(l.endpoints, e)
+	lines := l.lines
+	settings := l.settings
+	l.mu.Unlock()
+
+	e.watch(l)
+	if lines&InputLines != 0 {
+		e.SetModemLines(lines, InputLines)
+	}
+
+	if settings != (Settings{}) {
+		e.SetSettings(&settings)
+	}
+
+	err := l.copyOut(e)
+	l.remove(e)
+	return err
+}
+
+func (l *link) remove(e endpoint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, endpoint := range l.endpoints {
+		if endpoint == e {
+			l.endpoints = append(l.endpoints[0:i], l.endpoints[i+1:]...)
+			break
+		}
+	}
+}
+
+func (l *link) each(cb func(endpoint)) {
+	l.mu.Lock()
+	endpoints := append([]endpoint{}, l.endpoints...)
+	l.mu.Unlock()
+
+	for _, e := range endpoints {
+		cb(e)
+	}
+}
+
+// Close closes every endpoint of the link
+func (l *link) Close() error {
+	l.each(func(e endpoint) { e.Close() })
+	return nil
+}
+
+func (l *link) send(ft frameType, payload []byte) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	if l.w == nil {
+		if !l.persistent {
+			return io.ErrClosedPipe
+		}
+		l.buffer(ft, payload)
+		return nil
+	}
+
+	err := l.w.writeFrame(ft, payload)
+	if err != nil && l.persistent {
+		Logger.Printf("%s: lost peer: %v", l.name, err)
+		l.w = nil
+		l.buffer(ft, payload)
+		err = nil
+	}
+	return err
+}
+
+func (l *link) sendSettings(settings *Settings) {
+	Logger.Printf("%s: sending settings %v", l.name, settings)
+	if err := l.send(settingsFrame, []byte(settings.String())); err != nil {
+		Logger.Printf("%s: failed to send settings: %v", l.name, err)
+	}
+
+	l.mu.Lock()
+	l.settings.merge(settings)
+	l.mu.Unlock()
+}
+
+func (l *link) sendModemLines(lines, mask ModemLines) {
+	Logger.Printf("%s: sending modem lines %v (mask %v)", l.name, lines&mask, mask)
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:2], uint16(lines))
+	binary.BigEndian.PutUint16(payload[2:4], uint16(mask))
+	if err := l.send(modemFrame, payload); err != nil {
+		Logger.Printf("%s: failed to send modem lines: %v", l.name, err)
+	}
+
+	if mask &= OutputLines; mask != 0 {
+		l.mu.Lock()
+		l.lines = l.lines&^mask | lines&mask
+		l.mu.Unlock()
+	}
+}
+
+// SetModemLines asks the peer to change the output lines given in mask
+func (l *link) SetModemLines(lines, mask ModemLines) error {
+	mask &= OutputLines
+	if mask == 0 {
+		return fmt.Errorf("Only the DTR and RTS lines can be changed")
+	}
+	l.sendModemLines(lines, mask)
+	return nil
+}
+
+// ModemLines returns the last known state of the modem lines on the peer
+func (l *link) ModemLines() ModemLines {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lines
+}
+
+func (l *link) receiveModemLines(payload []byte) {
+	if len(payload) != 4 {
+		Logger.Printf("%s: invalid modem frame of %d bytes", l.name, len(payload))
+		return
+	}
+	lines := ModemLines(binary.BigEndian.Uint16(payload[0:2]))
+	mask := ModemLines(binary.BigEndian.Uint16(payload[2:4]))
+
+	Logger.Printf("%s: received modem lines %v (mask %v)", l.name, lines&mask, mask)
+	l.setModemLines(lines, mask)
+}
+
+// setModemLines applies the state of the peer modem lines in mask to
+// the endpoints
+func (l *link) setModemLines(lines, mask ModemLines) {
+	l.each(func(e endpoint) {
+		if err := e.SetModemLines(lines, mask); err != nil {
+			Logger.Printf("%s: failed to set modem lines: %v", l.name, err)
+		}
+	})
+
+	if mask &= InputLines; mask != 0 {
+		l.mu.Lock()
+		l.lines = l.lines&^mask | lines&mask
+		current := l.lines
+		l.mu.Unlock()
+
+		Logger.Printf("%s: peer modem lines %v", l.name, current)
+		if l.notify != nil {
+			l.notify(Event{Device: l.name, Type: ModemEvent, Lines: current})
+		}
+	}
+}
+
+func (l *link) sendBreak(duration time.Duration) error {
+	Logger.Printf("%s: sending break %v", l.name, duration)
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(duration/time.Millisecond))
+	err := l.send(breakFrame, payload)
+	if err != nil {
+		Logger.Printf("%s: failed to send break: %v", l.name, err)
+	}
+	return err
+}
+
+// SendBreak asks the peer to assert a BREAK for the given duration
+func (l *link) SendBreak(duration time.Duration) error {
+	if duration < time.Millisecond || maxBreak < duration {
+		return fmt.Errorf("Invalid break duration %v: valid durations are 1ms-%v", duration, maxBreak)
+	}
+	return l.sendBreak(duration)
+}
+
+func (l *link) receiveBreak(payload []byte) {
+	if len(payload) != 2 {
+		Logger.Printf("%s: invalid break frame of %d bytes", l.name, len(payload))
+		return
+	}
+
+	duration := time.Duration(binary.BigEndian.Uint16(payload)) * time.Millisecond
+	if duration == 0 {
+		Logger.Printf("%s: peer received BREAK", l.name)
+		if l.notify != nil {
+			l.notify(Event{Device: l.name, Type: BreakEvent})
+		}
+	} else {
+		Logger.Printf("%s: sending BREAK for %v", l.name, duration)
+	}
+
+	l.each(func(e endpoint) {
+		if err := e.SendBreak(duration); err != nil {
+			Logger.Printf("%s: failed to send BREAK: %v", l.name, err)
+		}
+	})
+}
+
+// copyOut copies data read from the endpoint to the peer until either
+// side fails
+func (l *link) copyOut(e endpoint) error {
+	buf := make([]byte, maxFramePayload)
+	for {
+		n, err := e.Read(buf)
+		if n > 0 {
+			if err := l.send(dataFrame, buf[0:n]); err != nil {
+				return err
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyIn reads frames from the peer and applies them to the endpoints
+// until the reader is exhausted
+func (l *link) copyIn(r io.Reader) error {
+	buf := make([]byte, maxFramePayload)
+	for {
+		ft, payload, err := readFrame(r, buf)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		}
+		l.receive(ft, payload)
+	}
+}
+
+// refuse reports a frame that the peer sent to a read-only link, once
+// for every kind of frame
+func (l *link) refuse(ft frameType) {
+	Logger.Printf("%s: read-only, refusing %v", l.name, ft)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.refusals == nil || l.refused[ft] {
+		return
+	}
+
+	if l.refused == nil {
+		l.refused = make(map[frameType]bool)
+	}
+	l.refused[ft] = true
+	fmt.Fprintf(l.refusals, "%s is read-only, the %v frames sent to it are refused\n", l.name, ft)
+}
+
+// receive applies a frame received from the peer to the endpoints
+func (l *link) receive(ft frameType, payload []byte) {
+	if l.readOnly {
+		l.refuse(ft)
+		return
+	}
+
+	switch ft {
+	case dataFrame:
+		l.each(func(e endpoint) {
+			if _, err := e.Write(payload); err != nil {
+				Logger.Printf("%s: write failed: %v", l.name, err)
+			}
+		})
+	case settingsFrame:
+		settings, err := ParseSettings(string(payload))
+		if err != nil {
+			Logger.Printf("%s: invalid settings %q: %v", l.name, string(payload), err)
+			break
+		}
+
+		Logger.Printf("%s: applying settings %v", l.name, settings)
+		l.mu.Lock()
+		l.settings.merge(settings)
+		l.mu.Unlock()
+
+		l.each(func(e endpoint) {
+			if err := e.SetSettings(settings); err != nil {
+				Logger.Printf("%s: failed to apply settings %v: %v", l.name, settings, err)
+			}
+		})
+	case modemFrame:
+		l.receiveModemLines(payload)
+	case breakFrame:
+		l.receiveBreak(payload)
+	default:
+		Logger.Printf("%s: ignoring unknown %v", l.name, ft)
+	}
+}
@@ -0,0 +1,36 @@
+package rcom
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLinkReadOnly(t *testing.T) {
+	var refusals bytes.Buffer
+	e := newTestEndpoint()
+	l := newLink("/dev/ttyS0", nil, nil)
+	l.readOnly = true
+	l.refusals = &refusals
+	l.endpoints = append(l.endpoints, e)
+
+	l.receive(dataFrame, []byte("reboot\r"))
+	l.receive(dataFrame, []byte("reboot\r"))
+	l.receive(settingsFrame, []byte("9600,8,N,1"))
+	l.receive(modemFrame, []byte{byte(LineDTR), byte(LineDTR)})
+	l.receive(breakFrame, []byte{0, 250})
+	expectNothing(t, "read-only link", e)
+	if len(e.settings) > 0 || len(e.lines) > 0 || len(e.breaks) > 0 {
+		t.Errorf("A read-only link applied settings, modem lines or a BREAK")
+	}
+
+	want := []string{
+		"/dev/ttyS0 is read-only, the data frames sent to it are refused",
+		"/dev/ttyS0 is read-only, the settings frames sent to it are refused",
+		"/dev/ttyS0 is read-only, the modem frames sent to it are refused",
+		"/dev/ttyS0 is read-only, the break frames sent to it are refused",
+	}
+	if got := strings.Split(strings.TrimSpace(refusals.String()), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Refusals reported:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
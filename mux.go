@@ -0,0 +1,234 @@
+package rcom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// muxWindow is the number of data bytes a stream may have in flight
+// before the receiver returns credit with a window frame
+const muxWindow = 4 * maxFramePayload
+
+// muxHeaderSize is the size of the stream id preceding every frame
+const muxHeaderSize = 2
+
+// mux carries the frames of many links over a single byte stream.
+// Every frame is prefixed with the big endian id of its stream.  The
+// streams take turns writing one frame at a time and data is limited by
+// a per stream window so that a busy device can not starve the others
+type mux struct {
+	w io.Writer
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	streams map[uint16]*muxStream
+	ready   []*muxStream
+	err     error
+}
+
+type muxStream struct {
+	id uint16
+	m  *mux
+	l  *link
+
+	// credit is the number of data bytes that may still be sent
+	credit int
+
+	// out holds encoded frames waiting for their turn and queued is set
+	// while the stream is in the ready list of the mux
+	out    [][]byte
+	queued bool
+
+	// in holds frames received from the peer that have not yet been
+	// applied to the link
+	in []muxFrame
+}
+
+type muxFrame struct {
+	ft      frameType
+	payload []byte
+}
+
+func newMux(w io.Writer) *mux {
+	m := &mux{w: w, streams: make(map[uint16]*muxStream)}
+	m.cond = sync.NewCond(&m.mu)
+	go m.writeLoop()
+	return m
+}
+
+// attach carries the link on the stream id
+func (m *mux) attach(id uint16, l *link) error {
+	s, err := m.open(id, l)
+	if err != nil {
+		return err
+	}
+	return l.connect(s)
+}
+
+// open adds a stream that delivers the frames it receives to the link,
+// the link is not connected to the stream
+func (m *mux) open(id uint16, l *link) (*muxStream, error) {
+	m.mu.Lock()
+	if _, found := m.streams[id]; found {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("Stream %d is already in use", id)
+	}
+
+	s := &muxStream{id: id, m: m, l: l, credit: muxWindow}
+	m.streams[id] = s
+	m.mu.Unlock()
+
+	go s.deliver()
+	return s, nil
+}
+
+// close fails every stream of the mux with err
+func (m *mux) close(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = err
+	}
+	m.cond.Broadcast()
+}
+
+// writeLoop writes the queued frames, one frame per stream in turn,
+// until the mux is closed
+func (m *mux) writeLoop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		for len(m.ready) == 0 && m.err == nil {
+			m.cond.Wait()
+		}
+
+		if m.err != nil {
+			return
+		}
+
+		s := m.ready[0]
+		m.ready = m.ready[1:]
+		frame := s.out[0]
+		s.out = s.out[1:]
+		if len(s.out) > 0 {
+			m.ready = append(m.ready, s)
+		} else {
+			s.queued = false
+		}
+
+		m.mu.Unlock()
+		_, err := m.w.Write(frame)
+		m.mu.Lock()
+		if err != nil && m.err == nil {
+			Logger.Printf("Multiplexed write failed: %v", err)
+			m.err = err
+			m.cond.Broadcast()
+		}
+	}
+}
+
+// run reads frames from r and queues them on their streams until r is
+// exhausted.  The mux is closed when run returns
+func (m *mux) run(r io.Reader) error {
+	header := make([]byte, muxHeaderSize)
+	buf := make([]byte, maxFramePayload)
+	for {
+		_, err := io.ReadFull(r, header)
+		var ft frameType
+		var payload []byte
+		if err == nil {
+			ft, payload, err = readFrame(r, buf)
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				m.close(io.ErrClosedPipe)
+				return nil
+			}
+			m.close(err)
+			return err
+		}
+
+		id := binary.BigEndian.Uint16(header)
+		m.mu.Lock()
+		s := m.streams[id]
+		switch {
+		case s == nil:
+			Logger.Printf("Ignoring %v for unknown stream %d", ft, id)
+		case ft == windowFrame:
+			if len(payload) == 4 {
+				s.credit += int(binary.BigEndian.Uint32(payload))
+			} else {
+				Logger.Printf("%s: invalid window frame of %d bytes", s.l.name, len(payload))
+			}
+		default:
+			s.in = append(s.in, muxFrame{ft, append([]byte{}, payload...)})
+		}
+		m.cond.Broadcast()
+		m.mu.Unlock()
+	}
+}
+
+// writeFrame queues a frame for the peer.  Data frames wait until the
+// stream has enough credit
+func (s *muxStream) writeFrame(ft frameType, payload []byte) error {
+	frame := &bytes.Buffer{}
+	binary.Write(frame, binary.BigEndian, s.id)
+	if err := writeFrame(frame, ft, payload); err != nil {
+		return err
+	}
+
+	m := s.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ft == dataFrame {
+		for s.credit < len(payload) && m.err == nil {
+			m.cond.Wait()
+		}
+		s.credit -= len(payload)
+	}
+
+	if m.err != nil {
+		return m.err
+	}
+
+	s.out = append(s.out, frame.Bytes())
+	if !s.queued {
+		s.queued = true
+		m.ready = append(m.ready, s)
+	}
+	m.cond.Broadcast()
+	return nil
+}
+
+// deliver applies the received frames to the link of the stream and
+// returns credit for the data once it has been written to the endpoints
+func (s *muxStream) deliver() {
+	m := s.m
+	m.mu.Lock()
+	for {
+		for len(s.in) == 0 && m.err == nil {
+			m.cond.Wait()
+		}
+
+		if len(s.in) == 0 {
+			m.mu.Unlock()
+			return
+		}
+
+		f := s.in[0]
+		s.in = s.in[1:]
+		m.mu.Unlock()
+
+		s.l.receive(f.ft, f.payload)
+		if f.ft == dataFrame {
+			credit := make([]byte, 4)
+			binary.BigEndian.PutUint32(credit, uint32(len(f.payload)))
+			s.writeFrame(windowFrame, credit)
+		}
+		m.mu.Lock()
+	}
+}
@@ -0,0 +1,320 @@
+package rcom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testEndpoint is an endpoint whose data is fed by the test and whose
+// writes, settings, modem lines and breaks are recorded on channels
+type testEndpoint struct {
+	in   *io.PipeReader
+	feed *io.PipeWriter
+
+	written  chan []byte
+	settings chan *Settings
+	lines    chan ModemLines
+	breaks   chan time.Duration
+}
+
+func newTestEndpoint() *testEndpoint {
+	r, w := io.Pipe()
+	return &testEndpoint{
+		in:       r,
+		feed:     w,
+		written:  make(chan []byte, 64),
+		settings: make(chan *Settings, 64),
+		lines:    make(chan ModemLines, 64),
+		breaks:   make(chan time.Duration, 64),
+	}
+}
+
+func (e *testEndpoint) Read(p []byte) (int, error) { return e.in.Read(p) }
+
+func (e *testEndpoint) Write(p []byte) (int, error) {
+	e.written <- append([]byte{}, p...)
+	return len(p), nil
+}
+
+func (e *testEndpoint) Close() error { return e.feed.Close() }
+
+func (e *testEndpoint) SetSettings(settings *Settings) error {
+	e.settings <- settings
+	return nil
+}
+
+func (e *testEndpoint) SetModemLines(lines, mask ModemLines) error {
+	e.lines <- lines & mask
+	return nil
+}
+
+func (e *testEndpoint) SendBreak(duration time.Duration) error {
+	e.breaks <- duration
+	return nil
+}
+
+func (e *testEndpoint) watch(events lineEvents) {}
+
+// expectWritten waits for the endpoint to be written want
+func expectWritten(t *testing.T, name string, e *testEndpoint, want []byte) {
+	t.Helper()
+	var got []byte
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case p := <-e.written:
+			got = append(got, p...)
+		case <-timeout:
+			t.Fatalf("%s: timed out after receiving %q, want %q", name, got, want)
+		}
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s: received %q, want %q", name, got, want)
+	}
+}
+
+// expectNothing checks that nothing is written to the endpoint for a
+// short while
+func expectNothing(t *testing.T, name string, e *testEndpoint) {
+	t.Helper()
+	select {
+	case p := <-e.written:
+		t.Fatalf("%s: unexpectedly received %q", name, p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// muxPair returns two muxes that carry the same streams over a net.Pipe
+// and the endpoints of the streams on each side
+func muxPair(t *testing.T, streams int) (client, server *mux, clientEnds, serverEnds []*testEndpoint, closeClient func()) {
+	c, s := net.Pipe()
+	client, server = newMux(c), newMux(s)
+	for i := 0; i < streams; i++ {
+		for _, side := range []struct {
+			m    *mux
+			ends *[]*testEndpoint
+		}{{client, &clientEnds}, {server, &serverEnds}} {
+			l := newLink("stream", nil, nil)
+			if err := side.m.attach(uint16(i), l); err != nil {
+				t.Fatalf("attach(%d) failed: %v", i, err)
+			}
+
+			e := newTestEndpoint()
+			*side.ends = append(*side.ends, e)
+			go l.add(e)
+		}
+	}
+
+	go client.run(c)
+	go server.run(s)
+	return client, server, clientEnds, serverEnds, func() { c.Close() }
+}
+
+func TestMuxStreams(t *testing.T) {
+	_, _, clientEnds, serverEnds, closeClient := muxPair(t, 2)
+	defer closeClient()
+
+	clientEnds[0].feed.Write([]byte("zero"))
+	expectWritten(t, "stream 0", serverEnds[0], []byte("zero"))
+	expectNothing(t, "stream 1", serverEnds[1])
+
+	serverEnds[1].feed.Write([]byte("one"))
+	expectWritten(t, "stream 1", clientEnds[1], []byte("one"))
+	expectNothing(t, "stream 0", clientEnds[0])
+
+	// more than a window of data only flows if credit is returned
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*muxWindow/16)
+	go clientEnds[1].feed.Write(data)
+	expectWritten(t, "stream 1 bulk", serverEnds[1], data)
+}
+
+func TestMuxConnectBuffered(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := newMux(s)
+	l := newLink("stream", nil, nil)
+	if err := server.attach(0, l); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	e := newTestEndpoint()
+	go l.add(e)
+	go server.run(s)
+
+	// more than a window of data buffered while the link was disconnected
+	client := newLink("stream", nil, nil)
+	client.bufferLimit = 2 * muxWindow
+	data := bytes.Repeat([]byte("0123456789abcdef"), 2*muxWindow/16)
+	for i := 0; i < len(data); i += maxFramePayload {
+		client.buffer(dataFrame, data[i:i+maxFramePayload])
+	}
+
+	a := &attachment{links: []*link{client}, mux: true}
+	connected := make(chan error, 1)
+	go func() {
+		_, err := a.connect(c, c)
+		connected <- err
+	}()
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Fatalf("connect failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connect with %d bytes buffered did not return", len(data))
+	}
+	expectWritten(t, "stream 0", e, data)
+}
+
+func TestMuxAttachTwice(t *testing.T) {
+	m := newMux(&bytes.Buffer{})
+	defer m.close(io.ErrClosedPipe)
+	if err := m.attach(7, newLink("a", nil, nil)); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	if err := m.attach(7, newLink("b", nil, nil)); err == nil {
+		t.Errorf("attaching stream 7 twice succeeded")
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	c, s := net.Pipe()
+	m := newMux(c)
+	if err := m.attach(0, newLink("stream", nil, nil)); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- m.run(c) }()
+	s.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run at the end of the stream = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run did not return when the peer closed")
+	}
+
+	if err := m.streams[0].writeFrame(dataFrame, []byte("late")); err == nil {
+		t.Errorf("writeFrame on a closed mux succeeded")
+	}
+}
+
+func TestMuxTruncatedFrame(t *testing.T) {
+	m := newMux(&bytes.Buffer{})
+	input := []byte{0, 0, byte(dataFrame), 0, 9, 'a'}
+	if err := m.run(bytes.NewReader(input)); err != io.ErrUnexpectedEOF {
+		t.Errorf("run of a truncated frame = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// rawFrames reads the multiplexed frames written to r
+func rawFrames(r io.Reader) <-chan muxFrame {
+	frames := make(chan muxFrame, 64)
+	go func() {
+		defer close(frames)
+		header := make([]byte, muxHeaderSize)
+		buf := make([]byte, maxFramePayload)
+		for {
+			if _, err := io.ReadFull(r, header); err != nil {
+				return
+			}
+
+			ft, payload, err := readFrame(r, buf)
+			if err != nil {
+				return
+			}
+			frames <- muxFrame{ft, append([]byte{}, payload...)}
+		}
+	}()
+	return frames
+}
+
+func TestMuxWindow(t *testing.T) {
+	out, peer := net.Pipe()
+	defer out.Close()
+	frames := rawFrames(peer)
+
+	m := newMux(out)
+	for i := uint16(0); i < 2; i++ {
+		if err := m.attach(i, newLink("stream", nil, nil)); err != nil {
+			t.Fatalf("attach failed: %v", err)
+		}
+	}
+
+	payload := make([]byte, maxFramePayload)
+	sent := make(chan int, 64)
+	go func() {
+		for i := 0; ; i++ {
+			if err := m.streams[0].writeFrame(dataFrame, payload); err != nil {
+				return
+			}
+			sent <- i
+		}
+	}()
+
+	want := muxWindow / maxFramePayload
+	for i := 0; i < want; i++ {
+		select {
+		case f := <-frames:
+			if f.ft != dataFrame {
+				t.Fatalf("received %v, want data", f.ft)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d frames were sent within the window", i, want)
+		}
+	}
+
+	select {
+	case f := <-frames:
+		t.Fatalf("received %v of %d bytes with the window exhausted", f.ft, len(f.payload))
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a stream without credit does not hold up the others
+	if err := m.streams[1].writeFrame(dataFrame, []byte("other")); err != nil {
+		t.Fatalf("writeFrame on stream 1 failed: %v", err)
+	}
+
+	select {
+	case f := <-frames:
+		if string(f.payload) != "other" {
+			t.Fatalf("received %q, want the data of stream 1", f.payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream 1 was blocked by the exhausted window of stream 0")
+	}
+
+	// returning credit for one frame lets one more through
+	credit := make([]byte, muxHeaderSize+frameHeaderSize+4)
+	credit[muxHeaderSize] = byte(windowFrame)
+	binary.BigEndian.PutUint16(credit[muxHeaderSize+1:], 4)
+	binary.BigEndian.PutUint32(credit[muxHeaderSize+frameHeaderSize:], maxFramePayload)
+	in, feed := io.Pipe()
+	defer feed.Close()
+	go m.run(in)
+	go feed.Write(credit)
+
+	select {
+	case f := <-frames:
+		if f.ft != dataFrame || len(f.payload) != maxFramePayload {
+			t.Fatalf("received %v of %d bytes, want a full data frame", f.ft, len(f.payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no data was sent after credit was returned")
+	}
+
+	select {
+	case f := <-frames:
+		t.Fatalf("received %v of %d bytes beyond the returned credit", f.ft, len(f.payload))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
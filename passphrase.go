@@ -0,0 +1,143 @@
+package rcom
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// maxPassphraseAttempts is the number of times a passphrase is asked for
+// before giving up on a key
+const maxPassphraseAttempts = 3
+
+// PassphraseFunc returns the passphrase of the encrypted private key file
+type PassphraseFunc func(file string) ([]byte, error)
+
+// Passphrase sets how the passphrases of encrypted identity files are
+// obtained, DefaultPassphrase is used when it is not given
+func Passphrase(fn PassphraseFunc) ConfigOption {
+	return func(config *Config) error {
+		config.passphrase = fn
+		return nil
+	}
+}
+
+// DefaultPassphrase reads the passphrase of file from RCOM_PASSPHRASE when
+// it is set, otherwise the user is prompted on the terminal or, without a
+// terminal, through the askpass helper in RCOM_ASKPASS or SSH_ASKPASS
+func DefaultPassphrase(file string) ([]byte, error) {
+	if passphrase, found := os.LookupEnv("RCOM_PASSPHRASE"); found {
+		return []byte(passphrase), nil
+	}
+
+	prompt := fmt.Sprintf("Enter passphrase for key '%s': ", file)
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return ReadPassphrase(prompt)
+	}
+
+	askpass := os.Getenv("RCOM_ASKPASS")
+	if askpass == "" {
+		askpass = os.Getenv("SSH_ASKPASS")
+	}
+
+	if askpass == "" {
+		return nil, fmt.Errorf("No passphrase for %s: set RCOM_PASSPHRASE or SSH_ASKPASS when there is no terminal", file)
+	}
+
+	Logger.Printf("Asking %s for the passphrase of %s", askpass, file)
+	out, err := exec.Command(askpass, prompt).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Askpass helper %s failed: %v", askpass, err)
+	}
+	return bytes.TrimRight(out, "\r\n"), nil
+}
+
+// ReadPassphrase prompts for a passphrase on the terminal without echoing
+// it
+func ReadPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprintf(os.Stdout, "%s", prompt)
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintf(os.Stdout, "\n")
+	return passphrase, err
+}
+
+// encryptedSigner is an identity whose private key is only decrypted, and
+// its passphrase asked for, the first time the server accepts the key
+type encryptedSigner struct {
+	file       string
+	key        []byte
+	pub        ssh.PublicKey
+	passphrase PassphraseFunc
+	attempts   int
+
+	mu     sync.Mutex
+	signer ssh.Signer
+}
+
+// newEncryptedSigner returns the identity for the encrypted key read from
+// file, the passphrase is asked for up to attempts times.  Keys in the
+// legacy PEM format do not include the public key, it is read from
+// file.pub or the key is decrypted right away
+func newEncryptedSigner(file string, key []byte, pub ssh.PublicKey, passphrase PassphraseFunc, attempts int) (*encryptedSigner, error) {
+	s := &encryptedSigner{file: file, key: key, pub: pub, passphrase: passphrase, attempts: attempts}
+	if s.pub == nil {
+		if buf, err := ioutil.ReadFile(file + ".pub"); err == nil {
+			s.pub, _, _, _, err = ssh.ParseAuthorizedKey(buf)
+			if err != nil {
+				Logger.Printf("Failed to parse public key %s.pub: %v", file, err)
+			}
+		}
+	}
+
+	if s.pub == nil {
+		if err := s.decrypt(); err != nil {
+			return nil, err
+		}
+		s.pub = s.signer.PublicKey()
+	}
+	return s, nil
+}
+
+func (s *encryptedSigner) decrypt() (err error) {
+	for i := 0; i < s.attempts; i++ {
+		var passphrase []byte
+		passphrase, err = s.passphrase(s.file)
+		if err != nil {
+			return err
+		}
+
+		s.signer, err = ssh.ParsePrivateKeyWithPassphrase(s.key, passphrase)
+		if err != x509.IncorrectPasswordError {
+			break
+		}
+		Logger.Printf("Incorrect passphrase for %s", s.file)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt private key %s: %v", s.file, err)
+	}
+	return nil
+}
+
+func (s *encryptedSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *encryptedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signer == nil {
+		if err := s.decrypt(); err != nil {
+			return nil, err
+		}
+	}
+	return s.signer.Sign(rand, data)
+}
@@ -0,0 +1,71 @@
+package rcom
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedSignerAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyfile := filepath.Join(dir, "id_ed25519")
+	if err := GenerateKey(Ed25519Key, 0, keyfile, "test", []byte("right")); err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	wrong, right := "wrong", "right"
+	tests := []struct {
+		name     string
+		env      *string
+		answers  []string
+		wantErr  bool
+		attempts int
+	}{
+		{"prompted until right", nil, []string{"wrong", "wrong", "right"}, false, 3},
+		{"prompted too often", nil, []string{"wrong", "wrong", "wrong", "right"}, true, 3},
+		{"RCOM_PASSPHRASE", &right, nil, false, 1},
+		{"wrong RCOM_PASSPHRASE", &wrong, nil, true, 1},
+	}
+
+	for _, test := range tests {
+		restore := setenv("RCOM_PASSPHRASE", test.env)
+		config := &Config{}
+		asked := 0
+		if test.answers != nil {
+			Passphrase(func(string) ([]byte, error) {
+				asked++
+				return []byte(test.answers[asked-1]), nil
+			})(config)
+		}
+
+		signer, err := config.loadIdentity(keyfile)
+		if err != nil {
+			restore()
+			t.Errorf("%s: loadIdentity failed: %v", test.name, err)
+			continue
+		}
+
+		if got := signer.(*encryptedSigner).attempts; got != test.attempts {
+			t.Errorf("%s: %d attempts, want %d", test.name, got, test.attempts)
+		}
+
+		_, err = signer.Sign(rand.Reader, []byte("data"))
+		restore()
+		if test.wantErr && err == nil {
+			t.Errorf("%s: signed with a wrong passphrase", test.name)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("%s: Sign failed: %v", test.name, err)
+		}
+
+		if test.answers != nil && asked != test.attempts {
+			t.Errorf("%s: asked %d times, want %d", test.name, asked, test.attempts)
+		}
+	}
+}
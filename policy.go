@@ -0,0 +1,377 @@
+package rcom
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultPolicyFile is the device access policy of rcom server, every
+// device may be served when it does not exist
+const DefaultPolicyFile = "/etc/rcom/policy.yaml"
+
+// AccessMode is the access to a device granted by a Policy
+type AccessMode int
+
+// Access modes, from the least to the most permissive
+const (
+	NoAccess AccessMode = iota
+	ReadOnly
+	ReadWrite
+)
+
+func (mode AccessMode) String() string {
+	switch mode {
+	case ReadOnly:
+		return "ro"
+	case ReadWrite:
+		return "rw"
+	}
+	return "none"
+}
+
+// policyRule grants access to the devices matching pattern
+type policyRule struct {
+	pattern string
+	mode    AccessMode
+}
+
+// Policy maps users and key fingerprints to the devices they may serve.
+// The policy file is a YAML mapping of users and of keys, with the
+// SHA256 fingerprints as shown by ssh-keygen -l, to device paths or glob
+// patterns and their mode, ro, rw or none.  The user "*" applies to
+// everyone and none denies a device whatever the other rules grant:
+//
+//	users:
+//	  alice:
+//	    /dev/ttyUSB*: rw
+//	    /dev/ttyUSB9: none
+//	  "*":
+//	    /dev/ttyACM0: ro
+//	keys:
+//	  "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s":
+//	    /dev/ttyUSB0: rw
+//
+// Only this block style subset of YAML is supported
+type Policy struct {
+	file  string
+	users map[string][]policyRule
+	keys  map[string][]policyRule
+}
+
+// LoadPolicy reads the policy file
+func LoadPolicy(file string) (*Policy, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read policy %s: %v", file, err)
+	}
+	return parsePolicy(file, buf)
+}
+
+// LoadDefaultPolicy reads DefaultPolicyFile.  There is no policy only
+// when the file does not exist, a policy that can not be read is an
+// error rather than leaving every device open
+func LoadDefaultPolicy() (*Policy, error) {
+	return loadOptionalPolicy(DefaultPolicyFile)
+}
+
+// loadOptionalPolicy reads the policy file, nil when it does not exist
+func loadOptionalPolicy(file string) (*Policy, error) {
+	buf, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read policy %s: %v", file, err)
+	}
+	return parsePolicy(file, buf)
+}
+
+// parsePolicy parses the users and keys sections of a policy file
+func parsePolicy(file string, buf []byte) (*Policy, error) {
+	policy := &Policy{file: file, users: make(map[string][]policyRule), keys: make(map[string][]policyRule)}
+
+	var section map[string][]policyRule
+	var name string
+	var indents []int
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := stripYAMLComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		trimmed := strings.TrimLeft(line, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("%s:%d: tabs can not be used for indentation", file, lineno)
+		}
+
+		indent := len(line) - len(trimmed)
+		for len(indents) > 0 && indent <= indents[len(indents)-1] {
+			if indent < indents[len(indents)-1] && (len(indents) == 1 || indent > indents[len(indents)-2]) {
+				return nil, fmt.Errorf("%s:%d: inconsistent indentation", file, lineno)
+			}
+			indents = indents[:len(indents)-1]
+		}
+		indents = append(indents, indent)
+
+		key, value, err := parseYAMLPair(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, lineno, err)
+		}
+
+		switch len(indents) {
+		case 1:
+			if value != "" {
+				return nil, fmt.Errorf("%s:%d: expected users: or keys:", file, lineno)
+			}
+
+			switch key {
+			case "users":
+				section = policy.users
+			case "keys":
+				section = policy.keys
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown section %q, expected users or keys", file, lineno, key)
+			}
+		case 2:
+			if value != "" {
+				return nil, fmt.Errorf("%s:%d: expected the devices of %s on the following lines", file, lineno, key)
+			}
+
+			if section == nil {
+				return nil, fmt.Errorf("%s:%d: %s is not in the users or keys section", file, lineno, key)
+			}
+
+			name = key
+			if _, found := section[name]; !found {
+				section[name] = nil
+			}
+		case 3:
+			var mode AccessMode
+			switch strings.ToLower(value) {
+			case "ro", "read-only":
+				mode = ReadOnly
+			case "rw", "read-write":
+				mode = ReadWrite
+			case "none", "deny":
+				mode = NoAccess
+			default:
+				return nil, fmt.Errorf("%s:%d: invalid mode %q for %s, expected ro, rw or none", file, lineno, value, key)
+			}
+
+			if !strings.HasPrefix(key, "/") {
+				return nil, fmt.Errorf("%s:%d: invalid device %q, expected an absolute path", file, lineno, key)
+			}
+			section[name] = append(section[name], policyRule{key, mode})
+		default:
+			return nil, fmt.Errorf("%s:%d: unexpected indentation", file, lineno)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", file, err)
+	}
+	return policy, nil
+}
+
+// stripYAMLComment removes a # comment that is outside of quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseYAMLPair parses a key: value line, either of which may be quoted
+func parseYAMLPair(line string) (key, value string, err error) {
+	line = strings.TrimSpace(line)
+	rest := line
+	if strings.HasPrefix(line, `"`) || strings.HasPrefix(line, "'") {
+		end := strings.IndexByte(line[1:], line[0])
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated quote in %q", line)
+		}
+		key, rest = line[1:end+1], strings.TrimLeft(line[end+2:], " ")
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("expected key: value, got %q", line)
+		}
+		rest = rest[1:]
+	} else {
+		i := strings.Index(line, ": ")
+		if i < 0 && strings.HasSuffix(line, ":") {
+			i = len(line) - 1
+		}
+
+		if i < 0 {
+			return "", "", fmt.Errorf("expected key: value, got %q", line)
+		}
+		key, rest = line[:i], line[i+1:]
+	}
+
+	value = strings.TrimSpace(rest)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return key, value, nil
+}
+
+// Access returns the access to device granted to the user or the key,
+// the most permissive of the rules that match unless one of them denies
+// the device.  A device that is a symbolic link, or is in a directory
+// reached through one, is granted by the rules for the path it resolves
+// to, so that a link can not reach a device the policy does not grant.
+// The target wins: rules for the link itself only deny it, with none
+func (policy *Policy) Access(username, key, device string) AccessMode {
+	var rules []policyRule
+	rules = append(rules, policy.users["*"]...)
+	if username != "" {
+		rules = append(rules, policy.users[username]...)
+	}
+
+	if key != "" {
+		rules = append(rules, policy.keys[key]...)
+	}
+
+	if !filepath.IsAbs(device) || filepath.Clean(device) != device {
+		return NoAccess
+	}
+
+	target := resolveDevice(device)
+	if target != device && deniedBy(rules, device) {
+		return NoAccess
+	}
+	return ruleAccess(rules, target)
+}
+
+// ruleAccess returns the access that the rules grant to device
+func ruleAccess(rules []policyRule, device string) AccessMode {
+	if deniedBy(rules, device) {
+		return NoAccess
+	}
+
+	mode := NoAccess
+	for _, rule := range rules {
+		if matchDevice([]string{rule.pattern}, device) && rule.mode > mode {
+			mode = rule.mode
+		}
+	}
+	return mode
+}
+
+// deniedBy reports whether one of the rules for device is none
+func deniedBy(rules []policyRule, device string) bool {
+	for _, rule := range rules {
+		if rule.mode == NoAccess && matchDevice([]string{rule.pattern}, device) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveDevice returns the path that device resolves to, following the
+// symbolic links of the device and of its directories.  A device that
+// does not exist yet resolves within the directory it is created in
+func resolveDevice(device string) string {
+	if target, err := filepath.EvalSymlinks(device); err == nil {
+		return target
+	}
+
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(device)); err == nil {
+		return filepath.Join(dir, filepath.Base(device))
+	}
+	return device
+}
+
+// PolicyIdentity returns the user and key fingerprint that the access
+// policy applies to.  They are given by the forced command of
+// authorized_keys, otherwise the user is the account the server runs as
+// and there is no key.  The environment is never trusted: clients can
+// set variables with SendEnv and a login with a shell can set any of
+// them, including SSH_USER_AUTH, so key rules only apply to keys whose
+// forced command gives -key
+func PolicyIdentity(username, key string) (string, string) {
+	if username == "" {
+		if u, err := user.Current(); err == nil {
+			username = u.Username
+		}
+	}
+	return username, key
+}
+
+// ServerOption configures the rcom server
+type ServerOption func(*serverConfig) error
+
+// serverConfig is the access policy of the rcom server
+type serverConfig struct {
+	policy   *Policy
+	username string
+	key      string
+}
+
+// AccessPolicy only serves the devices that the policy grants to the
+// user or key
+func AccessPolicy(policy *Policy, username, key string) ServerOption {
+	return func(config *serverConfig) error {
+		config.policy = policy
+		config.username = username
+		config.key = key
+		return nil
+	}
+}
+
+func newServerConfig(options []ServerOption) (*serverConfig, error) {
+	config := &serverConfig{}
+	for _, option := range options {
+		if err := option(config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// access checks the access to device, write is set when the device is
+// to be changed rather than only used.  It reports whether the device is
+// read-only
+func (config *serverConfig) access(device string, write bool) (bool, error) {
+	if config.policy == nil {
+		return false, nil
+	}
+
+	who := "user " + config.username
+	if config.key != "" {
+		who = fmt.Sprintf("%s with key %s", who, config.key)
+	}
+
+	switch mode := config.policy.Access(config.username, config.key, device); {
+	case mode == NoAccess:
+		return false, fmt.Errorf("Access to %s denied: %s does not grant it to %s", device, config.policy.file, who)
+	case mode == ReadOnly && write:
+		return false, fmt.Errorf("Access to %s denied: %s only grants read-only access to %s, read-only devices can not be created, forced, sent a BREAK or given settings", device, config.policy.file, who)
+	case mode == ReadOnly:
+		Logger.Printf("Serving %s read-only to %s", device, who)
+		return true, nil
+	}
+	return false, nil
+}
+
+// changesDevice reports whether serving device changes it, rather than
+// only opening it.  A device that does not exist is created as a pty
+func changesDevice(device string, force bool, settings *Settings) bool {
+	_, err := os.Stat(device)
+	return force || settings != nil || err != nil
+}
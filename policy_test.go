@@ -0,0 +1,450 @@
+package rcom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestStripYAMLComment(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"", ""},
+		{"# comment", ""},
+		{"users: # comment", "users: "},
+		{"users:\t# comment", "users:\t"},
+		{"  /dev/ttyS0: rw # comment", "  /dev/ttyS0: rw "},
+		{"  /dev/tty#0: rw", "  /dev/tty#0: rw"},
+		{`  "/dev/tty #0": rw # comment`, `  "/dev/tty #0": rw `},
+		{`  '/dev/tty #0': rw`, `  '/dev/tty #0': rw`},
+		{`  "it's # here": rw`, `  "it's # here": rw`},
+	}
+
+	for _, test := range tests {
+		if got := stripYAMLComment(test.line); got != test.want {
+			t.Errorf("stripYAMLComment(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseYAMLPair(t *testing.T) {
+	tests := []struct {
+		line  string
+		key   string
+		value string
+	}{
+		{"users:", "users", ""},
+		{"  users:  ", "users", ""},
+		{"/dev/ttyS0: rw", "/dev/ttyS0", "rw"},
+		{"/dev/ttyS0:   ro  ", "/dev/ttyS0", "ro"},
+		{`/dev/ttyS0: "rw"`, "/dev/ttyS0", "rw"},
+		{`/dev/ttyS0: 'ro'`, "/dev/ttyS0", "ro"},
+		{`"*":`, "*", ""},
+		{`'*' :`, "*", ""},
+		{`"SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s":`, "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s", ""},
+		{`"/dev/tty: S0": rw`, "/dev/tty: S0", "rw"},
+		{"/dev/tty:S0: rw", "/dev/tty:S0", "rw"},
+	}
+
+	for _, test := range tests {
+		key, value, err := parseYAMLPair(test.line)
+		if err != nil {
+			t.Errorf("parseYAMLPair(%q): %v", test.line, err)
+		} else if key != test.key || value != test.value {
+			t.Errorf("parseYAMLPair(%q) = %q, %q, want %q, %q", test.line, key, value, test.key, test.value)
+		}
+	}
+
+	for _, line := range []string{"users", "/dev/ttyS0 rw", `"users:`, `"users" rw`, `'users`} {
+		if key, value, err := parseYAMLPair(line); err == nil {
+			t.Errorf("parseYAMLPair(%q) = %q, %q, expected an error", line, key, value)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := parsePolicy("policy.yaml", []byte(`# rcom access policy
+users:
+  alice:   # the lab admin
+    /dev/ttyUSB*: rw
+    "/dev/tty #9": none
+
+  '*':
+      /dev/ttyACM0: READ-ONLY
+  bob:
+keys:
+  "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s":
+    /dev/ttyUSB0: 'read-write'
+users:
+  alice:
+    /dev/ttyS0: ro
+`))
+	if err != nil {
+		t.Fatalf("parsePolicy failed: %v", err)
+	}
+
+	users := map[string][]policyRule{
+		"alice": {{"/dev/ttyUSB*", ReadWrite}, {"/dev/tty #9", NoAccess}, {"/dev/ttyS0", ReadOnly}},
+		"*":     {{"/dev/ttyACM0", ReadOnly}},
+		"bob":   nil,
+	}
+	if !reflect.DeepEqual(policy.users, users) {
+		t.Errorf("Got users %v, want %v", policy.users, users)
+	}
+
+	keys := map[string][]policyRule{
+		"SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s": {{"/dev/ttyUSB0", ReadWrite}},
+	}
+	if !reflect.DeepEqual(policy.keys, keys) {
+		t.Errorf("Got keys %v, want %v", policy.keys, keys)
+	}
+}
+
+func TestParsePolicyInvalid(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"users:\n\talice:\n", "policy.yaml:2: tabs can not be used"},
+		{"users:\n  alice:\n    /dev/ttyS0: rw\n   /dev/ttyS1: rw\n", "policy.yaml:4: inconsistent indentation"},
+		{"users:\n    alice:\n      /dev/ttyS0: rw\n  bob:\n", "policy.yaml:4: inconsistent indentation"},
+		{"users:\n  alice:\n    /dev/ttyS0: rw\n      /dev/ttyS1: rw\n", "policy.yaml:4: unexpected indentation"},
+		{"groups:\n  wheel:\n", `policy.yaml:1: unknown section "groups"`},
+		{"users: alice\n", "policy.yaml:1: expected users: or keys:"},
+		{"users:\n  alice: rw\n", "policy.yaml:2: expected the devices of alice"},
+		{"  alice:\n    /dev/ttyS0: rw\n", `policy.yaml:1: unknown section "alice"`},
+		{"users:\n  alice:\n    /dev/ttyS0: write\n", `policy.yaml:3: invalid mode "write"`},
+		{"users:\n  alice:\n    /dev/ttyS0:\n", `policy.yaml:3: invalid mode ""`},
+		{"users:\n  alice:\n    ttyS0: rw\n", `policy.yaml:3: invalid device "ttyS0"`},
+		{"users:\n  \"alice:\n", "policy.yaml:2: unterminated quote"},
+		{"users:\n  alice\n", "policy.yaml:2: expected key: value"},
+	}
+
+	for _, test := range tests {
+		_, err := parsePolicy("policy.yaml", []byte(test.input))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parsePolicy(%q) = %v, want %q", test.input, err, test.err)
+		}
+	}
+}
+
+func TestPolicyAccess(t *testing.T) {
+	policy, err := parsePolicy("policy.yaml", []byte(`
+users:
+  "*":
+    /dev/ttyACM*: ro
+    /dev/ttyS9: none
+  alice:
+    /dev/ttyUSB*: rw
+    /dev/ttyUSB9: none
+    /dev/ttyACM0: rw
+    /dev/ttyS9: rw
+  bob:
+    /dev/ttyUSB0: ro
+keys:
+  "SHA256:key":
+    /dev/ttyUSB0: rw
+    /dev/ttyACM1: none
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		key      string
+		device   string
+		want     AccessMode
+	}{
+		{"alice", "", "/dev/ttyUSB0", ReadWrite},
+		{"alice", "", "/dev/ttyUSB9", NoAccess},
+		{"alice", "", "/dev/ttyACM0", ReadWrite},
+		{"alice", "", "/dev/ttyACM1", ReadOnly},
+		{"alice", "", "/dev/ttyS9", NoAccess},
+		{"alice", "", "/dev/ttyS0", NoAccess},
+		{"alice", "", "/dev/ttyUSB0/../ttyS0", NoAccess},
+		{"alice", "", "/dev/../dev/ttyUSB0", NoAccess},
+		{"bob", "", "/dev/ttyUSB0", ReadOnly},
+		{"bob", "", "/dev/ttyUSB1", NoAccess},
+		{"bob", "SHA256:key", "/dev/ttyUSB0", ReadWrite},
+		{"bob", "SHA256:key", "/dev/ttyACM1", NoAccess},
+		{"bob", "SHA256:key", "/dev/ttyACM0", ReadOnly},
+		{"carol", "", "/dev/ttyACM0", ReadOnly},
+		{"carol", "", "/dev/ttyUSB0", NoAccess},
+		{"carol", "SHA256:other", "/dev/ttyUSB0", NoAccess},
+		{"", "SHA256:key", "/dev/ttyUSB0", ReadWrite},
+		{"", "", "/dev/ttyACM0", ReadOnly},
+	}
+
+	for _, test := range tests {
+		if got := policy.Access(test.username, test.key, test.device); got != test.want {
+			t.Errorf("Access(%q, %q, %q) = %v, want %v", test.username, test.key, test.device, got, test.want)
+		}
+	}
+}
+
+func TestServerConfigAccess(t *testing.T) {
+	policy, err := parsePolicy("policy.yaml", []byte("users:\n  alice:\n    /dev/ttyS0: ro\n    /dev/ttyS1: rw\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		options  []ServerOption
+		device   string
+		write    bool
+		readOnly bool
+		err      string
+	}{
+		{nil, "/dev/ttyS0", true, false, ""},
+		{[]ServerOption{AccessPolicy(policy, "alice", "")}, "/dev/ttyS0", false, true, ""},
+		{[]ServerOption{AccessPolicy(policy, "alice", "")}, "/dev/ttyS0", true, false, "only grants read-only access"},
+		{[]ServerOption{AccessPolicy(policy, "alice", "")}, "/dev/ttyS1", true, false, ""},
+		{[]ServerOption{AccessPolicy(policy, "alice", "")}, "/dev/ttyS2", false, false, "does not grant it to user alice"},
+		{[]ServerOption{AccessPolicy(policy, "bob", "SHA256:key")}, "/dev/ttyS1", false, false, "does not grant it to user bob with key SHA256:key"},
+	}
+
+	for i, test := range tests {
+		config, err := newServerConfig(test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		readOnly, err := config.access(test.device, test.write)
+		if test.err == "" && err != nil {
+			t.Errorf("Test %d: access(%q, %v) failed: %v", i, test.device, test.write, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("Test %d: access(%q, %v) = %v, want %q", i, test.device, test.write, err, test.err)
+		} else if readOnly != test.readOnly {
+			t.Errorf("Test %d: access(%q, %v) read-only %v, want %v", i, test.device, test.write, readOnly, test.readOnly)
+		}
+	}
+}
+
+func TestChangesDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	device := filepath.Join(dir, "ttyS0")
+	if err := ioutil.WriteFile(device, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		device   string
+		force    bool
+		settings *Settings
+		want     bool
+	}{
+		{device, false, nil, false},
+		{device, true, nil, true},
+		{device, false, &Settings{BaudRate: 9600}, true},
+		{filepath.Join(dir, "ttyS1"), false, nil, true},
+	}
+
+	for _, test := range tests {
+		if got := changesDevice(test.device, test.force, test.settings); got != test.want {
+			t.Errorf("changesDevice(%q, %v, %v) = %v, want %v", test.device, test.force, test.settings, got, test.want)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	missing := filepath.Join(dir, "missing.yaml")
+	if policy, err := loadOptionalPolicy(missing); policy != nil || err != nil {
+		t.Errorf("loadOptionalPolicy(%s) = %v, %v, want no policy", missing, policy, err)
+	}
+
+	if _, err := LoadPolicy(missing); err == nil {
+		t.Errorf("LoadPolicy(%s) expected an error", missing)
+	}
+
+	// a policy that exists but can not be read fails closed
+	unreadable := filepath.Join(dir, "unreadable.yaml")
+	if err := os.Mkdir(unreadable, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if policy, err := loadOptionalPolicy(unreadable); err == nil {
+		t.Errorf("loadOptionalPolicy(%s) = %v, expected an error", unreadable, policy)
+	}
+
+	notDir := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(notDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if policy, err := loadOptionalPolicy(filepath.Join(notDir, "policy.yaml")); err == nil {
+		t.Errorf("loadOptionalPolicy under a file = %v, expected an error", policy)
+	}
+
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := ioutil.WriteFile(invalid, []byte("users: everyone\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if policy, err := loadOptionalPolicy(invalid); err == nil {
+		t.Errorf("loadOptionalPolicy(%s) = %v, expected an error", invalid, policy)
+	}
+
+	valid := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(valid, []byte("users:\n  alice:\n    /dev/ttyS0: rw\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := loadOptionalPolicy(valid)
+	if err != nil || policy == nil {
+		t.Fatalf("loadOptionalPolicy(%s) = %v, %v", valid, policy, err)
+	}
+
+	if mode := policy.Access("alice", "", "/dev/ttyS0"); mode != ReadWrite {
+		t.Errorf("Got %v access from %s, want rw", mode, valid)
+	}
+}
+
+// setenv sets or, when value is nil, unsets the environment variable and
+// returns the function that restores it
+func setenv(name string, value *string) func() {
+	old, found := os.LookupEnv(name)
+	if value == nil {
+		os.Unsetenv(name)
+	} else {
+		os.Setenv(name, *value)
+	}
+
+	return func() {
+		if found {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestPolicyIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := NewPrivateKey(Ed25519Key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authInfo := filepath.Join(dir, "auth")
+	if err := ioutil.WriteFile(authInfo, append([]byte("password\npublickey "), ssh.MarshalAuthorizedKey(publicKey)...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the environment a client may set with SendEnv, or a login with a
+	// shell may set to anything, is never trusted
+	spoofed := "admin"
+	defer setenv("RCOM_USER", &spoofed)()
+	defer setenv("RCOM_KEY", &spoofed)()
+	defer setenv("SSH_USER_AUTH", &authInfo)()
+
+	username, fingerprint := PolicyIdentity("", "")
+	if username == spoofed || fingerprint != "" {
+		t.Errorf("PolicyIdentity = %q, %q from the environment", username, fingerprint)
+	}
+
+	username, fingerprint = PolicyIdentity("alice", "SHA256:key")
+	if username != "alice" || fingerprint != "SHA256:key" {
+		t.Errorf("PolicyIdentity = %q, %q, want the given alice, SHA256:key", username, fingerprint)
+	}
+}
+
+func TestPolicyAccessSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the temp dir may itself be reached through a link
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"by-id", "pty", "dev"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, device := range []string{"ttyUSB0", "ttyS0"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "dev", device), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"by-id/usb-FTDI": "dev/ttyUSB0",
+		"by-id/console":  "dev/ttyS0",
+		"pty/console":    "dev/ttyS0",
+		"pty/dev":        "dev",
+	}
+	for link, target := range links {
+		if err := os.Symlink(filepath.Join(dir, target), filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy, err := parsePolicy("policy.yaml", []byte(fmt.Sprintf(`users:
+  alice:
+    %[1]s/pty/*: rw
+    %[1]s/by-id/*: rw
+    %[1]s/by-id/console: none
+    %[1]s/dev/ttyUSB0: ro
+`, dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		device string
+		want   AccessMode
+	}{
+		// new pty links are matched by their own path
+		{"/pty/new", ReadWrite},
+		// links are granted by the rules of their target
+		{"/by-id/usb-FTDI", ReadOnly},
+		{"/dev/ttyUSB0", ReadOnly},
+		// a link can not reach a device that is not granted
+		{"/pty/console", NoAccess},
+		{"/pty/dev/ttyS0", NoAccess},
+		{"/pty/dev/ttyS1", NoAccess},
+		// none for a link denies it whatever its target is granted
+		{"/by-id/console", NoAccess},
+	}
+
+	for _, test := range tests {
+		if got := policy.Access("alice", "", dir+test.device); got != test.want {
+			t.Errorf("Access(%s) = %v, want %v", test.device, got, test.want)
+		}
+	}
+}
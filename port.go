@@ -1,30 +1,339 @@
 package rcom
 
 import (
+	"fmt"
 	"os"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+var (
+	// settingsPollInterval is how often the termios of a pty is checked
+	// for changes that were not announced in packet mode (ex: when a
+	// program has cleared EXTPROC on the slave)
+	settingsPollInterval = 500 * time.Millisecond
+
+	// modemPollInterval is how often the modem lines are read from
+	// devices whose driver does not support TIOCMIWAIT
+	modemPollInterval = 100 * time.Millisecond
+)
+
 type port struct {
 	pty      *os.File
 	tty      *os.File
 	linkName string
+
+	packet   bool
+	marked   bool
+	readOnly bool
+	mark     int
+	buf      []byte
+	mu       sync.Mutex
+	settings *Settings
+	done     chan struct{}
+	once     sync.Once
+
+	// events receives settings changes made by programs attached to a
+	// pty, the input lines and BREAKs of a serial device and DTR being
+	// dropped or raised on a pty by setting the speed to or from B0
+	events lineEvents
+}
+
+func (p *port) isPTY() bool {
+	return p.tty != nil
 }
 
 func (p *port) Read(buf []byte) (n int, err error) {
-	return p.pty.Read(buf)
+	if p.marked {
+		return p.readMarked(buf)
+	}
+
+	if !p.packet {
+		return p.pty.Read(buf)
+	}
+
+	// in packet mode every read is prefixed with a status byte, zero
+	// means the remainder is data, anything else is a control packet
+	if len(p.buf) < len(buf)+1 {
+		p.buf = make([]byte, len(buf)+1)
+	}
+
+	for {
+		n, err = p.pty.Read(p.buf[0 : len(buf)+1])
+		if n > 0 {
+			if p.buf[0] == 0 {
+				return copy(buf, p.buf[1:n]), err
+			}
+			p.checkSettings()
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readMarked reads from a serial device with PARMRK set, removing the
+// marks from the data and reporting breaks.  Marks may be split across
+// reads, so the position within the current mark is kept in p.mark
+func (p *port) readMarked(buf []byte) (n int, err error) {
+	for {
+		var read int
+		read, err = p.pty.Read(buf)
+		n = 0
+		for _, b := range buf[0:read] {
+			switch p.mark {
+			case 0:
+				if b == 0xff {
+					p.mark = 1
+					continue
+				}
+			case 1:
+				p.mark = 0
+				if b == 0 {
+					p.mark = 2
+					continue
+				}
+			case 2:
+				p.mark = 0
+				if b == 0 {
+					Logger.Printf("Received BREAK")
+					if p.events != nil {
+						p.events.sendBreak(0)
+					}
+					continue
+				}
+				// framing or parity error, pass the character along
+			}
+			buf[n] = b
+			n++
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
 }
 
 func (p *port) Write(buf []byte) (n int, err error) {
+	if p.readOnly {
+		return 0, p.errReadOnly()
+	}
 	return p.pty.Write(buf)
 }
 
-func newPort(device string, force bool) (p *port, err error) {
+// errReadOnly is the error of changing a device opened read-only
+func (p *port) errReadOnly() error {
+	return fmt.Errorf("%s is opened read-only", p.pty.Name())
+}
+
+// SetSettings applies the line settings to the underlying device.  The
+// data bits and parity of a pty are fixed, so they are skipped
+func (p *port) SetSettings(settings *Settings) error {
+	if p.readOnly {
+		return p.errReadOnly()
+	}
+
+	if p.isPTY() && (settings.DataBits != 0 || settings.Parity != 0) {
+		pty := *settings
+		pty.DataBits = 0
+		pty.Parity = 0
+		settings = &pty
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := applySettings(p.pty.Fd(), settings)
+	if err == nil && p.packet {
+		// record the change so it isn't reported back to the peer
+		p.settings, err = p.readSettings()
+	}
+	return err
+}
+
+func (p *port) readSettings() (*Settings, error) {
+	settings, err := readSettings(p.pty.Fd())
+	if err == nil && p.isPTY() {
+		// The pty driver always forces 8 data bits without parity, so
+		// these are unknown and left unset rather than reported
+		settings.DataBits = 0
+		settings.Parity = 0
+	}
+	return settings, err
+}
+
+func (p *port) checkSettings() {
+	p.mu.Lock()
+	settings, err := p.readSettings()
+	if err != nil {
+		p.mu.Unlock()
+		Logger.Printf("Failed to read pty settings: %v", err)
+		return
+	}
+
+	changed := p.settings.diff(settings)
+	hangup := p.settings.BaudRate != 0 && settings.BaudRate == 0
+	raise := p.settings.BaudRate == 0 && settings.BaudRate != 0
+	p.settings = settings
+	p.mu.Unlock()
+
+	if changed != nil {
+		Logger.Printf("Local pty settings changed to %v", changed)
+		if p.events != nil {
+			p.events.sendSettings(changed)
+		}
+	}
+
+	// Setting the speed to B0 is how POSIX drops DTR, which is the only
+	// modem control a program can exercise on a pty
+	if (hangup || raise) && p.events != nil {
+		lines := ModemLines(0)
+		if raise {
+			lines = LineDTR
+		}
+		p.events.sendModemLines(lines, LineDTR)
+	}
+}
+
+// SetModemLines changes the output lines in mask to the state given in
+// lines.  A pty has no modem lines so the request is ignored
+func (p *port) SetModemLines(lines, mask ModemLines) error {
+	if p.isPTY() || mask&OutputLines == 0 {
+		return nil
+	} else if p.readOnly {
+		return p.errReadOnly()
+	}
+	return setModemLines(p.pty.Fd(), lines, mask&OutputLines)
+}
+
+// SendBreak asserts a BREAK condition on the device for the given
+// duration.  A pty cannot signal a BREAK so the request is ignored
+func (p *port) SendBreak(duration time.Duration) error {
+	if p.isPTY() || duration == 0 {
+		return nil
+	} else if p.readOnly {
+		return p.errReadOnly()
+	}
+	return sendBreak(p.pty.Fd(), duration)
+}
+
+// ModemLines returns the current state of the device modem lines
+func (p *port) ModemLines() (ModemLines, error) {
+	return getModemLines(p.pty.Fd())
+}
+
+// waitModemLines waits in the background for the input modem lines to
+// change.  TIOCMIWAIT can not be interrupted, so a stopped port does not
+// wait for it and it only returns at the next change or hangup
+func (p *port) waitModemLines() <-chan error {
+	changed := make(chan error, 1)
+	fd := p.pty.Fd()
+	go func() { changed <- waitModemLines(fd) }()
+	return changed
+}
+
+func (p *port) watchModemLines() {
+	lines, err := p.ModemLines()
+	if err != nil {
+		Logger.Printf("Modem lines are not available: %v", err)
+		return
+	}
+
+	if p.events != nil {
+		p.events.sendModemLines(lines&InputLines, InputLines)
+	}
+
+	polling := false
+	for {
+		var changed <-chan error
+		var poll <-chan time.Time
+		if polling {
+			poll = time.After(modemPollInterval)
+		} else {
+			changed = p.waitModemLines()
+		}
+
+		select {
+		case err := <-changed:
+			if err != nil {
+				Logger.Printf("Waiting for modem line changes failed, polling instead: %v", err)
+				polling = true
+				continue
+			}
+		case <-poll:
+		case <-p.done:
+			return
+		}
+
+		// the port may have been stopped while the wait returned
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		current, err := p.ModemLines()
+		if err != nil {
+			Logger.Printf("Failed to read modem lines: %v", err)
+			return
+		}
+
+		if (current^lines)&InputLines != 0 {
+			lines = current
+			if p.events != nil {
+				p.events.sendModemLines(lines&InputLines, InputLines)
+			}
+		}
+	}
+}
+
+// watch starts reporting changes on the port to events
+func (p *port) watch(events lineEvents) {
+	p.events = events
+	if p.isPTY() {
+		if p.packet {
+			go p.watchSettings()
+		}
+	} else {
+		p.announceSettings()
+		go p.watchModemLines()
+	}
+}
+
+// announceSettings sends the current settings of a serial device, so
+// that the peer starts out with them rather than unknown settings
+func (p *port) announceSettings() {
+	settings, err := readSettings(p.pty.Fd())
+	if err != nil {
+		Logger.Printf("Failed to read serial settings: %v", err)
+		return
+	}
+
+	if p.events != nil {
+		p.events.sendSettings(settings)
+	}
+}
+
+func (p *port) watchSettings() {
+	ticker := time.NewTicker(settingsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkSettings()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func newPort(device string, force bool, settings *Settings) (p *port, err error) {
 	Logger.Printf("Opening port %s", device)
-	p = &port{}
+	p = &port{done: make(chan struct{})}
 
 	if force {
 		err = os.RemoveAll(device)
@@ -35,14 +344,32 @@ func newPort(device string, force bool) (p *port, err error) {
 
 	if _, err = os.Stat(device); err != nil {
 		if os.IsNotExist(err) {
-			err = nil
 			p.pty, p.tty, err = pty.Open()
+			if err != nil {
+				Logger.Printf("Failed to open a pty: %v", err)
+				return nil, err
+			}
+
 			_, err = terminal.MakeRaw(int(p.pty.Fd()))
 			if err != nil {
 				Logger.Printf("Failed to activate RAW mode on pty: %v", err)
+				p.pty.Close()
+				p.tty.Close()
 				return nil, err
 			}
 
+			err = enablePacketMode(p.pty.Fd())
+			if err == nil {
+				p.settings, err = p.readSettings()
+			}
+
+			if err == nil {
+				p.packet = true
+			} else {
+				Logger.Printf("Failed to activate packet mode on pty, settings changes will not be forwarded: %v", err)
+				err = nil
+			}
+
 			err = os.Chmod(p.tty.Name(), 0660)
 			if err == nil {
 				Logger.Printf("Linking pty %s to %s", p.tty.Name(), device)
@@ -63,6 +390,21 @@ func newPort(device string, force bool) (p *port, err error) {
 			_, err = terminal.MakeRaw(int(p.pty.Fd()))
 			if err != nil {
 				Logger.Printf("Failed to activate RAW mode on serial port: %v", err)
+				return p, err
+			}
+
+			if err := enableBreakDetection(p.pty.Fd()); err == nil {
+				p.marked = true
+			} else {
+				Logger.Printf("Failed to enable BREAK detection on serial port: %v", err)
+			}
+
+			if settings != nil {
+				Logger.Printf("Setting %s to %v", device, settings)
+				err = applySettings(p.pty.Fd(), settings)
+				if err != nil {
+					Logger.Printf("Failed to apply serial settings %v: %v", settings, err)
+				}
 			}
 		}
 	}
@@ -70,7 +412,29 @@ func newPort(device string, force bool) (p *port, err error) {
 	return p, err
 }
 
+// newReadOnlyPort opens an existing device only to read from it.  Its
+// termios is left as it is, so the device is neither made raw nor set up
+// for BREAK detection, and its settings, modem lines and BREAKs can not
+// be changed through the port
+func newReadOnlyPort(device string) (*port, error) {
+	Logger.Printf("Opening port %s read-only", device)
+	f, err := os.OpenFile(device, os.O_RDONLY|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &port{pty: f, readOnly: true, done: make(chan struct{})}, nil
+}
+
+func (p *port) stop() {
+	p.once.Do(func() { close(p.done) })
+}
+
+func (p *port) Close() error {
+	return p.ClosePTY()
+}
+
 func (p *port) ClosePTY() error {
+	p.stop()
 	if p.linkName != "" {
 		Logger.Printf("Removing symlink %s", p.linkName)
 		os.Remove(p.linkName)
@@ -79,6 +443,7 @@ func (p *port) ClosePTY() error {
 }
 
 func (p *port) CloseTTY() error {
+	p.stop()
 	if p.linkName != "" {
 		Logger.Printf("Removing symlink %s", p.linkName)
 		os.Remove(p.linkName)
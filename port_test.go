@@ -0,0 +1,170 @@
+package rcom
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// testPTY returns a port for a new pty linked in a temporary directory
+// and the function that removes them
+func testPTY(t *testing.T) (*port, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newPort(filepath.Join(dir, "tty"), false, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("ptys are not available: %v", err)
+	}
+
+	return p, func() {
+		p.CloseTTY()
+		p.ClosePTY()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPTYSettings(t *testing.T) {
+	p, cleanup := testPTY(t)
+	defer cleanup()
+	if !p.packet {
+		t.Skip("pty packet mode is not available")
+	}
+
+	if err := p.SetSettings(&Settings{BaudRate: 9600, DataBits: 7, Parity: ParityEven, StopBits: 2}); err != nil {
+		t.Fatalf("SetSettings failed: %v", err)
+	}
+
+	settings, err := p.readSettings()
+	if err != nil {
+		t.Fatalf("readSettings failed: %v", err)
+	}
+
+	if settings.BaudRate != 9600 || settings.StopBits != 2 {
+		t.Errorf("pty settings are %v, want 9600,--2", settings)
+	}
+
+	if settings.DataBits != 0 || settings.Parity != 0 {
+		t.Errorf("pty settings report data bits %d and parity %q, want them unknown", settings.DataBits, settings.Parity)
+	}
+}
+
+// testEvents records the line events of an endpoint
+type testEvents struct {
+	settings chan *Settings
+}
+
+func (e *testEvents) sendSettings(settings *Settings) { e.settings <- settings }
+
+func (e *testEvents) sendModemLines(lines, mask ModemLines) {}
+
+func (e *testEvents) sendBreak(duration time.Duration) error { return nil }
+
+func TestSerialInitialSettings(t *testing.T) {
+	p, cleanup := testPTY(t)
+	defer cleanup()
+
+	// the slave of the pty stands in for a serial device
+	device, err := newPort(p.tty.Name(), false, &Settings{BaudRate: 19200, StopBits: 2})
+	if err != nil {
+		t.Fatalf("newPort(%s) failed: %v", p.tty.Name(), err)
+	}
+	defer device.ClosePTY()
+
+	events := &testEvents{settings: make(chan *Settings, 1)}
+	device.events = events
+	device.announceSettings()
+
+	select {
+	case settings := <-events.settings:
+		if settings.BaudRate != 19200 || settings.StopBits != 2 || settings.DataBits != 8 || settings.Parity != ParityNone {
+			t.Errorf("announced settings %v, want 19200,8N2", settings)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the settings of the device were not announced")
+	}
+}
+
+func TestReadOnlyPort(t *testing.T) {
+	p, cleanup := testPTY(t)
+	defer cleanup()
+
+	before, err := terminal.GetState(int(p.tty.Fd()))
+	if err != nil {
+		t.Fatalf("Failed to read the termios of %s: %v", p.tty.Name(), err)
+	}
+
+	device, err := openPort(p.tty.Name(), false, nil, true)
+	if err != nil {
+		t.Fatalf("openPort(%s) read-only failed: %v", p.tty.Name(), err)
+	}
+
+	events := &testEvents{settings: make(chan *Settings, 1)}
+	device.events = events
+	device.announceSettings()
+
+	if err := device.SetSettings(&Settings{BaudRate: 9600}); err == nil {
+		t.Errorf("Expected settings to be refused on a read-only port")
+	}
+
+	if err := device.SetModemLines(LineDTR, LineDTR); err == nil {
+		t.Errorf("Expected modem lines to be refused on a read-only port")
+	}
+
+	if err := device.SendBreak(time.Millisecond); err == nil {
+		t.Errorf("Expected a BREAK to be refused on a read-only port")
+	}
+
+	if _, err := device.Write([]byte("data")); err == nil {
+		t.Errorf("Expected writes to be refused on a read-only port")
+	}
+
+	if _, err := p.pty.Write([]byte("data\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	deadline := time.Now().Add(5 * time.Second)
+	for n := 0; n == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Nothing was read from the read-only port")
+		}
+		n, _ = device.Read(buf)
+		time.Sleep(10 * time.Millisecond)
+	}
+	device.ClosePTY()
+
+	after, err := terminal.GetState(int(p.tty.Fd()))
+	if err != nil {
+		t.Fatalf("Failed to read the termios of %s: %v", p.tty.Name(), err)
+	}
+
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("A read-only session changed the termios of %s from %+v to %+v", p.tty.Name(), before, after)
+	}
+
+	// the same session read-write makes the device raw
+	device, err = openPort(p.tty.Name(), false, nil, false)
+	if err != nil {
+		t.Fatalf("openPort(%s) failed: %v", p.tty.Name(), err)
+	}
+	device.ClosePTY()
+
+	raw, err := terminal.GetState(int(p.tty.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reflect.DeepEqual(before, raw) {
+		t.Errorf("Expected a read-write session to change the termios of %s", p.tty.Name())
+	}
+}
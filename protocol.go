@@ -0,0 +1,73 @@
+package rcom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// frameType identifies the payload of a frame exchanged between the
+// client and the server.  Every frame on the wire is a one byte type,
+// a two byte big endian payload length and the payload itself
+type frameType byte
+
+const (
+	dataFrame     frameType = iota // raw bytes to/from the device
+	settingsFrame                  // line settings in ParseSettings format
+	modemFrame                     // modem line state followed by the mask of lines it applies to
+	breakFrame                     // BREAK duration in milliseconds, zero reports a received BREAK
+	windowFrame                    // data credit returned on a multiplexed stream
+)
+
+func (ft frameType) String() string {
+	switch ft {
+	case dataFrame:
+		return "data"
+	case settingsFrame:
+		return "settings"
+	case modemFrame:
+		return "modem"
+	case breakFrame:
+		return "break"
+	case windowFrame:
+		return "window"
+	}
+	return fmt.Sprintf("frame(%d)", byte(ft))
+}
+
+const (
+	frameHeaderSize = 3
+	maxFramePayload = 4096
+)
+
+func writeFrame(w io.Writer, ft frameType, payload []byte) error {
+	if len(payload) > maxFramePayload {
+		return fmt.Errorf("Frame payload too large: %d bytes", len(payload))
+	}
+
+	buf := make([]byte, frameHeaderSize+len(payload))
+	buf[0] = byte(ft)
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads the next frame from r.  The returned payload is only
+// valid until the next call to readFrame with the same buffer
+func readFrame(r io.Reader, buf []byte) (ft frameType, payload []byte, err error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+
+	ft = frameType(header[0])
+	length := int(binary.BigEndian.Uint16(header[1:3]))
+	if length > len(buf) {
+		return ft, nil, fmt.Errorf("Frame payload too large: %d bytes", length)
+	}
+
+	payload = buf[0:length]
+	_, err = io.ReadFull(r, payload)
+	return
+}
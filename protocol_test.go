@@ -0,0 +1,66 @@
+package rcom
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	payloads := [][]byte{nil, []byte("hello"), bytes.Repeat([]byte{0xff}, maxFramePayload)}
+	for i, payload := range payloads {
+		if err := writeFrame(&buf, frameType(i), payload); err != nil {
+			t.Fatalf("writeFrame failed: %v", err)
+		}
+	}
+
+	rbuf := make([]byte, maxFramePayload)
+	for i, want := range payloads {
+		ft, payload, err := readFrame(&buf, rbuf)
+		if err != nil {
+			t.Fatalf("readFrame failed: %v", err)
+		}
+
+		if ft != frameType(i) || !bytes.Equal(payload, want) {
+			t.Errorf("readFrame = %v %d bytes, want %v %d bytes", ft, len(payload), frameType(i), len(want))
+		}
+	}
+
+	if _, _, err := readFrame(&buf, rbuf); err != io.EOF {
+		t.Errorf("readFrame at the end of the stream = %v, want EOF", err)
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, dataFrame, make([]byte, maxFramePayload+1)); err == nil {
+		t.Errorf("writeFrame of %d bytes succeeded", maxFramePayload+1)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("writeFrame wrote %d bytes of a frame that is too large", buf.Len())
+	}
+}
+
+func TestReadFrameInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"truncated header", []byte{byte(dataFrame), 0}, io.ErrUnexpectedEOF},
+		{"truncated payload", []byte{byte(dataFrame), 0, 5, 'a', 'b'}, io.ErrUnexpectedEOF},
+		{"oversized payload", []byte{byte(dataFrame), 0x10, 0x01}, nil},
+		{"larger than the buffer", []byte{byte(dataFrame), 0, 9, '0', '1', '2', '3', '4', '5', '6', '7', '8'}, nil},
+	}
+
+	for _, test := range tests {
+		_, payload, err := readFrame(bytes.NewReader(test.input), make([]byte, 8))
+		if err == nil {
+			t.Errorf("%s: readFrame = %q, want an error", test.name, payload)
+		} else if test.want != nil && err != test.want {
+			t.Errorf("%s: readFrame error = %v, want %v", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package rcom
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SOCKS5 protocol values (RFC 1928 and RFC 1929)
+const (
+	socksVersion        = 5
+	socksNoAuth         = 0
+	socksUserPass       = 2
+	socksNoAcceptable   = 0xff
+	socksConnect        = 1
+	socksIPv4           = 1
+	socksDomain         = 3
+	socksIPv6           = 4
+	socksUserPassVer    = 1
+	socksSucceeded      = 0
+	socksMaxFieldLength = 255
+)
+
+// parseProxy parses a proxy URL.  The scheme is one of socks5, socks5h
+// (the proxy resolves host names) or http and defaults to http
+func parseProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy %q: %v", proxy, err)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme %q: use socks5, socks5h or http", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("Invalid proxy %q: no host given", proxy)
+	}
+	return u, nil
+}
+
+// proxyFor returns the proxy to reach addr through, or nil to connect
+// directly
+func (config *Config) proxyFor(addr string) (*url.URL, error) {
+	proxy := config.proxy
+	if proxy == "" && config.proxyFromEnv {
+		proxy = getenv("ALL_PROXY")
+		if proxy != "" && noProxy(getenv("NO_PROXY"), addr) {
+			proxy = ""
+		}
+	}
+
+	if proxy == "" || strings.EqualFold(proxy, "none") {
+		return nil, nil
+	}
+	return parseProxy(proxy)
+}
+
+// getenv returns the environment variable name, or its lower case
+// version when it is not set
+func getenv(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// noProxy reports whether addr matches the NO_PROXY list.  Entries are
+// host names, which also match their subdomains, IP addresses or CIDR
+// ranges, optionally with a port, or * to match everything
+func noProxy(list string, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		if entry == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+
+		if entryIP := net.ParseIP(strings.Trim(entry, "[]")); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		entry = strings.TrimPrefix(entry, "*")
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialTCP opens a TCP connection to addr, through a proxy when one
+// applies
+func (config *Config) dialTCP(addr string) (net.Conn, error) {
+	proxy, err := config.proxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := config.clientConfig.Timeout
+	if proxy == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		port := "1080"
+		if proxy.Scheme == "http" {
+			port = "8080"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+
+	Logger.Printf("Connecting to %s through %s proxy %s", addr, proxy.Scheme, proxyAddr)
+	c, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to proxy %s: %v", proxyAddr, err)
+	}
+
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+
+	tunnel := c
+	if proxy.Scheme == "http" {
+		tunnel, err = httpConnect(c, proxy, addr)
+	} else {
+		err = socksConnectTo(c, proxy, addr)
+	}
+
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Proxy %s failed to connect to %s: %v", proxyAddr, addr, err)
+	}
+
+	tunnel.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// socksConnectTo asks the SOCKS5 proxy on c to connect to addr
+func socksConnectTo(c net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("Invalid port %q", portStr)
+	}
+
+	methods := []byte{socksNoAuth}
+	if proxy.User != nil {
+		methods = append(methods, socksUserPass)
+	}
+
+	if _, err := c.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+
+	if reply[0] != socksVersion {
+		return fmt.Errorf("Unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if proxy.User == nil {
+			return fmt.Errorf("SOCKS proxy requires a username and password")
+		}
+
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > socksMaxFieldLength || len(password) > socksMaxFieldLength {
+			return fmt.Errorf("SOCKS username or password too long")
+		}
+
+		req := []byte{socksUserPassVer, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := c.Write(req); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(c, reply); err != nil {
+			return err
+		}
+
+		if reply[1] != socksSucceeded {
+			return fmt.Errorf("SOCKS authentication failed")
+		}
+	case socksNoAcceptable:
+		return fmt.Errorf("SOCKS proxy accepted none of the authentication methods")
+	default:
+		return fmt.Errorf("SOCKS proxy chose unsupported authentication method %d", reply[1])
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			return err
+		}
+		ip = addrs[0]
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksIPv4)
+		req = append(req, ip4...)
+	} else if ip != nil {
+		req = append(req, socksIPv6)
+		req = append(req, ip.To16()...)
+	} else {
+		if len(host) > socksMaxFieldLength {
+			return fmt.Errorf("Host name %q too long", host)
+		}
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return err
+	}
+
+	if header[1] != socksSucceeded {
+		return fmt.Errorf("SOCKS connect failed with code %d", header[1])
+	}
+
+	// skip the bound address and port
+	length := 0
+	switch header[3] {
+	case socksIPv4:
+		length = net.IPv4len
+	case socksIPv6:
+		length = net.IPv6len
+	case socksDomain:
+		if _, err := io.ReadFull(c, header[0:1]); err != nil {
+			return err
+		}
+		length = int(header[0])
+	default:
+		return fmt.Errorf("Unknown SOCKS address type %d", header[3])
+	}
+	_, err = io.ReadFull(c, make([]byte, length+2))
+	return err
+}
+
+// bufferedConn reads the bytes buffered while reading the proxy
+// response before reading from the connection again
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.r.Read(p)
+}
+
+// httpConnect opens a tunnel to addr with an HTTP CONNECT request
+func httpConnect(c net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP CONNECT failed: %s", resp.Status)
+	}
+	return &bufferedConn{Conn: c, r: r}, nil
+}
@@ -0,0 +1,344 @@
+package rcom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// proxyRequest is the destination a test proxy was asked to connect to
+type proxyRequest struct {
+	addrType byte
+	host     string
+	port     int
+	auth     string
+}
+
+// testProxy listens on the loopback interface and serves a single
+// proxy request with serve, the requested destination is sent on
+// requests
+type testProxy struct {
+	listener net.Listener
+	requests chan proxyRequest
+}
+
+func newTestProxy(t *testing.T, serve func(c net.Conn, requests chan<- proxyRequest)) *testProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	p := &testProxy{listener: listener, requests: make(chan proxyRequest, 1)}
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		serve(c, p.requests)
+	}()
+	return p
+}
+
+func (p *testProxy) addr() string { return p.listener.Addr().String() }
+
+// serveSOCKS5 accepts the connect request of a SOCKS5 client, with a
+// username and password when the client offers them, and then echoes
+// the data of the tunnel
+func serveSOCKS5(c net.Conn, requests chan<- proxyRequest) {
+	var req proxyRequest
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return
+	}
+
+	method := byte(socksNoAuth)
+	for _, m := range methods {
+		if m == socksUserPass {
+			method = socksUserPass
+		}
+	}
+	c.Write([]byte{socksVersion, method})
+
+	if method == socksUserPass {
+		field := func() string {
+			length := make([]byte, 1)
+			io.ReadFull(c, length)
+			buf := make([]byte, length[0])
+			io.ReadFull(c, buf)
+			return string(buf)
+		}
+		io.ReadFull(c, header[0:1])
+		username := field()
+		password := field()
+		req.auth = username + ":" + password
+		c.Write([]byte{socksUserPassVer, socksSucceeded})
+	}
+
+	connect := make([]byte, 4)
+	if _, err := io.ReadFull(c, connect); err != nil {
+		return
+	}
+
+	req.addrType = connect[3]
+	switch req.addrType {
+	case socksIPv4, socksIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req.addrType == socksIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		io.ReadFull(c, ip)
+		req.host = net.IP(ip).String()
+	case socksDomain:
+		io.ReadFull(c, header[0:1])
+		host := make([]byte, header[0])
+		io.ReadFull(c, host)
+		req.host = string(host)
+	}
+
+	port := make([]byte, 2)
+	io.ReadFull(c, port)
+	req.port = int(binary.BigEndian.Uint16(port))
+	requests <- req
+
+	c.Write([]byte{socksVersion, socksSucceeded, 0, socksIPv4, 127, 0, 0, 1, 0, 22})
+	io.Copy(c, c)
+}
+
+// serveHTTPConnect answers a CONNECT request with status, and on
+// success writes greeting right after the response before echoing the
+// data of the tunnel
+func serveHTTPConnect(status int, greeting string) func(net.Conn, chan<- proxyRequest) {
+	return func(c net.Conn, requests chan<- proxyRequest) {
+		r := bufio.NewReader(c)
+		httpReq, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+
+		host, port, _ := net.SplitHostPort(httpReq.Host)
+		req := proxyRequest{host: host, auth: httpReq.Header.Get("Proxy-Authorization")}
+		req.port, _ = strconv.Atoi(port)
+		if httpReq.Method != http.MethodConnect {
+			req.host = ""
+		}
+		requests <- req
+
+		resp := "HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n\r\n"
+		if status != http.StatusOK {
+			c.Write([]byte(resp))
+			return
+		}
+
+		c.Write([]byte(resp + greeting))
+		io.Copy(c, r)
+	}
+}
+
+// expectTunnel checks that the proxy was asked for want and that data
+// is carried through the tunnel
+func expectTunnel(t *testing.T, name string, p *testProxy, c net.Conn, want proxyRequest, greeting string) {
+	t.Helper()
+	defer c.Close()
+	select {
+	case got := <-p.requests:
+		if got != want {
+			t.Errorf("%s: proxy was asked for %+v, want %+v", name, got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: proxy received no request", name)
+	}
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("%s: write failed: %v", name, err)
+	}
+
+	buf := make([]byte, len(greeting)+4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatalf("%s: read failed: %v", name, err)
+	}
+
+	if string(buf) != greeting+"ping" {
+		t.Errorf("%s: read %q through the tunnel, want %q", name, buf, greeting+"ping")
+	}
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	tests := []struct {
+		name   string
+		scheme string
+		user   string
+		addr   string
+		want   proxyRequest
+	}{
+		{"socks5 IPv4", "socks5://", "", "192.0.2.1:22", proxyRequest{socksIPv4, "192.0.2.1", 22, ""}},
+		{"socks5 IPv6", "socks5://", "", "[2001:db8::1]:2222", proxyRequest{socksIPv6, "2001:db8::1", 2222, ""}},
+		{"socks5 resolves names", "socks5://", "", "localhost:22", proxyRequest{socksIPv4, "127.0.0.1", 22, ""}},
+		{"socks5h", "socks5h://", "", "device.example.com:22", proxyRequest{socksDomain, "device.example.com", 22, ""}},
+		{"socks5 with password", "socks5h://", "alice:secret@", "router:22", proxyRequest{socksDomain, "router", 22, "alice:secret"}},
+	}
+
+	// socks5 sends the first address of the name
+	if addrs, err := net.LookupIP("localhost"); err == nil && addrs[0].To4() == nil {
+		tests[2].want = proxyRequest{socksIPv6, addrs[0].String(), 22, ""}
+	}
+
+	for _, test := range tests {
+		p := newTestProxy(t, serveSOCKS5)
+		config := &Config{proxy: test.scheme + test.user + p.addr()}
+		config.clientConfig.Timeout = 5 * time.Second
+
+		c, err := config.dialTCP(test.addr)
+		if err != nil {
+			t.Errorf("%s: dialTCP failed: %v", test.name, err)
+		} else {
+			expectTunnel(t, test.name, p, c, test.want, "")
+		}
+		p.listener.Close()
+	}
+}
+
+func TestDialHTTPConnect(t *testing.T) {
+	p := newTestProxy(t, serveHTTPConnect(http.StatusOK, "SSH-2.0-greeting\r\n"))
+	defer p.listener.Close()
+
+	config := &Config{proxy: "http://alice:secret@" + p.addr()}
+	c, err := config.dialTCP("device.example.com:22")
+	if err != nil {
+		t.Fatalf("dialTCP failed: %v", err)
+	}
+
+	// the bytes the proxy sends right after its response belong to the
+	// tunnel
+	want := proxyRequest{host: "device.example.com", port: 22, auth: "Basic YWxpY2U6c2VjcmV0"}
+	expectTunnel(t, "CONNECT", p, c, want, "SSH-2.0-greeting\r\n")
+}
+
+func TestDialHTTPConnectFailed(t *testing.T) {
+	p := newTestProxy(t, serveHTTPConnect(http.StatusForbidden, ""))
+	defer p.listener.Close()
+
+	config := &Config{proxy: p.addr()}
+	if c, err := config.dialTCP("device.example.com:22"); err == nil {
+		c.Close()
+		t.Fatalf("dialTCP succeeded although the proxy refused the CONNECT")
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	tests := []struct {
+		list string
+		addr string
+		want bool
+	}{
+		{"", "router:22", false},
+		{"*", "router:22", true},
+		{"example.com", "example.com:22", true},
+		{"example.com", "device.example.com:22", true},
+		{".example.com", "device.example.com:22", true},
+		{"*.example.com", "device.example.com:22", true},
+		{"example.com", "badexample.com:22", false},
+		{"Example.COM", "DEVICE.example.com:22", true},
+		{"other.com, example.com", "example.com:22", true},
+		{"example.com:2222", "example.com:22", false},
+		{"example.com:22", "example.com:22", true},
+		{"10.0.0.0/8", "10.1.2.3:22", true},
+		{"10.0.0.0/8", "192.168.1.1:22", false},
+		{"10.0.0.0/8", "ten.example.com:22", false},
+		{"192.168.1.1", "192.168.1.1:22", true},
+		{"[2001:db8::1]", "[2001:db8::1]:22", true},
+		{"2001:db8::/32", "[2001:db8::1]:22", true},
+	}
+
+	for _, test := range tests {
+		if got := noProxy(test.list, test.addr); got != test.want {
+			t.Errorf("noProxy(%q, %q) = %v, want %v", test.list, test.addr, got, test.want)
+		}
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	for _, name := range []string{"ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy"} {
+		if value, found := os.LookupEnv(name); found {
+			defer os.Setenv(name, value)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Unsetenv(name)
+	}
+
+	os.Setenv("all_proxy", "socks5h://proxy.example.com")
+	os.Setenv("NO_PROXY", "*.lab.example.com,10.0.0.0/8")
+
+	tests := []struct {
+		config *Config
+		addr   string
+		want   string
+	}{
+		{&Config{proxyFromEnv: true}, "device.example.com:22", "socks5h://proxy.example.com"},
+		{&Config{proxyFromEnv: true}, "device.lab.example.com:22", ""},
+		{&Config{proxyFromEnv: true}, "10.1.1.1:22", ""},
+		{&Config{}, "device.example.com:22", ""},
+		{&Config{proxyFromEnv: true, proxy: "none"}, "device.example.com:22", ""},
+		{&Config{proxyFromEnv: true, proxy: "http://other:3128"}, "device.lab.example.com:22", "http://other:3128"},
+	}
+
+	for _, test := range tests {
+		proxy, err := test.config.proxyFor(test.addr)
+		if err != nil {
+			t.Errorf("proxyFor(%s) failed: %v", test.addr, err)
+			continue
+		}
+
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+
+		if got != test.want {
+			t.Errorf("proxyFor(%s) with proxy %q = %q, want %q", test.addr, test.config.proxy, got, test.want)
+		}
+	}
+}
+
+func TestDialDirect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		c, err := listener.Accept()
+		if err == nil {
+			c.Write([]byte("direct"))
+			c.Close()
+		}
+	}()
+
+	config := &Config{proxy: "none"}
+	c, err := config.dialTCP(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dialTCP failed: %v", err)
+	}
+	defer c.Close()
+
+	buf, err := ioutil.ReadAll(c)
+	if err != nil || string(buf) != "direct" {
+		t.Errorf("read %q, %v from a direct connection, want direct", buf, err)
+	}
+}
@@ -0,0 +1,251 @@
+package rcom
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const keepAliveRequest = "keepalive@openssh.com"
+
+// reconnectDelay is the delay before the first reconnection attempt,
+// the delay doubles with every failed attempt
+var reconnectDelay = time.Second
+
+var errConnectionClosed = errors.New("Connection closed")
+
+// ErrDeadPeer is returned by Err when the connection was closed because
+// the remote host stopped answering keep-alives
+var ErrDeadPeer = errors.New("Remote host stopped responding")
+
+var errKeepAliveTimeout = errors.New("Keep-alive timed out")
+
+func newConnection(config *Config) *Connection {
+	return &Connection{config: config, done: make(chan struct{})}
+}
+
+func (conn *Connection) client() *ssh.Client {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.Client
+}
+
+// Err returns the reason the connection was closed, if it was not
+// closed with Close, or why an attached server was not restarted
+func (conn *Connection) Err() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.err
+}
+
+func (conn *Connection) notify(event Event) {
+	if conn.config.notify != nil {
+		conn.config.notify(event)
+	}
+}
+
+// lost marks the connection as lost, reporting it the first time
+func (conn *Connection) lost() {
+	conn.mu.Lock()
+	report := conn.connected
+	conn.connected = false
+	conn.mu.Unlock()
+
+	if report {
+		Logger.Printf("Lost connection to %s", conn.addr)
+		conn.notify(Event{Device: conn.addr, Type: DisconnectEvent})
+	}
+}
+
+// keepAlive sends keep-alive requests until the connection is closed.
+// The remote host is considered dead after keepAliveCountMax requests
+// in a row go unanswered, the connection is then either dropped to be
+// reconnected or closed
+func (conn *Connection) keepAlive() {
+	config := conn.config
+	ticker := time.NewTicker(config.keepAlive)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-conn.done:
+			return
+		}
+
+		client := conn.client()
+		err := ping(client, config.keepAliveTimeout)
+		if err == nil {
+			missed = 0
+			continue
+		}
+
+		missed++
+		Logger.Printf("Keep-alive %d of %d to %s failed: %v", missed, config.keepAliveCountMax, conn.addr, err)
+		if missed < config.keepAliveCountMax {
+			continue
+		}
+
+		missed = 0
+		conn.lost()
+		if config.reconnect > 0 {
+			client.Close()
+			continue
+		}
+
+		conn.mu.Lock()
+		conn.err = ErrDeadPeer
+		conn.mu.Unlock()
+		conn.Close()
+		client.Close()
+		return
+	}
+}
+
+// ping sends a keep-alive request and waits up to timeout for the reply
+func ping(client *ssh.Client, timeout time.Duration) error {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(keepAliveRequest, true, nil)
+		reply <- err
+	}()
+
+	select {
+	case err := <-reply:
+		return err
+	case <-time.After(timeout):
+		return errKeepAliveTimeout
+	}
+}
+
+func (conn *Connection) isClosed() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.closed
+}
+
+// supervise runs the session of an attachment until it ends.  With
+// reconnection enabled the links are then disconnected, keeping their
+// local endpoints open, and the session is restarted.  A server that
+// exits with an error before sending anything, such as one denied access
+// to its devices, is not restarted and its error is returned by Err
+func (conn *Connection) supervise(a *attachment, s *serverSession) {
+	defer conn.wg.Done()
+	delay := reconnectDelay
+	for {
+		if err := s.copyIn(); err != nil {
+			Logger.Printf("Remote session failed: %v", err)
+		}
+		err := s.Wait()
+		s.stdin.Close()
+		conn.removeSession(s.Session)
+
+		if conn.isClosed() {
+			return
+		}
+
+		if exit, ok := err.(*ssh.ExitError); ok && exit.ExitStatus() != 0 && s.received == 0 {
+			err = fmt.Errorf("%q exited with status %d before serving any data", a.exec, exit.ExitStatus())
+			Logger.Printf("Not restarting: %v", err)
+			conn.mu.Lock()
+			if conn.err == nil {
+				conn.err = err
+			}
+			conn.mu.Unlock()
+			return
+		}
+
+		if conn.config.reconnect <= 0 {
+			return
+		}
+
+		for _, l := range a.links {
+			l.disconnect()
+		}
+
+		// sessions that end without serving anything are restarted
+		// with the backoff of failed attempts
+		if s.received > 0 {
+			delay = reconnectDelay
+		}
+
+		s, delay, err = conn.restart(a, delay)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// restart starts the session of an attachment again after delay,
+// redialing the remote host when the connection was lost.  Failed
+// attempts are retried with an exponential backoff until the connection
+// is closed.  The delay before the next restart is returned
+func (conn *Connection) restart(a *attachment, delay time.Duration) (*serverSession, time.Duration, error) {
+	for {
+		Logger.Printf("Restarting %q in %v", a.exec, delay)
+		select {
+		case <-time.After(delay):
+		case <-conn.done:
+			return nil, delay, errConnectionClosed
+		}
+
+		delay *= 2
+		if delay > conn.config.reconnect {
+			delay = conn.config.reconnect
+		}
+
+		err := conn.redial()
+		if err == nil {
+			var s *serverSession
+			s, err = conn.start(a)
+			if err == nil {
+				Logger.Printf("Restarted %q", a.exec)
+				return s, delay, nil
+			}
+		}
+
+		if err == errConnectionClosed {
+			return nil, delay, err
+		}
+		Logger.Printf("Failed to restart %q: %v", a.exec, err)
+	}
+}
+
+// redial replaces the ssh client when it no longer answers requests
+func (conn *Connection) redial() error {
+	conn.dialMu.Lock()
+	defer conn.dialMu.Unlock()
+	if conn.isClosed() {
+		return errConnectionClosed
+	}
+
+	client := conn.client()
+	if ping(client, conn.config.keepAliveTimeout) == nil {
+		return nil
+	}
+	client.Close()
+	conn.lost()
+
+	Logger.Printf("Reconnecting to %s", conn.addr)
+	client, err := conn.dial()
+	if err != nil {
+		return err
+	}
+
+	conn.mu.Lock()
+	if conn.closed {
+		conn.mu.Unlock()
+		client.Close()
+		return errConnectionClosed
+	}
+	conn.Client = client
+	conn.connected = true
+	conn.mu.Unlock()
+
+	Logger.Printf("Reconnected to %s", conn.addr)
+	conn.notify(Event{Device: conn.addr, Type: ReconnectEvent})
+	return nil
+}
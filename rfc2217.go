@@ -0,0 +1,654 @@
+package rcom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// RFC 2217 COM-PORT-OPTION commands.  An access server replies to and
+// notifies with the command value plus comPortServer
+const (
+	comPortSignature         = 0
+	comPortSetBaudRate       = 1
+	comPortSetDataSize       = 2
+	comPortSetParity         = 3
+	comPortSetStopSize       = 4
+	comPortSetControl        = 5
+	comPortNotifyLineState   = 6
+	comPortNotifyModemState  = 7
+	comPortFlowSuspend       = 8
+	comPortFlowResume        = 9
+	comPortSetLineStateMask  = 10
+	comPortSetModemStateMask = 11
+	comPortPurgeData         = 12
+
+	comPortServer = 100
+)
+
+// SET-CONTROL values
+const (
+	controlFlowRequest  = 0
+	controlFlowNone     = 1
+	controlFlowXonXoff  = 2
+	controlFlowHardware = 3
+	controlBreakRequest = 4
+	controlBreakOn      = 5
+	controlBreakOff     = 6
+	controlDTRRequest   = 7
+	controlDTROn        = 8
+	controlDTROff       = 9
+	controlRTSRequest   = 10
+	controlRTSOn        = 11
+	controlRTSOff       = 12
+	controlInFlowReq    = 13
+	controlInFlowNone   = 14
+)
+
+// NOTIFY-MODEMSTATE and NOTIFY-LINESTATE bits
+const (
+	modemStateCTSDelta = 0x01
+	modemStateDSRDelta = 0x02
+	modemStateRIEdge   = 0x04
+	modemStateDCDDelta = 0x08
+	modemStateCTS      = 0x10
+	modemStateDSR      = 0x20
+	modemStateRI       = 0x40
+	modemStateDCD      = 0x80
+
+	lineStateBreak = 0x10
+)
+
+var rfc2217Parity = []Parity{0, ParityNone, ParityOdd, ParityEven, ParityMark, ParitySpace}
+
+func parityToRFC2217(parity Parity) byte {
+	for i, p := range rfc2217Parity {
+		if i > 0 && p == parity {
+			return byte(i)
+		}
+	}
+	return 0
+}
+
+func flowToRFC2217(flow FlowControl) byte {
+	switch flow {
+	case FlowNone:
+		return controlFlowNone
+	case FlowSoftware:
+		return controlFlowXonXoff
+	case FlowHardware:
+		return controlFlowHardware
+	}
+	return 0
+}
+
+// modemState encodes the input lines as a NOTIFY-MODEMSTATE value,
+// including the delta bits for the lines that differ from previous
+func modemState(lines, previous ModemLines) (state byte) {
+	bits := []struct {
+		line  ModemLines
+		state byte
+		delta byte
+	}{
+		{LineCTS, modemStateCTS, modemStateCTSDelta},
+		{LineDSR, modemStateDSR, modemStateDSRDelta},
+		{LineRI, modemStateRI, 0},
+		{LineDCD, modemStateDCD, modemStateDCDDelta},
+	}
+
+	for _, bit := range bits {
+		if lines&bit.line != 0 {
+			state |= bit.state
+		}
+
+		if (lines^previous)&bit.line != 0 {
+			state |= bit.delta
+		}
+	}
+
+	if previous&LineRI != 0 && lines&LineRI == 0 {
+		state |= modemStateRIEdge
+	}
+	return state
+}
+
+// rfc2217Server is an endpoint that exposes a link to an RFC 2217
+// (Telnet COM Port Control) client
+type rfc2217Server struct {
+	*telnetConn
+
+	mu         sync.Mutex
+	events     lineEvents
+	settings   Settings
+	lines      ModemLines
+	modemMask  byte
+	lineMask   byte
+	breakStart time.Time
+}
+
+func newRFC2217Server(conn net.Conn) *rfc2217Server {
+	s := &rfc2217Server{
+		telnetConn: newTelnetConn(conn),
+		modemMask:  0xff,
+	}
+
+	s.supported = func(option byte, local bool) bool {
+		switch option {
+		case telnetBinary, telnetSGA:
+			return true
+		case telnetComPort:
+			return !local
+		}
+		return false
+	}
+	s.onSubnegotiation = s.subnegotiation
+	s.onBreak = func() { s.sendBreak(defaultBreak) }
+	return s
+}
+
+// defaultBreak is the length of the BREAK sent for a telnet BRK command
+const defaultBreak = 250 * time.Millisecond
+
+func (s *rfc2217Server) start() error {
+	for _, req := range [][2]byte{
+		{telnetWILL, telnetBinary},
+		{telnetDO, telnetBinary},
+		{telnetWILL, telnetSGA},
+		{telnetDO, telnetSGA},
+	} {
+		if err := s.request(req[0], req[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *rfc2217Server) watch(events lineEvents) {
+	s.mu.Lock()
+	s.events = events
+	s.mu.Unlock()
+}
+
+func (s *rfc2217Server) eventHandler() lineEvents {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.events
+}
+
+func (s *rfc2217Server) sendSettings(settings *Settings) {
+	if events := s.eventHandler(); events != nil {
+		events.sendSettings(settings)
+	}
+}
+
+func (s *rfc2217Server) sendModemLines(lines, mask ModemLines) {
+	s.mu.Lock()
+	s.lines = s.lines&^mask | lines&mask
+	events := s.events
+	s.mu.Unlock()
+
+	if events != nil {
+		events.sendModemLines(lines, mask)
+	}
+}
+
+func (s *rfc2217Server) sendBreak(duration time.Duration) {
+	if events := s.eventHandler(); events != nil {
+		events.sendBreak(duration)
+	}
+}
+
+func (s *rfc2217Server) reply(command byte, value ...byte) {
+	data := append([]byte{command + comPortServer}, value...)
+	if err := s.sendSubnegotiation(telnetComPort, data); err != nil {
+		Logger.Printf("RFC 2217: failed to reply to command %d: %v", command, err)
+	}
+}
+
+func (s *rfc2217Server) subnegotiation(option byte, data []byte) {
+	if option != telnetComPort || len(data) < 1 {
+		return
+	}
+
+	command, value := data[0], data[1:]
+	Logger.Printf("RFC 2217: received command %d %x", command, value)
+	s.mu.Lock()
+	current := s.settings
+	s.mu.Unlock()
+
+	switch command {
+	case comPortSignature:
+		s.reply(command, []byte("rcom")...)
+	case comPortSetBaudRate:
+		if len(value) != 4 {
+			return
+		}
+
+		if baud := int(binary.BigEndian.Uint32(value)); baud > 0 {
+			current.BaudRate = baud
+			s.sendSettings(&Settings{BaudRate: baud})
+		}
+		reply := make([]byte, 4)
+		binary.BigEndian.PutUint32(reply, uint32(current.BaudRate))
+		s.reply(command, reply...)
+	case comPortSetDataSize:
+		if len(value) != 1 {
+			return
+		}
+
+		if 5 <= value[0] && value[0] <= 8 {
+			current.DataBits = int(value[0])
+			s.sendSettings(&Settings{DataBits: current.DataBits})
+		}
+		s.reply(command, byte(current.DataBits))
+	case comPortSetParity:
+		if len(value) != 1 {
+			return
+		}
+
+		if 1 <= value[0] && int(value[0]) < len(rfc2217Parity) {
+			current.Parity = rfc2217Parity[value[0]]
+			s.sendSettings(&Settings{Parity: current.Parity})
+		}
+		s.reply(command, parityToRFC2217(current.Parity))
+	case comPortSetStopSize:
+		if len(value) != 1 {
+			return
+		}
+
+		// 1.5 stop bits (3) is not supported and answered with the
+		// current setting
+		if value[0] == 1 || value[0] == 2 {
+			current.StopBits = int(value[0])
+			s.sendSettings(&Settings{StopBits: current.StopBits})
+		}
+		s.reply(command, byte(current.StopBits))
+	case comPortSetControl:
+		if len(value) != 1 {
+			return
+		}
+		s.control(value[0], &current)
+	case comPortSetLineStateMask:
+		if len(value) == 1 {
+			s.mu.Lock()
+			s.lineMask = value[0]
+			s.mu.Unlock()
+		}
+		s.reply(command, value...)
+	case comPortSetModemStateMask:
+		if len(value) == 1 {
+			s.mu.Lock()
+			s.modemMask = value[0]
+			s.mu.Unlock()
+		}
+		s.reply(command, value...)
+	case comPortFlowSuspend, comPortFlowResume, comPortPurgeData:
+		s.reply(command, value...)
+	default:
+		Logger.Printf("RFC 2217: ignoring unknown command %d", command)
+	}
+
+	s.mu.Lock()
+	s.settings = current
+	s.mu.Unlock()
+}
+
+func (s *rfc2217Server) control(value byte, current *Settings) {
+	s.mu.Lock()
+	lines := s.lines
+	breaking := !s.breakStart.IsZero()
+	s.mu.Unlock()
+
+	reply := value
+	switch value {
+	case controlFlowRequest, controlInFlowReq:
+		reply = flowToRFC2217(current.FlowControl)
+		if value == controlInFlowReq && reply != 0 {
+			reply += controlInFlowNone - controlFlowNone
+		}
+	case controlFlowNone, controlFlowXonXoff, controlFlowHardware:
+		current.FlowControl = map[byte]FlowControl{
+			controlFlowNone:     FlowNone,
+			controlFlowXonXoff:  FlowSoftware,
+			controlFlowHardware: FlowHardware,
+		}[value]
+		s.sendSettings(&Settings{FlowControl: current.FlowControl})
+	case controlBreakRequest:
+		reply = controlBreakOff
+		if breaking {
+			reply = controlBreakOn
+		}
+	case controlBreakOn:
+		s.mu.Lock()
+		s.breakStart = time.Now()
+		s.mu.Unlock()
+	case controlBreakOff:
+		// the BREAK is sent to the remote device once its length is known
+		s.mu.Lock()
+		duration := time.Since(s.breakStart)
+		s.breakStart = time.Time{}
+		s.mu.Unlock()
+
+		if breaking {
+			if duration < time.Millisecond {
+				duration = time.Millisecond
+			} else if duration > maxBreak {
+				duration = maxBreak
+			}
+			s.sendBreak(duration)
+		}
+	case controlDTRRequest:
+		reply = controlDTROff
+		if lines&LineDTR != 0 {
+			reply = controlDTROn
+		}
+	case controlDTROn, controlDTROff:
+		dtr := ModemLines(0)
+		if value == controlDTROn {
+			dtr = LineDTR
+		}
+		s.sendModemLines(dtr, LineDTR)
+	case controlRTSRequest:
+		reply = controlRTSOff
+		if lines&LineRTS != 0 {
+			reply = controlRTSOn
+		}
+	case controlRTSOn, controlRTSOff:
+		rts := ModemLines(0)
+		if value == controlRTSOn {
+			rts = LineRTS
+		}
+		s.sendModemLines(rts, LineRTS)
+	}
+	s.reply(comPortSetControl, reply)
+}
+
+// SetSettings records the settings of the remote device so that they
+// can be reported to the client
+func (s *rfc2217Server) SetSettings(settings *Settings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings.merge(settings)
+	return nil
+}
+
+// SetModemLines notifies the client of changes to the input lines
+func (s *rfc2217Server) SetModemLines(lines, mask ModemLines) error {
+	mask &= InputLines
+	if mask == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	previous := s.lines
+	s.lines = s.lines&^mask | lines&mask
+	state := modemState(s.lines, previous) & s.modemMask
+	s.mu.Unlock()
+
+	if !s.enabled(telnetComPort, false) {
+		return nil
+	}
+	return s.sendSubnegotiation(telnetComPort, []byte{comPortNotifyModemState + comPortServer, state})
+}
+
+// SendBreak notifies the client of a BREAK received by the remote
+// device.  A client cannot be sent a BREAK, so other requests are
+// ignored
+func (s *rfc2217Server) SendBreak(duration time.Duration) error {
+	s.mu.Lock()
+	notify := s.lineMask&lineStateBreak != 0
+	s.mu.Unlock()
+
+	if duration != 0 || !notify || !s.enabled(telnetComPort, false) {
+		return nil
+	}
+	return s.sendSubnegotiation(telnetComPort, []byte{comPortNotifyLineState + comPortServer, lineStateBreak})
+}
+
+// serveRFC2217 accepts RFC 2217 clients on listener and adds them to
+// the link until the listener is closed
+func serveRFC2217(listener net.Listener, l *link) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			Logger.Printf("%s: RFC 2217 listener stopped: %v", l.name, err)
+			return
+		}
+
+		Logger.Printf("%s: RFC 2217 client connected from %v", l.name, conn.RemoteAddr())
+		go func() {
+			s := newRFC2217Server(conn)
+			err := s.start()
+			if err == nil {
+				err = l.add(s)
+			}
+			Logger.Printf("%s: RFC 2217 client %v disconnected: %v", l.name, conn.RemoteAddr(), err)
+			conn.Close()
+		}()
+	}
+}
+
+// rfc2217Client is an endpoint for a device on a terminal server.  With
+// comPort set the line settings, modem lines and BREAKs are exchanged
+// using RFC 2217, otherwise only data is passed over the telnet
+// connection
+type rfc2217Client struct {
+	*telnetConn
+
+	comPort bool
+	mu      sync.Mutex
+	events  lineEvents
+	lines   ModemLines
+
+	// answered is closed once the terminal server has answered the
+	// COM-PORT-OPTION request, or failed to within comPortTimeout
+	answered   chan struct{}
+	answerOnce sync.Once
+	noAnswer   bool
+}
+
+// comPortTimeout is how long COM-PORT-OPTION commands wait for the
+// terminal server to agree to the option
+var comPortTimeout = 10 * time.Second
+
+func newRFC2217Client(conn net.Conn, comPort bool) *rfc2217Client {
+	c := &rfc2217Client{
+		telnetConn: newTelnetConn(conn),
+		comPort:    comPort,
+		answered:   make(chan struct{}),
+	}
+
+	c.supported = func(option byte, local bool) bool {
+		switch option {
+		case telnetBinary, telnetSGA:
+			return true
+		case telnetComPort:
+			return local && comPort
+		}
+		return false
+	}
+	c.onSubnegotiation = c.subnegotiation
+	c.onNegotiate = c.negotiated
+	return c
+}
+
+func (c *rfc2217Client) start() error {
+	requests := [][2]byte{
+		{telnetWILL, telnetBinary},
+		{telnetDO, telnetBinary},
+		{telnetWILL, telnetSGA},
+		{telnetDO, telnetSGA},
+	}
+
+	if c.comPort {
+		requests = append(requests, [2]byte{telnetWILL, telnetComPort})
+	}
+
+	for _, req := range requests {
+		if err := c.request(req[0], req[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// negotiated asks for the modem and line state notifications once the
+// terminal server has agreed to COM-PORT-OPTION
+func (c *rfc2217Client) negotiated(option byte, local, enabled bool) {
+	if option != telnetComPort || !local || !c.comPort {
+		return
+	}
+
+	first := false
+	c.answerOnce.Do(func() {
+		first = true
+		close(c.answered)
+	})
+
+	if !first {
+		return
+	}
+
+	if !enabled {
+		Logger.Printf("RFC 2217: the terminal server refused COM-PORT-OPTION")
+		return
+	}
+	c.command(comPortSetModemStateMask, 0xff)
+	c.command(comPortSetLineStateMask, lineStateBreak)
+}
+
+func (c *rfc2217Client) watch(events lineEvents) {
+	c.mu.Lock()
+	c.events = events
+	c.mu.Unlock()
+}
+
+// command sends a COM-PORT-OPTION command once the terminal server has
+// agreed to the option.  Commands fail when it refused or did not answer,
+// they would otherwise end up in the data of a plain telnet server
+func (c *rfc2217Client) command(command byte, value ...byte) error {
+	if !c.comPort {
+		return nil
+	}
+
+	select {
+	case <-c.answered:
+	case <-time.After(comPortTimeout):
+		c.answerOnce.Do(func() {
+			c.noAnswer = true
+			close(c.answered)
+		})
+	}
+
+	if c.noAnswer {
+		return fmt.Errorf("The terminal server did not answer the RFC 2217 COM-PORT-OPTION request")
+	} else if !c.enabled(telnetComPort, true) {
+		return fmt.Errorf("The terminal server refused RFC 2217 COM-PORT-OPTION, connect with telnet:// instead")
+	}
+	return c.sendSubnegotiation(telnetComPort, append([]byte{command}, value...))
+}
+
+func (c *rfc2217Client) subnegotiation(option byte, data []byte) {
+	if option != telnetComPort || len(data) < 1 || data[0] < comPortServer {
+		return
+	}
+
+	command, value := data[0]-comPortServer, data[1:]
+	c.mu.Lock()
+	events := c.events
+	c.mu.Unlock()
+
+	switch command {
+	case comPortNotifyModemState:
+		if len(value) != 1 {
+			return
+		}
+
+		lines := ModemLines(0)
+		for _, bit := range []struct {
+			state byte
+			line  ModemLines
+		}{
+			{modemStateCTS, LineCTS},
+			{modemStateDSR, LineDSR},
+			{modemStateRI, LineRI},
+			{modemStateDCD, LineDCD},
+		} {
+			if value[0]&bit.state != 0 {
+				lines |= bit.line
+			}
+		}
+
+		if events != nil {
+			events.sendModemLines(lines, InputLines)
+		}
+	case comPortNotifyLineState:
+		if len(value) == 1 && value[0]&lineStateBreak != 0 && events != nil {
+			events.sendBreak(0)
+		}
+	default:
+		Logger.Printf("RFC 2217: server acknowledged command %d %x", command, value)
+	}
+}
+
+// SetSettings sends the line settings to the terminal server
+func (c *rfc2217Client) SetSettings(settings *Settings) (err error) {
+	if settings.BaudRate > 0 {
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, uint32(settings.BaudRate))
+		err = c.command(comPortSetBaudRate, value...)
+	}
+
+	if err == nil && settings.DataBits > 0 {
+		err = c.command(comPortSetDataSize, byte(settings.DataBits))
+	}
+
+	if err == nil && settings.Parity != 0 {
+		err = c.command(comPortSetParity, parityToRFC2217(settings.Parity))
+	}
+
+	if err == nil && settings.StopBits > 0 {
+		err = c.command(comPortSetStopSize, byte(settings.StopBits))
+	}
+
+	if err == nil && settings.FlowControl != "" {
+		err = c.command(comPortSetControl, flowToRFC2217(settings.FlowControl))
+	}
+	return err
+}
+
+// SetModemLines asks the terminal server to change the DTR and RTS lines
+func (c *rfc2217Client) SetModemLines(lines, mask ModemLines) (err error) {
+	if mask&LineDTR != 0 {
+		value := byte(controlDTROff)
+		if lines&LineDTR != 0 {
+			value = controlDTROn
+		}
+		err = c.command(comPortSetControl, value)
+	}
+
+	if err == nil && mask&LineRTS != 0 {
+		value := byte(controlRTSOff)
+		if lines&LineRTS != 0 {
+			value = controlRTSOn
+		}
+		err = c.command(comPortSetControl, value)
+	}
+	return err
+}
+
+// SendBreak asks the terminal server to assert a BREAK
+func (c *rfc2217Client) SendBreak(duration time.Duration) error {
+	if duration == 0 {
+		return nil
+	}
+
+	err := c.command(comPortSetControl, controlBreakOn)
+	if err == nil {
+		time.Sleep(duration)
+		err = c.command(comPortSetControl, controlBreakOff)
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package rcom
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// telnetPeer collects what the other end of conn writes
+type telnetPeer struct {
+	net.Conn
+	received chan []byte
+	buf      []byte
+}
+
+func newTelnetPeer(conn net.Conn) *telnetPeer {
+	p := &telnetPeer{Conn: conn, received: make(chan []byte, 64)}
+	go func() {
+		defer close(p.received)
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				p.received <- append([]byte{}, buf[0:n]...)
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// expect waits until want has been received
+func (p *telnetPeer) expect(t *testing.T, want []byte) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		if i := bytes.Index(p.buf, want); i >= 0 {
+			p.buf = p.buf[i+len(want):]
+			return
+		}
+
+		select {
+		case b, ok := <-p.received:
+			if !ok {
+				t.Fatalf("connection closed before receiving %x, got %x", want, p.buf)
+			}
+			p.buf = append(p.buf, b...)
+		case <-timeout:
+			t.Fatalf("timed out waiting for %x, got %x", want, p.buf)
+		}
+	}
+}
+
+func comPortCommand(command byte, value ...byte) []byte {
+	b := append([]byte{telnetIAC, telnetSB, telnetComPort, command}, telnetEscape(value)...)
+	return append(b, telnetIAC, telnetSE)
+}
+
+func TestRFC2217ServerInitialSettings(t *testing.T) {
+	conn, c := net.Pipe()
+	defer c.Close()
+	peer := newTelnetPeer(c)
+
+	// the settings of the remote device are known before the client
+	// connects
+	l := newLink("dev", nil, nil)
+	var frame bytes.Buffer
+	writeFrame(&frame, settingsFrame, []byte("9600,7E2,rtscts"))
+	if err := l.copyIn(&frame); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newRFC2217Server(conn)
+	go func() {
+		if s.start() == nil {
+			l.add(s)
+		}
+		conn.Close()
+	}()
+
+	peer.Write([]byte{telnetIAC, telnetWILL, telnetComPort})
+	peer.expect(t, []byte{telnetIAC, telnetDO, telnetComPort})
+
+	queries := []struct {
+		command byte
+		value   []byte
+		want    []byte
+	}{
+		{comPortSetBaudRate, []byte{0, 0, 0, 0}, []byte{0, 0, 0x25, 0x80}},
+		{comPortSetDataSize, []byte{0}, []byte{7}},
+		{comPortSetParity, []byte{0}, []byte{parityToRFC2217(ParityEven)}},
+		{comPortSetStopSize, []byte{0}, []byte{2}},
+		{comPortSetControl, []byte{controlFlowRequest}, []byte{controlFlowHardware}},
+	}
+
+	for _, query := range queries {
+		peer.Write(comPortCommand(query.command, query.value...))
+		peer.expect(t, comPortCommand(query.command+comPortServer, query.want...))
+	}
+}
+
+// startRFC2217Client starts a client on conn and processes what it reads
+// until conn is closed
+func startRFC2217Client(t *testing.T, conn net.Conn) *rfc2217Client {
+	t.Helper()
+	c := newRFC2217Client(conn, true)
+	if err := c.start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := c.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func TestRFC2217ClientRefused(t *testing.T) {
+	conn, p := net.Pipe()
+	defer conn.Close()
+	peer := newTelnetPeer(p)
+
+	c := startRFC2217Client(t, conn)
+	errs := make(chan error, 1)
+	go func() { errs <- c.SetSettings(&Settings{BaudRate: 9600}) }()
+
+	// a plain telnet server refuses the option
+	peer.expect(t, []byte{telnetIAC, telnetWILL, telnetComPort})
+	peer.Write([]byte{telnetIAC, telnetDONT, telnetComPort})
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatalf("SetSettings succeeded with COM-PORT-OPTION refused")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SetSettings did not return")
+	}
+
+	peer.Close()
+	for b := range peer.received {
+		peer.buf = append(peer.buf, b...)
+	}
+
+	if bytes.Contains(peer.buf, []byte{telnetIAC, telnetSB, telnetComPort}) {
+		t.Errorf("COM-PORT-OPTION subnegotiation was sent after the option was refused: %x", peer.buf)
+	}
+}
+
+func TestRFC2217ClientAgreed(t *testing.T) {
+	conn, p := net.Pipe()
+	defer conn.Close()
+	peer := newTelnetPeer(p)
+
+	c := startRFC2217Client(t, conn)
+	errs := make(chan error, 1)
+	go func() { errs <- c.SetSettings(&Settings{BaudRate: 9600}) }()
+
+	peer.expect(t, []byte{telnetIAC, telnetWILL, telnetComPort})
+	peer.Write([]byte{telnetIAC, telnetDO, telnetComPort})
+	peer.expect(t, comPortCommand(comPortSetModemStateMask, 0xff))
+	peer.expect(t, comPortCommand(comPortSetLineStateMask, lineStateBreak))
+	peer.expect(t, comPortCommand(comPortSetBaudRate, 0, 0, 0x25, 0x80))
+
+	if err := <-errs; err != nil {
+		t.Errorf("SetSettings failed: %v", err)
+	}
+}
+
+func TestRFC2217ClientNoAnswer(t *testing.T) {
+	defer func(timeout time.Duration) { comPortTimeout = timeout }(comPortTimeout)
+	comPortTimeout = 50 * time.Millisecond
+
+	conn, p := net.Pipe()
+	defer conn.Close()
+	newTelnetPeer(p)
+
+	c := startRFC2217Client(t, conn)
+	if err := c.SendBreak(time.Millisecond); err == nil {
+		t.Errorf("SendBreak succeeded without an answer to COM-PORT-OPTION")
+	}
+}
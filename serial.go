@@ -0,0 +1,224 @@
+package rcom
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Parity byte
+
+const (
+	ParityNone  Parity = 'N'
+	ParityOdd   Parity = 'O'
+	ParityEven  Parity = 'E'
+	ParityMark  Parity = 'M'
+	ParitySpace Parity = 'S'
+)
+
+func (p Parity) valid() bool {
+	switch p {
+	case ParityNone, ParityOdd, ParityEven, ParityMark, ParitySpace:
+		return true
+	}
+	return false
+}
+
+type FlowControl string
+
+const (
+	FlowNone     FlowControl = "none"
+	FlowHardware FlowControl = "rtscts"
+	FlowSoftware FlowControl = "xonxoff"
+)
+
+// Settings describes the line parameters of a serial device.  Zero
+// values mean the corresponding parameter is left unchanged on the
+// device.
+type Settings struct {
+	BaudRate    int
+	DataBits    int
+	Parity      Parity
+	StopBits    int
+	FlowControl FlowControl
+}
+
+// ParseSettings parses a line description such as "115200 8N1" or
+// "115200,8N1,rtscts".  Any of the baud rate, framing or flow control
+// may be omitted and a '-' in the framing leaves that part unchanged
+// (ex: "--2" only sets two stop bits).
+func ParseSettings(str string) (*Settings, error) {
+	settings := &Settings{}
+	fields := strings.FieldsFunc(str, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Invalid serial settings %q", str)
+	}
+
+	for _, field := range fields {
+		if baud, err := strconv.Atoi(field); err == nil {
+			if baud < 1 {
+				return nil, fmt.Errorf("Invalid baud rate %d", baud)
+			}
+			settings.BaudRate = baud
+			continue
+		}
+
+		switch flow := FlowControl(strings.ToLower(field)); flow {
+		case FlowNone, FlowHardware, FlowSoftware:
+			settings.FlowControl = flow
+			continue
+		}
+
+		if len(field) != 3 {
+			return nil, fmt.Errorf("Invalid serial settings %q", field)
+		}
+
+		field = strings.ToUpper(field)
+		if field[0] != '-' {
+			settings.DataBits = int(field[0] - '0')
+			if settings.DataBits < 5 || 8 < settings.DataBits {
+				return nil, fmt.Errorf("Invalid data bits in %q: valid values are 5-8", field)
+			}
+		}
+
+		if field[1] != '-' {
+			settings.Parity = Parity(field[1])
+			if !settings.Parity.valid() {
+				return nil, fmt.Errorf("Invalid parity in %q: valid values are N, O, E, M and S", field)
+			}
+		}
+
+		if field[2] != '-' {
+			settings.StopBits = int(field[2] - '0')
+			if settings.StopBits != 1 && settings.StopBits != 2 {
+				return nil, fmt.Errorf("Invalid stop bits in %q: valid values are 1 and 2", field)
+			}
+		}
+	}
+	return settings, nil
+}
+
+func (s *Settings) String() string {
+	fields := []string{}
+	if s.BaudRate > 0 {
+		fields = append(fields, strconv.Itoa(s.BaudRate))
+	}
+
+	if s.DataBits > 0 || s.Parity != 0 || s.StopBits > 0 {
+		framing := []byte("---")
+		if s.DataBits > 0 {
+			framing[0] = byte('0' + s.DataBits)
+		}
+
+		if s.Parity != 0 {
+			framing[1] = byte(s.Parity)
+		}
+
+		if s.StopBits > 0 {
+			framing[2] = byte('0' + s.StopBits)
+		}
+		fields = append(fields, string(framing))
+	}
+
+	if s.FlowControl != "" {
+		fields = append(fields, string(s.FlowControl))
+	}
+	return strings.Join(fields, ",")
+}
+
+// merge sets the parameters that are known in other
+func (s *Settings) merge(other *Settings) {
+	if other.BaudRate > 0 {
+		s.BaudRate = other.BaudRate
+	}
+
+	if other.DataBits > 0 {
+		s.DataBits = other.DataBits
+	}
+
+	if other.Parity != 0 {
+		s.Parity = other.Parity
+	}
+
+	if other.StopBits > 0 {
+		s.StopBits = other.StopBits
+	}
+
+	if other.FlowControl != "" {
+		s.FlowControl = other.FlowControl
+	}
+}
+
+// diff returns the settings in other that differ from s, or nil if
+// there is no difference.  Parameters that are unknown in other are
+// never reported as changed
+func (s *Settings) diff(other *Settings) *Settings {
+	changed := &Settings{}
+	if other.BaudRate != s.BaudRate {
+		changed.BaudRate = other.BaudRate
+	}
+
+	if other.DataBits != 0 && other.DataBits != s.DataBits {
+		changed.DataBits = other.DataBits
+	}
+
+	if other.Parity != 0 && other.Parity != s.Parity {
+		changed.Parity = other.Parity
+	}
+
+	if other.StopBits != 0 && other.StopBits != s.StopBits {
+		changed.StopBits = other.StopBits
+	}
+
+	if other.FlowControl != "" && other.FlowControl != s.FlowControl {
+		changed.FlowControl = other.FlowControl
+	}
+
+	if *changed == (Settings{}) {
+		return nil
+	}
+	return changed
+}
+
+// ModemLines is a bit set of the modem control and status lines of a
+// serial device.  DTR and RTS are outputs and can be changed, the
+// remaining lines are inputs reported by the device
+type ModemLines uint16
+
+const (
+	LineDTR ModemLines = 1 << iota
+	LineRTS
+	LineCTS
+	LineDSR
+	LineDCD
+	LineRI
+
+	OutputLines = LineDTR | LineRTS
+	InputLines  = LineCTS | LineDSR | LineDCD | LineRI
+)
+
+var lineNames = []struct {
+	line ModemLines
+	name string
+}{
+	{LineDTR, "DTR"},
+	{LineRTS, "RTS"},
+	{LineCTS, "CTS"},
+	{LineDSR, "DSR"},
+	{LineDCD, "DCD"},
+	{LineRI, "RI"},
+}
+
+func (ml ModemLines) String() string {
+	names := []string{}
+	for _, ln := range lineNames {
+		if ml&ln.line != 0 {
+			names = append(names, ln.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
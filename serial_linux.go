@@ -0,0 +1,268 @@
+//go:build linux
+// +build linux
+
+package rcom
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var baudRates = map[int]uint32{
+	50:      unix.B50,
+	75:      unix.B75,
+	110:     unix.B110,
+	134:     unix.B134,
+	150:     unix.B150,
+	200:     unix.B200,
+	300:     unix.B300,
+	600:     unix.B600,
+	1200:    unix.B1200,
+	1800:    unix.B1800,
+	2400:    unix.B2400,
+	4800:    unix.B4800,
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	500000:  unix.B500000,
+	576000:  unix.B576000,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+	1152000: unix.B1152000,
+	1500000: unix.B1500000,
+	2000000: unix.B2000000,
+	2500000: unix.B2500000,
+	3000000: unix.B3000000,
+	3500000: unix.B3500000,
+	4000000: unix.B4000000,
+}
+
+// getTermios2 reads the termios of fd in the layout that carries the
+// input and output speeds as plain integers, allowing non-standard baud
+// rates via BOTHER
+func getTermios2(fd uintptr) (*unix.Termios, error) {
+	t := &unix.Termios{}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, ioctlGetTermios2, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return nil, errno
+	}
+	return t, nil
+}
+
+func setTermios2(fd uintptr, t *unix.Termios) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, ioctlSetTermios2, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func applySettings(fd uintptr, settings *Settings) error {
+	t, err := getTermios2(fd)
+	if err != nil {
+		return err
+	}
+
+	if settings.BaudRate > 0 {
+		speed, found := baudRates[settings.BaudRate]
+		if !found {
+			speed = unix.BOTHER
+		}
+		t.Cflag &^= unix.CBAUD | unix.CIBAUD
+		t.Cflag |= speed | speed<<unix.IBSHIFT
+		t.Ispeed = uint32(settings.BaudRate)
+		t.Ospeed = uint32(settings.BaudRate)
+	}
+
+	if settings.DataBits > 0 {
+		t.Cflag &^= unix.CSIZE
+		switch settings.DataBits {
+		case 5:
+			t.Cflag |= unix.CS5
+		case 6:
+			t.Cflag |= unix.CS6
+		case 7:
+			t.Cflag |= unix.CS7
+		default:
+			t.Cflag |= unix.CS8
+		}
+	}
+
+	if settings.Parity != 0 {
+		t.Cflag &^= unix.PARENB | unix.PARODD | unix.CMSPAR
+		switch settings.Parity {
+		case ParityOdd:
+			t.Cflag |= unix.PARENB | unix.PARODD
+		case ParityEven:
+			t.Cflag |= unix.PARENB
+		case ParityMark:
+			t.Cflag |= unix.PARENB | unix.PARODD | unix.CMSPAR
+		case ParitySpace:
+			t.Cflag |= unix.PARENB | unix.CMSPAR
+		}
+	}
+
+	if settings.StopBits == 1 {
+		t.Cflag &^= unix.CSTOPB
+	} else if settings.StopBits == 2 {
+		t.Cflag |= unix.CSTOPB
+	}
+
+	switch settings.FlowControl {
+	case FlowNone:
+		t.Cflag &^= unix.CRTSCTS
+		t.Iflag &^= unix.IXON | unix.IXOFF | unix.IXANY
+	case FlowHardware:
+		t.Cflag |= unix.CRTSCTS
+		t.Iflag &^= unix.IXON | unix.IXOFF | unix.IXANY
+	case FlowSoftware:
+		t.Cflag &^= unix.CRTSCTS
+		t.Iflag |= unix.IXON | unix.IXOFF
+	}
+
+	t.Cflag |= unix.CREAD | unix.CLOCAL
+	return setTermios2(fd, t)
+}
+
+func readSettings(fd uintptr) (*Settings, error) {
+	t, err := getTermios2(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &Settings{
+		BaudRate:    int(t.Ospeed),
+		Parity:      ParityNone,
+		StopBits:    1,
+		FlowControl: FlowNone,
+	}
+
+	switch t.Cflag & unix.CSIZE {
+	case unix.CS5:
+		settings.DataBits = 5
+	case unix.CS6:
+		settings.DataBits = 6
+	case unix.CS7:
+		settings.DataBits = 7
+	default:
+		settings.DataBits = 8
+	}
+
+	if t.Cflag&unix.PARENB != 0 {
+		switch t.Cflag & (unix.PARODD | unix.CMSPAR) {
+		case unix.PARODD:
+			settings.Parity = ParityOdd
+		case unix.CMSPAR | unix.PARODD:
+			settings.Parity = ParityMark
+		case unix.CMSPAR:
+			settings.Parity = ParitySpace
+		default:
+			settings.Parity = ParityEven
+		}
+	}
+
+	if t.Cflag&unix.CSTOPB != 0 {
+		settings.StopBits = 2
+	}
+
+	if t.Cflag&unix.CRTSCTS != 0 {
+		settings.FlowControl = FlowHardware
+	} else if t.Iflag&(unix.IXON|unix.IXOFF) != 0 {
+		settings.FlowControl = FlowSoftware
+	}
+	return settings, nil
+}
+
+// enableBreakDetection makes the line discipline mark a received BREAK
+// with the sequence \377 \0 \0 in the input stream instead of
+// discarding it or raising SIGINT.  A literal \377 is read as \377 \377
+func enableBreakDetection(fd uintptr) error {
+	t, err := getTermios2(fd)
+	if err == nil {
+		t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.IGNPAR
+		t.Iflag |= unix.PARMRK
+		err = setTermios2(fd, t)
+	}
+	return err
+}
+
+func sendBreak(fd uintptr, duration time.Duration) error {
+	err := unix.IoctlSetInt(int(fd), unix.TIOCSBRK, 0)
+	if err == nil {
+		time.Sleep(duration)
+		err = unix.IoctlSetInt(int(fd), unix.TIOCCBRK, 0)
+	}
+	return err
+}
+
+// enablePacketMode puts the master side of a pty into packet mode and
+// sets EXTPROC on the slave so that every termios change made on the
+// slave is reported with TIOCPKT_IOCTL on the next read of the master
+func enablePacketMode(fd uintptr) error {
+	t, err := getTermios2(fd)
+	if err == nil {
+		t.Lflag |= unix.EXTPROC
+		err = setTermios2(fd, t)
+	}
+
+	if err == nil {
+		err = unix.IoctlSetPointerInt(int(fd), unix.TIOCPKT, 1)
+	}
+	return err
+}
+
+var modemBits = []struct {
+	line ModemLines
+	bit  int
+}{
+	{LineDTR, unix.TIOCM_DTR},
+	{LineRTS, unix.TIOCM_RTS},
+	{LineCTS, unix.TIOCM_CTS},
+	{LineDSR, unix.TIOCM_DSR},
+	{LineDCD, unix.TIOCM_CD},
+	{LineRI, unix.TIOCM_RI},
+}
+
+func toTIOCM(lines ModemLines) (bits int) {
+	for _, mb := range modemBits {
+		if lines&mb.line != 0 {
+			bits |= mb.bit
+		}
+	}
+	return bits
+}
+
+func getModemLines(fd uintptr) (lines ModemLines, err error) {
+	bits, err := unix.IoctlGetInt(int(fd), unix.TIOCMGET)
+	if err == nil {
+		for _, mb := range modemBits {
+			if bits&mb.bit != 0 {
+				lines |= mb.line
+			}
+		}
+	}
+	return lines, err
+}
+
+// setModemLines changes the lines in mask to the state given in lines
+func setModemLines(fd uintptr, lines, mask ModemLines) (err error) {
+	if set := toTIOCM(lines & mask); set != 0 {
+		err = unix.IoctlSetPointerInt(int(fd), unix.TIOCMBIS, set)
+	}
+
+	if clear := toTIOCM(^lines & mask); err == nil && clear != 0 {
+		err = unix.IoctlSetPointerInt(int(fd), unix.TIOCMBIC, clear)
+	}
+	return err
+}
+
+// waitModemLines blocks until one of the input lines changes state
+func waitModemLines(fd uintptr) error {
+	return unix.IoctlSetInt(int(fd), unix.TIOCMIWAIT, toTIOCM(InputLines))
+}
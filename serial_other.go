@@ -0,0 +1,43 @@
+//go:build !linux
+// +build !linux
+
+package rcom
+
+import (
+	"errors"
+	"time"
+)
+
+var errSerialUnsupported = errors.New("Serial line settings are not supported on this platform")
+
+func applySettings(fd uintptr, settings *Settings) error {
+	return errSerialUnsupported
+}
+
+func readSettings(fd uintptr) (*Settings, error) {
+	return nil, errSerialUnsupported
+}
+
+func enablePacketMode(fd uintptr) error {
+	return errSerialUnsupported
+}
+
+func getModemLines(fd uintptr) (ModemLines, error) {
+	return 0, errSerialUnsupported
+}
+
+func setModemLines(fd uintptr, lines, mask ModemLines) error {
+	return errSerialUnsupported
+}
+
+func waitModemLines(fd uintptr) error {
+	return errSerialUnsupported
+}
+
+func enableBreakDetection(fd uintptr) error {
+	return errSerialUnsupported
+}
+
+func sendBreak(fd uintptr, duration time.Duration) error {
+	return errSerialUnsupported
+}
@@ -0,0 +1,13 @@
+//go:build linux && !ppc64 && !ppc64le
+// +build linux,!ppc64,!ppc64le
+
+package rcom
+
+import "golang.org/x/sys/unix"
+
+// unix.Termios is struct termios2 from asm-generic/termbits.h, which is
+// read and written with TCGETS2 and TCSETS2
+const (
+	ioctlGetTermios2 = unix.TCGETS2
+	ioctlSetTermios2 = unix.TCSETS2
+)
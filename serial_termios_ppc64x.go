@@ -0,0 +1,14 @@
+//go:build linux && (ppc64 || ppc64le)
+// +build linux
+// +build ppc64 ppc64le
+
+package rcom
+
+import "golang.org/x/sys/unix"
+
+// powerpc has no termios2, its struct termios already carries the input
+// and output speeds and is read and written with TCGETS and TCSETS
+const (
+	ioctlGetTermios2 = unix.TCGETS
+	ioctlSetTermios2 = unix.TCSETS
+)
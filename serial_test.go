@@ -0,0 +1,78 @@
+package rcom
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSettings(t *testing.T) {
+	tests := []struct {
+		input string
+		want  *Settings
+	}{
+		{"115200", &Settings{BaudRate: 115200}},
+		{"115200 8N1", &Settings{BaudRate: 115200, DataBits: 8, Parity: ParityNone, StopBits: 1}},
+		{"115200,8N1,rtscts", &Settings{BaudRate: 115200, DataBits: 8, Parity: ParityNone, StopBits: 1, FlowControl: FlowHardware}},
+		{"7e2", &Settings{DataBits: 7, Parity: ParityEven, StopBits: 2}},
+		{"--2", &Settings{StopBits: 2}},
+		{"-M-", &Settings{Parity: ParityMark}},
+		{"7--", &Settings{DataBits: 7}},
+		{"XONXOFF", &Settings{FlowControl: FlowSoftware}},
+		{"9600,none", &Settings{BaudRate: 9600, FlowControl: FlowNone}},
+	}
+
+	for _, test := range tests {
+		got, err := ParseSettings(test.input)
+		if err != nil {
+			t.Errorf("ParseSettings(%q) failed: %v", test.input, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseSettings(%q) = %+v, want %+v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseSettingsInvalid(t *testing.T) {
+	for _, input := range []string{"", " , ", "0", "-9600", "9N1", "4N1", "8X1", "8N3", "8N0", "8N", "8N1x", "fast", "8\x001"} {
+		if got, err := ParseSettings(input); err == nil {
+			t.Errorf("ParseSettings(%q) = %+v, want an error", input, got)
+		}
+	}
+}
+
+func TestSettingsString(t *testing.T) {
+	for _, input := range []string{"115200", "115200,8N1", "9600,7E2,rtscts", "--2", "-O-", "xonxoff"} {
+		settings, err := ParseSettings(input)
+		if err != nil {
+			t.Fatalf("ParseSettings(%q) failed: %v", input, err)
+		}
+
+		again, err := ParseSettings(settings.String())
+		if err != nil {
+			t.Errorf("ParseSettings(%q) failed: %v", settings.String(), err)
+		} else if !reflect.DeepEqual(settings, again) {
+			t.Errorf("%q round trips as %+v, want %+v", input, again, settings)
+		}
+	}
+}
+
+func TestSettingsDiff(t *testing.T) {
+	current := &Settings{BaudRate: 9600, DataBits: 8, Parity: ParityNone, StopBits: 1, FlowControl: FlowNone}
+	tests := []struct {
+		other *Settings
+		want  *Settings
+	}{
+		{&Settings{BaudRate: 9600, DataBits: 8, Parity: ParityNone, StopBits: 1, FlowControl: FlowNone}, nil},
+		{&Settings{BaudRate: 115200, DataBits: 8, Parity: ParityNone, StopBits: 1, FlowControl: FlowNone}, &Settings{BaudRate: 115200}},
+		{&Settings{BaudRate: 9600, DataBits: 7, Parity: ParityEven, StopBits: 2, FlowControl: FlowHardware}, &Settings{DataBits: 7, Parity: ParityEven, StopBits: 2, FlowControl: FlowHardware}},
+
+		// unknown parameters, such as the framing of a pty, are not changes
+		{&Settings{BaudRate: 9600, StopBits: 1, FlowControl: FlowNone}, nil},
+		{&Settings{BaudRate: 19200}, &Settings{BaudRate: 19200}},
+	}
+
+	for _, test := range tests {
+		if got := current.diff(test.other); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("diff(%v) = %v, want %v", test.other, got, test.want)
+		}
+	}
+}
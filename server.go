@@ -1,10 +1,13 @@
 package rcom
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
 type reader struct {
@@ -19,21 +22,55 @@ func (r reader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
-func Server(linkname string, force bool) error {
+// SendBreak asserts a BREAK for the given duration on the device
+// without otherwise changing its settings
+func SendBreak(device string, duration time.Duration, options ...ServerOption) error {
+	config, err := newServerConfig(options)
+	if err != nil {
+		return err
+	}
+
+	if _, err := config.access(device, true); err != nil {
+		return err
+	}
+
+	Logger.Printf("Sending BREAK to %s for %v", device, duration)
+	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sendBreak(f.Fd(), duration)
+}
+
+func Server(linkname string, force bool, settings *Settings, options ...ServerOption) error {
+	config, err := newServerConfig(options)
+	if err != nil {
+		return err
+	}
+
+	readOnly, err := config.access(linkname, changesDevice(linkname, force, settings))
+	if err != nil {
+		return err
+	}
+
 	Logger.Printf("Connecting server to %s", linkname)
-	p, err := newPort(linkname, force)
+	p, err := openPort(linkname, force, settings, readOnly)
 	if err != nil {
 		return err
 	}
 
+	l := newLink(linkname, frameStream{os.Stdout}, nil)
+	l.readOnly = readOnly
+	warnReadOnly(l)
 	done := make(chan interface{}, 3)
 	go func() {
-		io.Copy(p, os.Stdin)
+		l.copyIn(os.Stdin)
 		done <- true
 	}()
 
 	go func() {
-		io.Copy(os.Stdout, p)
+		l.add(p)
 		done <- true
 	}()
 
@@ -53,3 +90,120 @@ func Server(linkname string, force bool) error {
 	}
 	return nil
 }
+
+// PTYServer creates a pty linked to linkname and serves it for a device
+// that is opened on the client
+func PTYServer(linkname string, force bool, options ...ServerOption) error {
+	config, err := newServerConfig(options)
+	if err != nil {
+		return err
+	}
+
+	if _, err := config.access(linkname, true); err != nil {
+		return err
+	}
+
+	if !force {
+		if _, err := os.Lstat(linkname); err == nil {
+			return fmt.Errorf("%s already exists", linkname)
+		}
+	}
+	return Server(linkname, force, nil, options...)
+}
+
+// MuxServer serves several devices over a single stdin and stdout.  The
+// devices are given as path[:settings], settings defaults to the given
+// settings, and each device is carried on the stream numbered by its
+// position
+func MuxServer(devices []string, force bool, settings *Settings, options ...ServerOption) error {
+	if len(devices) > 65536 {
+		return fmt.Errorf("Too many devices to multiplex: %d", len(devices))
+	}
+
+	config, err := newServerConfig(options)
+	if err != nil {
+		return err
+	}
+
+	var ports []*port
+	closePorts := func() {
+		for _, p := range ports {
+			p.CloseTTY()
+		}
+	}
+
+	m := newMux(os.Stdout)
+	for i, device := range devices {
+		deviceSettings := settings
+		if strings.Contains(device, ":") {
+			fields := strings.SplitN(device, ":", 2)
+			device = fields[0]
+			var err error
+			deviceSettings, err = ParseSettings(fields[1])
+			if err != nil {
+				closePorts()
+				return fmt.Errorf("%s: %v", device, err)
+			}
+		}
+
+		readOnly, err := config.access(device, changesDevice(device, force, deviceSettings))
+		if err != nil {
+			closePorts()
+			return err
+		}
+
+		Logger.Printf("Connecting server to %s", device)
+		p, err := openPort(device, force, deviceSettings, readOnly)
+		if err != nil {
+			closePorts()
+			return err
+		}
+		ports = append(ports, p)
+
+		l := newLink(device, nil, nil)
+		l.readOnly = readOnly
+		warnReadOnly(l)
+		if err := m.attach(uint16(i), l); err != nil {
+			closePorts()
+			return err
+		}
+		go l.add(p)
+	}
+
+	done := make(chan interface{}, 2)
+	go func() {
+		m.run(os.Stdin)
+		done <- true
+	}()
+
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-ch
+		Logger.Printf("Server received %v", sig)
+		done <- true
+	}()
+	<-done
+	closePorts()
+	return nil
+}
+
+// openPort opens the device that is served.  Read-only devices are
+// opened without changing them, devices that would be changed are
+// refused read-only access by the access policy beforehand
+func openPort(device string, force bool, settings *Settings, readOnly bool) (*port, error) {
+	if readOnly {
+		return newReadOnlyPort(device)
+	}
+	return newPort(device, force, settings)
+}
+
+// warnReadOnly tells the client, through the stderr of the server, that
+// its input to the device of a read-only link is refused, and reports
+// the refused frames there
+func warnReadOnly(l *link) {
+	if l.readOnly {
+		fmt.Fprintf(os.Stderr, "%s is read-only, input to it is refused\n", l.name)
+		l.refusals = os.Stderr
+	}
+}
@@ -0,0 +1,373 @@
+package rcom
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// maxIncludeDepth limits nested Include directives in ssh_config
+const maxIncludeDepth = 16
+
+// sshConfigHost holds the ssh_config(5) values that apply to a host.
+// As with ssh the first value found for a keyword is used, except for
+// keywords such as IdentityFile that may be given more than once
+type sshConfigHost struct {
+	host   string
+	values map[string][]string
+}
+
+// multiValued keywords accumulate every value found
+var multiValued = map[string]bool{
+	"identityfile":    true,
+	"certificatefile": true,
+}
+
+func (h *sshConfigHost) get(keyword string) string {
+	if values := h.values[strings.ToLower(keyword)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (h *sshConfigHost) getAll(keyword string) []string {
+	return h.values[strings.ToLower(keyword)]
+}
+
+func (h *sshConfigHost) set(keyword string, args []string) {
+	keyword = strings.ToLower(keyword)
+	if multiValued[keyword] {
+		h.values[keyword] = append(h.values[keyword], args[0])
+	} else if _, found := h.values[keyword]; !found {
+		h.values[keyword] = args
+	}
+}
+
+// hostname returns the name to connect to, HostName when it is given.
+// Only %h (the host given) and %% may be used in HostName
+func (h *sshConfigHost) hostname() string {
+	if hostname := h.get("HostName"); hostname != "" {
+		return strings.NewReplacer("%h", h.host, "%%", "%").Replace(hostname)
+	}
+	return h.host
+}
+
+// expand substitutes ~ and the % tokens of ssh_config in value
+func (h *sshConfigHost) expand(value string, remoteUser string) string {
+	u, err := user.Current()
+	if err != nil {
+		return value
+	}
+
+	if value == "~" || strings.HasPrefix(value, "~/") {
+		value = filepath.Join(u.HomeDir, value[1:])
+	}
+
+	port := h.get("Port")
+	if port == "" {
+		port = "22"
+	}
+
+	if remoteUser == "" {
+		remoteUser = u.Username
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' || i == len(value)-1 {
+			sb.WriteByte(value[i])
+			continue
+		}
+
+		i++
+		switch value[i] {
+		case '%':
+			sb.WriteByte('%')
+		case 'd':
+			sb.WriteString(u.HomeDir)
+		case 'h':
+			sb.WriteString(h.hostname())
+		case 'n':
+			sb.WriteString(h.host)
+		case 'p':
+			sb.WriteString(port)
+		case 'r':
+			sb.WriteString(remoteUser)
+		case 'u':
+			sb.WriteString(u.Username)
+		default:
+			sb.WriteByte('%')
+			sb.WriteByte(value[i])
+		}
+	}
+	return sb.String()
+}
+
+// identityFiles returns the expanded IdentityFiles
+func (h *sshConfigHost) identityFiles(remoteUser string) (files []string) {
+	for _, file := range h.getAll("IdentityFile") {
+		files = append(files, h.expand(file, remoteUser))
+	}
+	return files
+}
+
+// knownHostsFiles expands the files of UserKnownHostsFile or
+// GlobalKnownHostsFile, "none" disables the files
+func (h *sshConfigHost) knownHostsFiles(files []string, remoteUser string) []string {
+	expanded := []string{}
+	for _, file := range files {
+		if strings.EqualFold(file, "none") {
+			return []string{}
+		}
+		expanded = append(expanded, h.expand(file, remoteUser))
+	}
+	return expanded
+}
+
+// lookupSSHConfig reads the ssh_config files, in order, and returns the
+// values that apply to host.  remoteUser is the login user if it was
+// given explicitly and is used for Match user
+func lookupSSHConfig(host string, remoteUser string, files ...string) (*sshConfigHost, error) {
+	h := &sshConfigHost{host: host, values: make(map[string][]string)}
+	for _, file := range files {
+		if err := h.read(file, filepath.Dir(file), remoteUser, 0); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// read applies the lines of file that match the host.  Relative Include
+// paths are found in base, the directory of the top level file
+func (h *sshConfigHost) read(file string, base string, remoteUser string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: too many nested Include directives", file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	active := true
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		keyword, args, err := parseSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", file, lineno, err)
+		}
+
+		if keyword == "" {
+			continue
+		}
+
+		switch strings.ToLower(keyword) {
+		case "host":
+			active = matchPatternList(args, h.host)
+		case "match":
+			active, err = h.match(args, remoteUser)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %v", file, lineno, err)
+			}
+		case "include":
+			if !active {
+				break
+			}
+
+			for _, pattern := range args {
+				pattern = h.expand(pattern, remoteUser)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(base, pattern)
+				}
+
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s line %d: %v", file, lineno, err)
+				}
+
+				for _, match := range matches {
+					if err := h.read(match, base, remoteUser, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			if active {
+				h.set(keyword, args)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// unsupportedMatch holds the Match criteria that have been logged as
+// unsupported, each is only logged once
+var unsupportedMatch = struct {
+	sync.Mutex
+	logged map[string]bool
+}{logged: make(map[string]bool)}
+
+// match evaluates the criteria of a Match line.  Criteria that can not
+// be evaluated the way ssh does, such as exec, are logged and the block
+// does not match rather than matching differently
+func (h *sshConfigHost) match(args []string, remoteUser string) (bool, error) {
+	if remoteUser == "" {
+		remoteUser = h.get("User")
+	}
+
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+		if remoteUser == "" {
+			remoteUser = u.Username
+		}
+	}
+
+	matched := true
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		result := false
+		switch criterion {
+		case "all":
+			result = true
+		case "canonical", "final":
+			result = false
+		case "host", "originalhost", "user", "localuser":
+			if i+1 == len(args) {
+				return false, fmt.Errorf("Match %s requires an argument", criterion)
+			}
+			i++
+			patterns := strings.Split(args[i], ",")
+			switch criterion {
+			case "host":
+				result = matchPatternList(patterns, h.hostname())
+			case "originalhost":
+				result = matchPatternList(patterns, h.host)
+			case "user":
+				result = matchPatternList(patterns, remoteUser)
+			case "localuser":
+				result = matchPatternList(patterns, localUser)
+			}
+		default:
+			unsupportedMatch.Lock()
+			if !unsupportedMatch.logged[criterion] {
+				unsupportedMatch.logged[criterion] = true
+				Logger.Printf("Unsupported Match criterion %q in ssh_config, the block is ignored", criterion)
+			}
+			unsupportedMatch.Unlock()
+			return false, nil
+		}
+
+		if result == negate {
+			matched = false
+		}
+	}
+	return matched, nil
+}
+
+// parseSSHConfigLine splits a line into its keyword and arguments,
+// keyword is empty for blank lines and comments
+func parseSSHConfigLine(line string) (keyword string, args []string, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return "", nil, fmt.Errorf("%s requires an argument", line)
+	}
+	keyword = line[0:end]
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var arg strings.Builder
+	inArg, quoted := false, false
+scan:
+	for _, c := range rest {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case quoted:
+			arg.WriteRune(c)
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case c == '#' && !inArg:
+			break scan
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if quoted {
+		return "", nil, fmt.Errorf("Unterminated quote")
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("%s requires an argument", keyword)
+	}
+	return keyword, args, nil
+}
+
+// matchPatternList reports whether s matches the ssh pattern list.  A
+// negated pattern (!pattern) that matches overrides any other match
+func matchPatternList(patterns []string, s string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if matchPattern(pattern[1:], s) {
+				return false
+			}
+		} else if matchPattern(pattern, s) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchPattern matches s against a pattern where * matches any number of
+// characters and ? matches exactly one
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || !strings.EqualFold(pattern[0:1], s[0:1]) {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,348 @@
+package rcom
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeSSHConfig writes the files, named relative to a temporary
+// directory, and returns the directory
+func writeSSHConfig(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rcom")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestParseSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		keyword string
+		args    []string
+	}{
+		{"", "", nil},
+		{"   # comment", "", nil},
+		{"Port 2222", "Port", []string{"2222"}},
+		{"Port=2222", "Port", []string{"2222"}},
+		{"Port = 2222", "Port", []string{"2222"}},
+		{"\tUser\tbob  # trailing comment", "User", []string{"bob"}},
+		{`IdentityFile "/path/with space/id"`, "IdentityFile", []string{"/path/with space/id"}},
+		{`IdentityFile=" quoted # hash "`, "IdentityFile", []string{" quoted # hash "}},
+		{"Host a b\tc", "Host", []string{"a", "b", "c"}},
+		{"Host a#b", "Host", []string{"a#b"}},
+	}
+
+	for _, test := range tests {
+		keyword, args, err := parseSSHConfigLine(test.line)
+		if err != nil {
+			t.Errorf("parseSSHConfigLine(%q) failed: %v", test.line, err)
+		} else if keyword != test.keyword || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("parseSSHConfigLine(%q) = %q %q, want %q %q", test.line, keyword, args, test.keyword, test.args)
+		}
+	}
+
+	for _, line := range []string{"Port", "Port=", "User  # no value", `IdentityFile "unterminated`} {
+		if keyword, args, err := parseSSHConfigLine(line); err == nil {
+			t.Errorf("parseSSHConfigLine(%q) = %q %q, want an error", line, keyword, args)
+		}
+	}
+}
+
+func TestMatchPatternList(t *testing.T) {
+	tests := []struct {
+		patterns string
+		s        string
+		want     bool
+	}{
+		{"*", "anything", true},
+		{"*.example.com", "host.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"host?", "host1", true},
+		{"host?", "host", false},
+		{"HOST", "host", true},
+		{"* !bastion", "bastion", false},
+		{"* !bastion", "router", true},
+		{"!bastion", "router", false},
+		{"a,b,c", "b", true},
+		{"10.0.0.*,!10.0.0.1", "10.0.0.1", false},
+		{"10.0.0.*,!10.0.0.1", "10.0.0.2", true},
+	}
+
+	for _, test := range tests {
+		patterns := strings.FieldsFunc(test.patterns, func(r rune) bool { return r == ' ' || r == ',' })
+		if got := matchPatternList(patterns, test.s); got != test.want {
+			t.Errorf("matchPatternList(%q, %q) = %v, want %v", test.patterns, test.s, got, test.want)
+		}
+	}
+}
+
+func TestLookupSSHConfig(t *testing.T) {
+	dir := writeSSHConfig(t, map[string]string{
+		"config": `
+Host router
+	HostName 10.0.0.1
+	User admin
+	IdentityFile ~/.ssh/router
+
+Host * !bastion
+	User everyone
+	Port 2222
+	IdentityFile ~/.ssh/id_%h_%r_%p_%n_%%
+	IdentityFile=/keys/default
+
+Host bastion
+	User jump
+`,
+	})
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config")
+
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+
+	h, err := lookupSSHConfig("router", "", config)
+	if err != nil {
+		t.Fatalf("lookupSSHConfig failed: %v", err)
+	}
+
+	// the first value wins, except for IdentityFile which accumulates
+	if got := h.get("User"); got != "admin" {
+		t.Errorf("User = %q, want admin", got)
+	}
+
+	if got := h.get("port"); got != "2222" {
+		t.Errorf("Port = %q, want 2222", got)
+	}
+
+	if got := h.hostname(); got != "10.0.0.1" {
+		t.Errorf("hostname = %q, want 10.0.0.1", got)
+	}
+
+	want := []string{
+		filepath.Join(u.HomeDir, ".ssh/router"),
+		filepath.Join(u.HomeDir, ".ssh/id_10.0.0.1_admin_2222_router_%"),
+		"/keys/default",
+	}
+	var got []string
+	for _, file := range h.getAll("IdentityFile") {
+		got = append(got, h.expand(file, "admin"))
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IdentityFile = %q, want %q", got, want)
+	}
+
+	h, err = lookupSSHConfig("bastion", "", config)
+	if err != nil {
+		t.Fatalf("lookupSSHConfig failed: %v", err)
+	}
+
+	if got := h.get("User"); got != "jump" {
+		t.Errorf("User of bastion = %q, want jump", got)
+	}
+
+	if got := h.get("Port"); got != "" {
+		t.Errorf("Port of bastion = %q, want it unset", got)
+	}
+}
+
+func TestSSHConfigExpand(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+
+	h := &sshConfigHost{host: "alias", values: map[string][]string{
+		"hostname": {"%h.example.com"},
+		"port":     {"2200"},
+	}}
+
+	tests := []struct {
+		value string
+		user  string
+		want  string
+	}{
+		{"~", "", u.HomeDir},
+		{"~/.ssh/%n", "", filepath.Join(u.HomeDir, ".ssh/alias")},
+		{"%d/%u", "", u.HomeDir + "/" + u.Username},
+		{"%r@%h:%p", "bob", "bob@alias.example.com:2200"},
+		{"%r", "", u.Username},
+		{"100%%", "", "100%"},
+		{"%x%", "", "%x%"},
+		{"not~/home", "", "not~/home"},
+	}
+
+	for _, test := range tests {
+		if got := h.expand(test.value, test.user); got != test.want {
+			t.Errorf("expand(%q, %q) = %q, want %q", test.value, test.user, got, test.want)
+		}
+	}
+}
+
+func TestSSHConfigMatch(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+
+	dir := writeSSHConfig(t, map[string]string{
+		"config": `
+Host alias
+	HostName real.example.com
+
+Match host real.example.com user bob
+	Port 1001
+
+Match originalhost alias !user bob
+	Port 1002
+
+Match localuser ` + u.Username + ` host *.example.com
+	IdentityFile /keys/local
+
+Match canonical
+	IdentityFile /keys/canonical
+
+Match all
+	IdentityFile /keys/all
+`,
+	})
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config")
+
+	tests := []struct {
+		host  string
+		user  string
+		port  string
+		files []string
+	}{
+		{"alias", "bob", "1001", []string{"/keys/local", "/keys/all"}},
+		{"alias", "alice", "1002", []string{"/keys/local", "/keys/all"}},
+		{"other", "bob", "", []string{"/keys/all"}},
+	}
+
+	for _, test := range tests {
+		h, err := lookupSSHConfig(test.host, test.user, config)
+		if err != nil {
+			t.Fatalf("lookupSSHConfig(%s) failed: %v", test.host, err)
+		}
+
+		if got := h.get("Port"); got != test.port {
+			t.Errorf("Port of %s@%s = %q, want %q", test.user, test.host, got, test.port)
+		}
+
+		if got := h.getAll("IdentityFile"); !reflect.DeepEqual(got, test.files) {
+			t.Errorf("IdentityFile of %s@%s = %q, want %q", test.user, test.host, got, test.files)
+		}
+	}
+}
+
+func TestSSHConfigMatchUnsupported(t *testing.T) {
+	for _, line := range []string{
+		"Match exec \"true\"",
+		"Match !exec \"false\"",
+		"Match all tagged foo",
+		"Match localnetwork 10.0.0.0/8 host *",
+	} {
+		dir := writeSSHConfig(t, map[string]string{"config": line + "\n\tPort 1\nHost *\n\tUser after\n"})
+		defer os.RemoveAll(dir)
+
+		h, err := lookupSSHConfig("host", "", filepath.Join(dir, "config"))
+		if err != nil {
+			t.Errorf("%q failed the lookup: %v", line, err)
+			continue
+		}
+
+		if got := h.get("Port"); got != "" {
+			t.Errorf("%q matched, Port = %q", line, got)
+		}
+
+		if got := h.get("User"); got != "after" {
+			t.Errorf("User after %q = %q, want after", line, got)
+		}
+	}
+}
+
+func TestSSHConfigMatchInvalid(t *testing.T) {
+	for _, line := range []string{
+		"Match host",
+		"Match user",
+	} {
+		dir := writeSSHConfig(t, map[string]string{"config": line + "\n\tPort 1\n"})
+		defer os.RemoveAll(dir)
+
+		if _, err := lookupSSHConfig("host", "", filepath.Join(dir, "config")); err == nil {
+			t.Errorf("%q was accepted", line)
+		}
+	}
+}
+
+func TestSSHConfigInclude(t *testing.T) {
+	dir := writeSSHConfig(t, map[string]string{
+		"config":            "Include conf.d/*.conf\nHost *\n\tUser fallback\n",
+		"conf.d/10-a.conf":  "Host router\n\tUser first\n\tInclude nested/extra\n",
+		"conf.d/20-b.conf":  "Host router\n\tUser second\n",
+		"nested/extra":      "Port 2022\n",
+		"conf.d/nested/not": "Port 1\n",
+		"loop":              "Include loop\n",
+		"missing":           "Include does-not-exist\nUser nobody\n",
+	})
+	defer os.RemoveAll(dir)
+
+	// relative includes, even nested ones, are relative to the directory
+	// of the top level file
+	h, err := lookupSSHConfig("router", "", filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatalf("lookupSSHConfig failed: %v", err)
+	}
+
+	if got := h.get("User"); got != "first" {
+		t.Errorf("User = %q, want first", got)
+	}
+
+	if got := h.get("Port"); got != "2022" {
+		t.Errorf("Port = %q, want 2022", got)
+	}
+
+	// an Include outside a matching Host block is skipped
+	h, err = lookupSSHConfig("other", "", filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatalf("lookupSSHConfig failed: %v", err)
+	}
+
+	if got := h.get("User"); got != "fallback" {
+		t.Errorf("User of other = %q, want fallback", got)
+	}
+
+	if _, err := lookupSSHConfig("router", "", filepath.Join(dir, "loop")); err == nil || !strings.Contains(err.Error(), "nested Include") {
+		t.Errorf("recursive Include = %v, want too many nested Include directives", err)
+	}
+
+	h, err = lookupSSHConfig("router", "", filepath.Join(dir, "missing"), filepath.Join(dir, "no-such-config"))
+	if err != nil {
+		t.Fatalf("lookupSSHConfig with missing files failed: %v", err)
+	}
+
+	if got := h.get("User"); got != "nobody" {
+		t.Errorf("User = %q, want nobody", got)
+	}
+}
@@ -0,0 +1,226 @@
+package rcom
+
+import (
+	"net"
+	"sync"
+)
+
+// telnet commands (RFC 854)
+const (
+	telnetSE   = 240
+	telnetBRK  = 243
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+// telnet options
+const (
+	telnetBinary  = 0
+	telnetSGA     = 3
+	telnetComPort = 44 // RFC 2217
+)
+
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOption
+	telnetStateSB
+	telnetStateSBIAC
+)
+
+// telnetConn strips the telnet protocol from the data read from the
+// underlying connection and escapes IAC in the data written to it.
+// Option negotiation and subnegotiation are reported to the callbacks
+type telnetConn struct {
+	net.Conn
+
+	wmu sync.Mutex
+
+	state   int
+	command byte
+	sb      []byte
+
+	// supported reports whether the given option may be enabled on
+	// our side (local) or on the remote side
+	supported func(option byte, local bool) bool
+
+	onSubnegotiation func(option byte, data []byte)
+	onBreak          func()
+
+	// onNegotiate is told the state of an option on our side (local)
+	// or on the remote side once the remote side has negotiated it
+	onNegotiate func(option byte, local, enabled bool)
+
+	mu     sync.Mutex
+	local  map[byte]bool
+	remote map[byte]bool
+}
+
+func newTelnetConn(conn net.Conn) *telnetConn {
+	return &telnetConn{
+		Conn:   conn,
+		local:  make(map[byte]bool),
+		remote: make(map[byte]bool),
+	}
+}
+
+func (tc *telnetConn) Read(buf []byte) (n int, err error) {
+	for {
+		var read int
+		read, err = tc.Conn.Read(buf)
+		n = 0
+		for _, b := range buf[0:read] {
+			switch tc.state {
+			case telnetStateData:
+				if b == telnetIAC {
+					tc.state = telnetStateIAC
+					continue
+				}
+				buf[n] = b
+				n++
+			case telnetStateIAC:
+				tc.state = telnetStateData
+				switch b {
+				case telnetIAC:
+					buf[n] = b
+					n++
+				case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+					tc.command = b
+					tc.state = telnetStateOption
+				case telnetSB:
+					tc.sb = tc.sb[0:0]
+					tc.state = telnetStateSB
+				case telnetBRK:
+					if tc.onBreak != nil {
+						tc.onBreak()
+					}
+				}
+			case telnetStateOption:
+				tc.state = telnetStateData
+				tc.negotiate(tc.command, b)
+			case telnetStateSB:
+				if b == telnetIAC {
+					tc.state = telnetStateSBIAC
+				} else {
+					tc.sb = append(tc.sb, b)
+				}
+			case telnetStateSBIAC:
+				if b == telnetSE {
+					tc.state = telnetStateData
+					if len(tc.sb) > 0 && tc.onSubnegotiation != nil {
+						tc.onSubnegotiation(tc.sb[0], tc.sb[1:])
+					}
+				} else {
+					tc.state = telnetStateSB
+					tc.sb = append(tc.sb, b)
+				}
+			}
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// negotiate answers an option request, only replying when the state of
+// the option changes so that negotiation can not loop
+func (tc *telnetConn) negotiate(command, option byte) {
+	tc.mu.Lock()
+	var reply byte
+	var enable bool
+	local := command == telnetDO || command == telnetDONT
+	switch command {
+	case telnetDO, telnetDONT:
+		enable = command == telnetDO && tc.supported != nil && tc.supported(option, true)
+		if enable != tc.local[option] || (command == telnetDO && !enable) {
+			tc.local[option] = enable
+			reply = telnetWONT
+			if enable {
+				reply = telnetWILL
+			}
+		}
+	case telnetWILL, telnetWONT:
+		enable = command == telnetWILL && tc.supported != nil && tc.supported(option, false)
+		if enable != tc.remote[option] || (command == telnetWILL && !enable) {
+			tc.remote[option] = enable
+			reply = telnetDONT
+			if enable {
+				reply = telnetDO
+			}
+		}
+	}
+	tc.mu.Unlock()
+
+	if reply != 0 {
+		tc.sendCommand(reply, option)
+	}
+
+	if tc.onNegotiate != nil {
+		tc.onNegotiate(option, local, enable)
+	}
+}
+
+// request asks the remote side to enable an option on our side (WILL)
+// or on its side (DO)
+func (tc *telnetConn) request(command, option byte) error {
+	tc.mu.Lock()
+	switch command {
+	case telnetWILL:
+		tc.local[option] = true
+	case telnetDO:
+		tc.remote[option] = true
+	}
+	tc.mu.Unlock()
+	return tc.sendCommand(command, option)
+}
+
+func (tc *telnetConn) enabled(option byte, local bool) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if local {
+		return tc.local[option]
+	}
+	return tc.remote[option]
+}
+
+func (tc *telnetConn) write(buf []byte) error {
+	tc.wmu.Lock()
+	defer tc.wmu.Unlock()
+	_, err := tc.Conn.Write(buf)
+	return err
+}
+
+func (tc *telnetConn) sendCommand(command, option byte) error {
+	return tc.write([]byte{telnetIAC, command, option})
+}
+
+func (tc *telnetConn) sendSubnegotiation(option byte, data []byte) error {
+	buf := []byte{telnetIAC, telnetSB, option}
+	buf = append(buf, telnetEscape(data)...)
+	buf = append(buf, telnetIAC, telnetSE)
+	return tc.write(buf)
+}
+
+func (tc *telnetConn) Write(buf []byte) (int, error) {
+	if err := tc.write(telnetEscape(buf)); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// telnetEscape doubles every IAC in buf
+func telnetEscape(buf []byte) []byte {
+	escaped := make([]byte, 0, len(buf))
+	for _, b := range buf {
+		if b == telnetIAC {
+			escaped = append(escaped, telnetIAC)
+		}
+		escaped = append(escaped, b)
+	}
+	return escaped
+}
@@ -0,0 +1,147 @@
+package rcom
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// terminal server schemes accepted by ConnectTerminal
+const (
+	schemeRFC2217 = "rfc2217"
+	schemeTelnet  = "telnet"
+	schemeTCP     = "tcp"
+)
+
+// IsTerminalURL reports whether target names a terminal server rather
+// than an ssh host
+func IsTerminalURL(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	switch u.Scheme {
+	case schemeRFC2217, schemeTelnet, schemeTCP:
+		return true
+	}
+	return false
+}
+
+// ConnectTerminal prepares a connection to a terminal server given as
+// rfc2217://host:port, telnet://host:port or tcp://host:port.  No ssh
+// session is used, devices are attached by their TCP port on the
+// terminal server
+func ConnectTerminal(target string, options ...ConfigOption) (*Connection, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid terminal server %q: %v", target, err)
+	}
+
+	if !IsTerminalURL(target) {
+		return nil, fmt.Errorf("Invalid terminal server %q: scheme must be one of %s, %s or %s", target, schemeRFC2217, schemeTelnet, schemeTCP)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("Invalid terminal server %q: no host given", target)
+	}
+
+	config := &Config{
+		clientConfig: ssh.ClientConfig{
+			Timeout: time.Second * 5,
+		},
+	}
+
+	for _, option := range options {
+		if err := option(config); err != nil {
+			return nil, err
+		}
+	}
+
+	conn := newConnection(config)
+	conn.terminal = u
+	return conn, nil
+}
+
+// attachTerminal connects to the terminal server port serving the
+// device and connects it to a link called name.  The connection is
+// added as the endpoint of a second link that plays the role of the
+// remote server, the two links are joined with pipes
+func (conn *Connection) attachTerminal(name string, port string) error {
+	if _, err := strconv.Atoi(port); err != nil {
+		port = conn.terminal.Port()
+	}
+
+	if port == "" {
+		return fmt.Errorf("No terminal server port given for %s", name)
+	}
+
+	addr := net.JoinHostPort(conn.terminal.Hostname(), port)
+	Logger.Printf("Connecting to %s://%s", conn.terminal.Scheme, addr)
+	c, err := net.DialTimeout("tcp", addr, conn.config.clientConfig.Timeout)
+	if err != nil {
+		Logger.Printf("Failed to connect to %s: %v", addr, err)
+		return err
+	}
+
+	var e endpoint
+	switch conn.terminal.Scheme {
+	case schemeRFC2217, schemeTelnet:
+		client := newRFC2217Client(c, conn.terminal.Scheme == schemeRFC2217)
+		if err = client.start(); err != nil {
+			c.Close()
+			return err
+		}
+		e = client
+	default:
+		e = tcpEndpoint{c}
+	}
+
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+	l := newLink(name, frameStream{inw}, conn.config.notify)
+	remote := newLink(addr, frameStream{outw}, nil)
+	conn.links = append(conn.links, l)
+	conn.terminals = append(conn.terminals, remote)
+
+	go func() {
+		remote.copyIn(inr)
+	}()
+
+	go func() {
+		err := remote.add(e)
+		if err != nil && err != io.EOF {
+			Logger.Printf("%s: %v", addr, err)
+		}
+		e.Close()
+		outw.Close()
+	}()
+
+	conn.wg.Add(1)
+	go func() {
+		err := l.copyIn(outr)
+		if err != nil {
+			Logger.Printf("%s: %v", name, err)
+		}
+		e.Close()
+		inw.Close()
+		conn.wg.Done()
+	}()
+	return nil
+}
+
+// tcpEndpoint passes raw data to a terminal server port.  Line
+// settings, modem lines and BREAKs can not be carried and are ignored
+type tcpEndpoint struct {
+	net.Conn
+}
+
+func (tcpEndpoint) SetSettings(*Settings) error                { return nil }
+func (tcpEndpoint) SetModemLines(lines, mask ModemLines) error { return nil }
+func (tcpEndpoint) SendBreak(duration time.Duration) error     { return nil }
+func (tcpEndpoint) watch(events lineEvents)                    {}
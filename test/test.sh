@@ -7,5 +7,5 @@ cd /home/rcom/devel/rcom/cmd/rcom
 ./rcom -debug client -e /home/rcom/devel/rcom/cmd/rcom/rcom server lp:rp &
 sleep 2 # wait for device to be created
 cat lp &
-ssh -i ~/.ssh/id_rsa_rcom server
+ssh -i ~/.ssh/id_ed25519_rcom server
 cd $OLDDIR